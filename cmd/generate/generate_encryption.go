@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"crypto/rand"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -34,18 +33,12 @@ const (
 	defaultTestFilename   = "test_hello.encrypted"
 )
 
-// KeyInfo stores metadata about generated keys
-type KeyInfo struct {
-	MasterKeyHex   string    `json:"master_key_hex"`
-	GeneratedAt    time.Time `json:"generated_at"`
-	TotalShares    int       `json:"total_shares"`
-	RequiredShares int       `json:"required_shares"`
-}
-
 var (
-	keyFile  string
-	keyDir   string
-	testFile string
+	keyFile      string // Pre-keyring master key, migrated on the next generate
+	keyDir       string
+	testFile     string
+	diskImageDir string
+	sealedMode   bool // KEY_MODE=sealed: key material never touches the disk
 )
 
 func main() {
@@ -53,6 +46,25 @@ func main() {
 	fmt.Println("===========================")
 
 	loadConfig()
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "rotate":
+			runRotation(os.Args[2:])
+		case "recipient":
+			runRecipientGeneration(os.Args[2:])
+		case "groups":
+			runGroupGeneration()
+		default:
+			fmt.Println("Usage:")
+			fmt.Println("  generate_encryption                                # Generate a new master key and shares")
+			fmt.Println("  generate_encryption rotate [--s3]                  # Rotate the master key and rewrap snapshots")
+			fmt.Println("  generate_encryption recipient <name> [--no-split]  # Create an X25519 recipient key pair")
+			fmt.Println("  generate_encryption groups                         # Create the Shamir groups of SHAMIR_GROUPS")
+		}
+		return
+	}
+
 	totalShares, threshold, err := validateShamirConfig()
 	if err != nil {
 		fmt.Printf("❌ Failed to load configuration: %v\n", err)
@@ -66,9 +78,19 @@ func main() {
 		os.Exit(1)
 	}
 
-	if _, err := os.Stat(keyFile); err == nil {
-		fmt.Printf("⚠️  Master key already exists at %s\n", keyFile)
-		fmt.Print("Do you want to regenerate it? This will invalidate existing encrypted snapshots! (y/N): ")
+	keyring, err := loadKeyring(keyDir, keyFile)
+	if err == errNoKeyring {
+		keyring = &Keyring{}
+	} else if err != nil {
+		fmt.Printf("❌ Failed to load keyring: %v\n", err)
+		os.Exit(1)
+	}
+
+	var previousKey []byte
+	if active := keyring.active(); active != nil {
+		fmt.Printf("⚠️  Key generation %s is already active (created %s)\n", active.ID, active.CreatedAt.Format("2006-01-02"))
+		fmt.Println("💡 Use 'generate_encryption rotate' to also rewrap existing snapshots to the new key.")
+		fmt.Print("Create a new key generation? Existing snapshots stay readable with their current shares. (y/N): ")
 
 		var response string
 		fmt.Scanln(&response)
@@ -76,7 +98,22 @@ func main() {
 			fmt.Println("✅ Keeping existing key")
 			return
 		}
-		fmt.Println("🔄 Regenerating master key...")
+		fmt.Println("🔄 Creating new key generation...")
+
+		// Repositories are carried over to the new generation
+		keyFiles, _, err := findRepositoryFiles()
+		if err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(1)
+		}
+		if len(keyFiles) > 0 {
+			previousKey, err = readGenerationKey(active, "to carry the repository over")
+			if err != nil {
+				fmt.Printf("❌ Failed to load current master key: %v\n", err)
+				os.Exit(1)
+			}
+			defer wipe(previousKey)
+		}
 	}
 
 	key, err := generateMasterKey()
@@ -84,6 +121,7 @@ func main() {
 		fmt.Printf("❌ Failed to generate master key: %v\n", err)
 		os.Exit(1)
 	}
+	defer wipe(key)
 
 	cleanupOldTestFile()
 
@@ -93,40 +131,110 @@ func main() {
 		os.Exit(1)
 	}
 
-	displayKeyShares(shares, threshold)
-
-	keyInfo := KeyInfo{
-		MasterKeyHex:   hex.EncodeToString(key),
-		GeneratedAt:    time.Now(),
-		TotalShares:    totalShares,
-		RequiredShares: threshold,
+	generation, err := addKeyGeneration(keyring, key, totalShares, threshold, keyStatusActive)
+	if err != nil {
+		fmt.Printf("❌ Failed to store key generation: %v\n", err)
+		os.Exit(1)
 	}
-
-	if err := saveKeyInfo(keyInfo); err != nil {
-		fmt.Printf("❌ Failed to save key info: %v\n", err)
+	unlock, err := lockSnapshotRuns()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
 		os.Exit(1)
 	}
+	defer unlock()
+	if err := activateKeyGeneration(keyring, generation.ID, previousKey, key); err != nil {
+		fmt.Printf("❌ Failed to activate key generation: %v\n", err)
+		os.Exit(1)
+	}
+
+	displayKeyShares("master key generation "+generation.ID, shares, threshold)
 
 	fmt.Printf("%s✅ Encryption setup completed successfully!%s\n", ColorGreen, ColorReset)
-	fmt.Printf("🔑 Master key saved to: %s\n", keyFile)
+	if sealedMode {
+		fmt.Printf("🔒 Sealed mode: key generation %s was not written to disk\n", generation.ID)
+		fmt.Printf("📝 Unseal the snapshot daemon with %d shares ('make unseal') to start taking snapshots\n", threshold)
+		return
+	}
+	fmt.Printf("🔑 Key generation %s saved to: %s\n", generation.ID, generation.KeyFile)
 	fmt.Println("📝 Your snapshot program can now encrypt data using the master key")
 }
 
 func generateMasterKey() ([]byte, error) {
-	key := make([]byte, 32)
+	key := make([]byte, keyLengthBytes)
 	if _, err := rand.Read(key); err != nil {
 		return nil, fmt.Errorf("failed to generate random key: %v", err)
 	}
 
-	keyHex := hex.EncodeToString(key)
-	if err := os.WriteFile(keyFile, []byte(keyHex), 0600); err != nil {
-		return nil, fmt.Errorf("failed to save key to file: %v", err)
-	}
-
 	fmt.Printf("🔑 Generated new 256-bit master key\n")
 	return key, nil
 }
 
+// addKeyGeneration records key in the keyring with the given status and,
+// unless running in sealed mode, stores it under KEY_DIR.
+func addKeyGeneration(keyring *Keyring, key []byte, totalShares, threshold int, status string) (*KeyGeneration, error) {
+	now := time.Now()
+	fingerprint := keyFingerprint(key)
+
+	generation := &KeyGeneration{
+		ID:             newKeyID(now, fingerprint),
+		Fingerprint:    fingerprint,
+		CreatedAt:      now,
+		TotalShares:    totalShares,
+		RequiredShares: threshold,
+		Status:         status,
+	}
+
+	if !sealedMode {
+		if err := storeGenerationKey(keyDir, generation, key); err != nil {
+			return nil, err
+		}
+	}
+
+	keyring.Generations = append(keyring.Generations, generation)
+	if err := saveKeyring(keyDir, keyring); err != nil {
+		return nil, err
+	}
+	return generation, nil
+}
+
+// activateKeyGeneration switches snapshots to the given generation, then
+// deletes the key material of every retired generation from this host, or
+// of every generation in sealed mode. Retired snapshots stay readable with
+// their generation's shares; repositories are carried over from oldKey to
+// key first, unless oldKey is nil because there are none.
+func activateKeyGeneration(keyring *Keyring, id string, oldKey, key []byte) error {
+	if oldKey != nil {
+		if err := carryRepositories(oldKey, id, key); err != nil {
+			return fmt.Errorf("failed to carry repositories over: %v", err)
+		}
+	}
+	if err := keyring.activate(id, time.Now()); err != nil {
+		return err
+	}
+	if err := saveKeyring(keyDir, keyring); err != nil {
+		return err
+	}
+
+	for _, generation := range keyring.Generations {
+		if generation.KeyFile == "" || (generation.Status != keyStatusRetired && !sealedMode) {
+			continue
+		}
+		if err := os.Remove(generation.KeyFile); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove retired key %s: %v", generation.KeyFile, err)
+		}
+		fmt.Printf("🗑️ Removed key material of %s generation %s\n", generation.Status, generation.ID)
+		generation.KeyFile = ""
+	}
+
+	// The pre-keyring info file duplicated the key in hex
+	legacyInfo := filepath.Join(keyDir, legacyInfoFilename)
+	if err := os.Remove(legacyInfo); err == nil {
+		fmt.Printf("🗑️ Removed legacy %s\n", legacyInfo)
+	}
+
+	return saveKeyring(keyDir, keyring)
+}
+
 func createKeyShares(keyHex string, totalShares, requiredShares int) ([]string, error) {
 	fmt.Printf("🔐 Creating %d key shares (threshold: %d)\n", totalShares, requiredShares)
 
@@ -155,6 +263,8 @@ func loadConfig() {
 	keyDir = getConfigValue(envVars, "KEY_DIR", "/app/keys")
 	keyFilename := getConfigValue(envVars, "KEY_FILENAME", "master.key")
 	testFile = getConfigValue(envVars, "TEST_FILE", "/app/test_hello.encrypted")
+	diskImageDir = getConfigValue(envVars, "DISK_IMAGE_DIR", "/app/disk_images")
+	sealedMode = getConfigValue(envVars, "KEY_MODE", "file") == "sealed"
 
 	keyFile = filepath.Join(keyDir, keyFilename)
 }
@@ -224,8 +334,11 @@ func getConfigInt(envVars map[string]string, key string, defaultValue int) int {
 	return defaultValue
 }
 
-func displayKeyShares(shares []string, threshold int) {
+// displayKeyShares prints the shares of keyName, e.g. "master key
+// generation 20250101-0a1b2c3d" or "Shamir group ops".
+func displayKeyShares(keyName string, shares []string, threshold int) {
 	fmt.Println("🔐 ===== ENCRYPTION KEY SHARES =====")
+	fmt.Printf("Key: %s\n", keyName)
 	fmt.Printf("Generated %d key shares (%d required to decrypt)\n", len(shares), threshold)
 	fmt.Println("⚠️  IMPORTANT: Store these shares securely and separately!")
 	fmt.Println()
@@ -241,10 +354,10 @@ func displayKeyShares(shares []string, threshold int) {
 	}
 
 	fmt.Println("📋 DECRYPTION INSTRUCTIONS:")
-	fmt.Printf("   • Any %d of these %d shares can reconstruct the master key\n", threshold, len(shares))
+	fmt.Printf("   • Any %d of these %d shares can reconstruct the %s\n", threshold, len(shares), keyName)
 	fmt.Println("   • Each share should be stored by a different person/system")
 	fmt.Println("   • Never store all shares in the same location")
-	fmt.Println("   • These shares can decrypt ALL future snapshots")
+	fmt.Printf("   • These shares decrypt every snapshot encrypted to the %s\n", keyName)
 	fmt.Println("🔐 ===================================")
 }
 
@@ -255,19 +368,3 @@ func cleanupOldTestFile() {
 		}
 	}
 }
-
-func saveKeyInfo(keyInfo KeyInfo) error {
-	infoFile := keyDir + "/key_info.json"
-
-	jsonData, err := json.MarshalIndent(keyInfo, "", "  ")
-	if err != nil {
-		return fmt.Errorf("failed to marshal key info: %v", err)
-	}
-
-	if err := os.WriteFile(infoFile, jsonData, 0600); err != nil {
-		return fmt.Errorf("failed to save key info: %v", err)
-	}
-
-	fmt.Printf("💾 Key information saved to: %s\n", infoFile)
-	return nil
-}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shamirGroup is one SHAMIR_GROUPS entry: name:threshold/total.
+type shamirGroup struct {
+	Name           string
+	RequiredShares int
+	TotalShares    int
+}
+
+// parseShamirGroups reads SHAMIR_GROUPS, e.g. "ops:2/3,security:3/5".
+func parseShamirGroups(value string) ([]shamirGroup, error) {
+	var groups []shamirGroup
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, quorum, found := strings.Cut(entry, ":")
+		required, total, found2 := strings.Cut(quorum, "/")
+		if !found || !found2 || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid group %q, expected name:threshold/total", entry)
+		}
+
+		group := shamirGroup{Name: strings.TrimSpace(name)}
+		var err error
+		if group.RequiredShares, err = strconv.Atoi(strings.TrimSpace(required)); err != nil {
+			return nil, fmt.Errorf("invalid threshold in group %q", entry)
+		}
+		if group.TotalShares, err = strconv.Atoi(strings.TrimSpace(total)); err != nil {
+			return nil, fmt.Errorf("invalid total shares in group %q", entry)
+		}
+
+		if group.RequiredShares < 2 {
+			return nil, fmt.Errorf("group %s: threshold must be at least 2, got %d", group.Name, group.RequiredShares)
+		}
+		if group.RequiredShares > group.TotalShares {
+			return nil, fmt.Errorf("group %s: threshold (%d) cannot be greater than total shares (%d)", group.Name, group.RequiredShares, group.TotalShares)
+		}
+		if group.TotalShares > 255 {
+			return nil, fmt.Errorf("group %s: at most 255 shares, got %d", group.Name, group.TotalShares)
+		}
+		if seen[group.Name] {
+			return nil, fmt.Errorf("group %s is listed twice", group.Name)
+		}
+		seen[group.Name] = true
+
+		groups = append(groups, group)
+	}
+
+	return groups, nil
+}
+
+// runGroupGeneration brings the keyring's Shamir groups in line with
+// SHAMIR_GROUPS. Each new group gets an X25519 key pair whose private key
+// is split with the group's own quorum and never stored; snapshots are then
+// encrypted to every group. Groups whose quorum changed get a new key, and
+// groups no longer configured are dropped from new snapshots. Existing
+// snapshots keep opening with the shares they were encrypted to.
+func runGroupGeneration() {
+	fmt.Println("👥 Shamir Group Generation")
+	fmt.Println("==========================")
+
+	groups, err := parseShamirGroups(readEnvFile()["SHAMIR_GROUPS"])
+	if err != nil {
+		fmt.Printf("❌ Invalid SHAMIR_GROUPS: %v\n", err)
+		os.Exit(1)
+	}
+	if len(groups) == 0 {
+		fmt.Println("❌ SHAMIR_GROUPS is empty, e.g. SHAMIR_GROUPS=ops:2/3,security:3/5")
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		fmt.Printf("❌ Failed to create key directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	keyring, err := loadKeyring(keyDir, keyFile)
+	if err == errNoKeyring {
+		keyring = &Keyring{}
+	} else if err != nil {
+		fmt.Printf("❌ Failed to load keyring: %v\n", err)
+		os.Exit(1)
+	}
+
+	configured := make(map[string]shamirGroup)
+	for _, group := range groups {
+		configured[group.Name] = group
+	}
+
+	// Keep unchanged groups and every plain recipient
+	var kept []*RecipientKey
+	existing := make(map[string]bool)
+	for _, key := range keyring.Recipients {
+		if !key.Group {
+			kept = append(kept, key)
+			continue
+		}
+
+		group, ok := configured[key.Name]
+		switch {
+		case !ok:
+			fmt.Printf("🗑️ Group %s is no longer configured; new snapshots will not be encrypted to it\n", key.Name)
+		case group.RequiredShares != key.RequiredShares || group.TotalShares != key.TotalShares:
+			fmt.Printf("🔄 Group %s changes from %d/%d to %d/%d shares; creating a new group key\n",
+				key.Name, key.RequiredShares, key.TotalShares, group.RequiredShares, group.TotalShares)
+		default:
+			fmt.Printf("✅ Group %s (%d of %d shares) already exists\n", key.Name, key.RequiredShares, key.TotalShares)
+			kept = append(kept, key)
+			existing[key.Name] = true
+		}
+	}
+
+	type groupShares struct {
+		group  shamirGroup
+		shares []string
+	}
+	var created []groupShares
+
+	for _, group := range groups {
+		if existing[group.Name] {
+			continue
+		}
+
+		key, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			fmt.Printf("❌ Failed to generate key for group %s: %v\n", group.Name, err)
+			os.Exit(1)
+		}
+		privateKey := key.Bytes()
+		shares, err := createKeyShares(hex.EncodeToString(privateKey), group.TotalShares, group.RequiredShares)
+		wipe(privateKey)
+		if err != nil {
+			fmt.Printf("❌ Failed to create shares for group %s: %v\n", group.Name, err)
+			os.Exit(1)
+		}
+
+		publicKey := key.PublicKey().Bytes()
+		kept = append(kept, &RecipientKey{
+			Name:           group.Name,
+			Group:          true,
+			PublicKey:      hex.EncodeToString(publicKey),
+			Fingerprint:    keyFingerprint(publicKey),
+			CreatedAt:      time.Now(),
+			TotalShares:    group.TotalShares,
+			RequiredShares: group.RequiredShares,
+		})
+		created = append(created, groupShares{group: group, shares: shares})
+	}
+
+	keyring.Recipients = kept
+	if err := saveKeyring(keyDir, keyring); err != nil {
+		fmt.Printf("❌ Failed to save keyring: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, c := range created {
+		fmt.Println()
+		displayKeyShares("private key of Shamir group "+c.group.Name, c.shares, c.group.RequiredShares)
+	}
+
+	fmt.Println()
+	fmt.Printf("%s✅ %d Shamir groups configured, %d new%s\n", ColorGreen, len(groups), len(created), ColorReset)
+	fmt.Println("📝 Hand each group's shares to its members only; any one group's quorum opens new snapshots")
+}
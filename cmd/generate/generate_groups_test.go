@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/bits"
+	"testing"
+)
+
+// shareSubsets returns every subset of shares with size shares, in the
+// order they were handed out.
+func shareSubsets(shares []string, size int) [][]string {
+	var subsets [][]string
+	for mask := 0; mask < 1<<len(shares); mask++ {
+		if bits.OnesCount(uint(mask)) != size {
+			continue
+		}
+		var subset []string
+		for i, share := range shares {
+			if mask&(1<<i) != 0 {
+				subset = append(subset, share)
+			}
+		}
+		subsets = append(subsets, subset)
+	}
+	return subsets
+}
+
+func TestShamirSharesKOfN(t *testing.T) {
+	for _, group := range []shamirGroup{{"2/3", 2, 3}, {"3/5", 3, 5}, {"2/2", 2, 2}, {"4/4", 4, 4}} {
+		key := testKey(t)
+		shares, err := createKeyShares(hex.EncodeToString(key), group.TotalShares, group.RequiredShares)
+		if err != nil {
+			t.Fatalf("%s: %v", group.Name, err)
+		}
+		if len(shares) != group.TotalShares {
+			t.Fatalf("%s: got %d shares", group.Name, len(shares))
+		}
+
+		for _, subset := range shareSubsets(shares, group.RequiredShares) {
+			combined, err := combineShares(subset)
+			if err != nil {
+				t.Fatalf("%s: %v", group.Name, err)
+			}
+			if !bytes.Equal(combined, key) {
+				t.Fatalf("%s: %d shares did not recover the key", group.Name, len(subset))
+			}
+		}
+
+		for _, subset := range shareSubsets(shares, group.RequiredShares-1) {
+			combined, err := combineShares(subset)
+			if err == nil && bytes.Equal(combined, key) {
+				t.Fatalf("%s: %d shares recovered the key", group.Name, len(subset))
+			}
+		}
+	}
+}
+
+func TestShamirSharesRepeated(t *testing.T) {
+	key := testKey(t)
+	shares, err := createKeyShares(hex.EncodeToString(key), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	combined, err := combineShares([]string{shares[0], shares[0]})
+	if err == nil && bytes.Equal(combined, key) {
+		t.Fatal("one share entered twice recovered the key")
+	}
+}
+
+func TestParseShamirGroups(t *testing.T) {
+	groups, err := parseShamirGroups(" ops:2/3, security : 3 / 5 ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []shamirGroup{{"ops", 2, 3}, {"security", 3, 5}}
+	if len(groups) != len(want) || groups[0] != want[0] || groups[1] != want[1] {
+		t.Fatalf("got %+v, want %+v", groups, want)
+	}
+
+	for _, value := range []string{"ops", "ops:2", ":2/3", "ops:1/3", "ops:4/3", "ops:2/256", "ops:x/3", "ops:2/3,ops:3/5"} {
+		if _, err := parseShamirGroups(value); err == nil {
+			t.Errorf("%q: accepted", value)
+		}
+	}
+}
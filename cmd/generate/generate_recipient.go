@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// runRecipientGeneration creates an X25519 key pair for a snapshot
+// recipient. Only the public key is kept: it is recorded in the keyring and
+// printed for RECIPIENTS in .env. The private key is shown once, as Shamir
+// shares by default or whole with --no-split (e.g. for a break-glass key
+// kept by the security team).
+func runRecipientGeneration(args []string) {
+	fmt.Println("📬 Recipient Key Generation")
+	fmt.Println("===========================")
+
+	name, split := "", true
+	for _, arg := range args {
+		switch {
+		case arg == "--no-split":
+			split = false
+		case strings.HasPrefix(arg, "-") || name != "":
+			fmt.Printf("❌ Unexpected argument: %s\n", arg)
+			fmt.Println("Usage: generate_encryption recipient <name> [--no-split]")
+			os.Exit(1)
+		default:
+			name = arg
+		}
+	}
+	if name == "" || strings.ContainsAny(name, ":,") {
+		fmt.Println("❌ A recipient name without ':' or ',' is required")
+		fmt.Println("Usage: generate_encryption recipient <name> [--no-split]")
+		os.Exit(1)
+	}
+
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		fmt.Printf("❌ Failed to create key directory: %v\n", err)
+		os.Exit(1)
+	}
+
+	keyring, err := loadKeyring(keyDir, keyFile)
+	if err == errNoKeyring {
+		keyring = &Keyring{}
+	} else if err != nil {
+		fmt.Printf("❌ Failed to load keyring: %v\n", err)
+		os.Exit(1)
+	}
+	for _, existing := range keyring.Recipients {
+		if existing.Name == name {
+			fmt.Printf("❌ Recipient %s already exists (%s)\n", name, existing.Fingerprint)
+			os.Exit(1)
+		}
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Printf("❌ Failed to generate recipient key: %v\n", err)
+		os.Exit(1)
+	}
+	privateKey := key.Bytes()
+	defer wipe(privateKey)
+	publicKey := key.PublicKey().Bytes()
+
+	recipientKey := &RecipientKey{
+		Name:        name,
+		PublicKey:   hex.EncodeToString(publicKey),
+		Fingerprint: keyFingerprint(publicKey),
+		CreatedAt:   time.Now(),
+	}
+
+	var shares []string
+	threshold := 0
+	if split {
+		var totalShares int
+		totalShares, threshold, err = validateShamirConfig()
+		if err != nil {
+			fmt.Printf("❌ Failed to load configuration: %v\n", err)
+			os.Exit(1)
+		}
+		shares, err = createKeyShares(hex.EncodeToString(privateKey), totalShares, threshold)
+		if err != nil {
+			fmt.Printf("❌ Failed to create key shares: %v\n", err)
+			os.Exit(1)
+		}
+		recipientKey.TotalShares = totalShares
+		recipientKey.RequiredShares = threshold
+	}
+
+	keyring.Recipients = append(keyring.Recipients, recipientKey)
+	if err := saveKeyring(keyDir, keyring); err != nil {
+		fmt.Printf("❌ Failed to save keyring: %v\n", err)
+		os.Exit(1)
+	}
+
+	if split {
+		displayKeyShares("private key of recipient "+name, shares, threshold)
+	} else {
+		fmt.Printf("🔑 PRIVATE KEY of recipient %s (shown once, never stored):\n", name)
+		fmt.Printf("   %s%s%s\n", ColorBlue, hex.EncodeToString(privateKey), ColorReset)
+		fmt.Println("⚠️  Whoever holds this key can decrypt every snapshot encrypted to this recipient")
+	}
+
+	fmt.Println()
+	fmt.Printf("%s✅ Recipient %s created (%s)%s\n", ColorGreen, name, recipientKey.Fingerprint, ColorReset)
+	fmt.Println("📝 Add it to RECIPIENTS in .env (comma separated) and restart the container:")
+	fmt.Printf("   %s:%s\n", name, recipientKey.PublicKey)
+}
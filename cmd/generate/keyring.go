@@ -0,0 +1,275 @@
+package main
+
+// Keyring of master key generations.
+//
+// KEY_DIR/keyring.json lists every master key generation with its share
+// parameters and status, but no key material. The active generation's key
+// is stored hex-encoded in KEY_DIR/generations/<id>.key and is the one new
+// snapshots are encrypted with. Retired generations only live on as Shamir
+// shares held by their owners; their ID is recorded in each snapshot's key
+// slots so the decrypt tool knows which shares to ask for.
+//
+// X25519 recipients created by 'generate_encryption recipient' and the
+// Shamir groups created by 'generate_encryption groups' are listed too, with
+// their public key only. Every snapshot is encrypted to the groups.
+//
+// A key directory from before the keyring (master.key + key_info.json) is
+// read as a keyring with a single active generation.
+//
+// This file is shared by cmd/script, cmd/generate and cmd/test; keep the
+// copies identical.
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	keyringFilename       = "keyring.json"
+	keyGenerationsDirname = "generations"
+	legacyInfoFilename    = "key_info.json"
+	masterKeyLength       = 32 // AES-256 master key
+
+	keyStatusActive  = "active"
+	keyStatusPending = "pending" // Created by an unfinished rotation
+	keyStatusRetired = "retired"
+)
+
+var errNoKeyring = errors.New("no master key generation found")
+
+// KeyGeneration describes one master key. KeyFile is only set while the
+// key material is kept on this host.
+type KeyGeneration struct {
+	ID             string     `json:"id"`
+	Fingerprint    string     `json:"fingerprint"`
+	CreatedAt      time.Time  `json:"created_at"`
+	TotalShares    int        `json:"total_shares"`
+	RequiredShares int        `json:"required_shares"`
+	Status         string     `json:"status"`
+	RetiredAt      *time.Time `json:"retired_at,omitempty"`
+	KeyFile        string     `json:"key_file,omitempty"`
+}
+
+// RecipientKey describes an X25519 recipient whose private key was split
+// into Shamir shares. RequiredShares is 0 when it was handed out whole.
+// Group marks the recipients of SHAMIR_GROUPS.
+type RecipientKey struct {
+	Name           string    `json:"name"`
+	Group          bool      `json:"group,omitempty"`
+	PublicKey      string    `json:"public_key"`
+	Fingerprint    string    `json:"fingerprint"`
+	CreatedAt      time.Time `json:"created_at"`
+	TotalShares    int       `json:"total_shares,omitempty"`
+	RequiredShares int       `json:"required_shares,omitempty"`
+}
+
+// Keyring is the content of keyring.json.
+type Keyring struct {
+	ActiveID    string           `json:"active_id"`
+	Generations []*KeyGeneration `json:"generations"`
+	Recipients  []*RecipientKey  `json:"recipients,omitempty"`
+}
+
+// newKeyID derives a readable, unique generation ID from the creation date
+// and the key fingerprint.
+func newKeyID(createdAt time.Time, fingerprint string) string {
+	return fmt.Sprintf("%s-%s", createdAt.UTC().Format("20060102"), fingerprint[:8])
+}
+
+// loadKeyring reads KEY_DIR/keyring.json, falling back to the pre-keyring
+// master key at legacyKeyPath.
+func loadKeyring(keyDir, legacyKeyPath string) (*Keyring, error) {
+	data, err := os.ReadFile(filepath.Join(keyDir, keyringFilename))
+	if os.IsNotExist(err) {
+		return loadLegacyKeyring(keyDir, legacyKeyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %v", err)
+	}
+
+	keyring := &Keyring{}
+	if err := json.Unmarshal(data, keyring); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring: %v", err)
+	}
+	return keyring, nil
+}
+
+// loadLegacyKeyring presents a pre-keyring master.key as a single active
+// generation so existing installations keep working until the next
+// generate or rotate writes a real keyring.
+func loadLegacyKeyring(keyDir, keyPath string) (*Keyring, error) {
+	key, err := readHexKey(keyPath)
+	if os.IsNotExist(err) {
+		return nil, errNoKeyring
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(key)
+
+	generation := &KeyGeneration{
+		Fingerprint: keyFingerprint(key),
+		Status:      keyStatusActive,
+		KeyFile:     keyPath,
+	}
+
+	var info struct {
+		GeneratedAt    time.Time `json:"generated_at"`
+		TotalShares    int       `json:"total_shares"`
+		RequiredShares int       `json:"required_shares"`
+	}
+	if data, err := os.ReadFile(filepath.Join(keyDir, legacyInfoFilename)); err == nil {
+		json.Unmarshal(data, &info)
+	}
+	generation.CreatedAt = info.GeneratedAt
+	generation.TotalShares = info.TotalShares
+	generation.RequiredShares = info.RequiredShares
+	generation.ID = newKeyID(info.GeneratedAt, generation.Fingerprint)
+	if info.GeneratedAt.IsZero() {
+		generation.ID = "legacy-" + generation.Fingerprint[:8]
+	}
+
+	return &Keyring{
+		ActiveID:    generation.ID,
+		Generations: []*KeyGeneration{generation},
+	}, nil
+}
+
+// saveKeyring replaces keyring.json atomically.
+func saveKeyring(keyDir string, keyring *Keyring) error {
+	data, err := json.MarshalIndent(keyring, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal keyring: %v", err)
+	}
+
+	path := filepath.Join(keyDir, keyringFilename)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return fmt.Errorf("failed to save keyring: %v", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (k *Keyring) find(id string) *KeyGeneration {
+	for _, generation := range k.Generations {
+		if generation.ID == id {
+			return generation
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) findByFingerprint(fingerprint string) *KeyGeneration {
+	for _, generation := range k.Generations {
+		if generation.Fingerprint == fingerprint {
+			return generation
+		}
+	}
+	return nil
+}
+
+func (k *Keyring) findRecipient(fingerprint string) *RecipientKey {
+	for _, recipient := range k.Recipients {
+		if recipient.Fingerprint == fingerprint {
+			return recipient
+		}
+	}
+	return nil
+}
+
+// groups returns the Shamir groups as recipients to encrypt to.
+func (k *Keyring) groups() ([]recipient, error) {
+	var groups []recipient
+	for _, key := range k.Recipients {
+		if !key.Group {
+			continue
+		}
+		publicKey, err := hex.DecodeString(key.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("group %s: invalid public key: %v", key.Name, err)
+		}
+		groups = append(groups, recipient{
+			Name:           key.Name,
+			PublicKey:      publicKey,
+			RequiredShares: key.RequiredShares,
+			TotalShares:    key.TotalShares,
+		})
+	}
+	return groups, nil
+}
+
+func (k *Keyring) active() *KeyGeneration {
+	if k.ActiveID == "" {
+		return nil
+	}
+	return k.find(k.ActiveID)
+}
+
+// activate makes id the active generation and retires the previous one.
+func (k *Keyring) activate(id string, now time.Time) error {
+	generation := k.find(id)
+	if generation == nil {
+		return fmt.Errorf("unknown key generation %s", id)
+	}
+
+	if previous := k.active(); previous != nil && previous.ID != id {
+		previous.Status = keyStatusRetired
+		previous.RetiredAt = &now
+	}
+
+	generation.Status = keyStatusActive
+	generation.RetiredAt = nil
+	k.ActiveID = id
+	return nil
+}
+
+// storeGenerationKey writes a generation's key material under KEY_DIR.
+func storeGenerationKey(keyDir string, generation *KeyGeneration, key []byte) error {
+	dir := filepath.Join(keyDir, keyGenerationsDirname)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	generation.KeyFile = filepath.Join(dir, generation.ID+".key")
+	return os.WriteFile(generation.KeyFile, []byte(hex.EncodeToString(key)), 0600)
+}
+
+// loadGenerationKey reads a generation's key and checks it against the
+// fingerprint recorded in the keyring.
+func loadGenerationKey(generation *KeyGeneration) ([]byte, error) {
+	if generation.KeyFile == "" {
+		return nil, fmt.Errorf("key generation %s is not stored on this host", generation.ID)
+	}
+
+	key, err := readHexKey(generation.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key generation %s: %v", generation.ID, err)
+	}
+	if keyFingerprint(key) != generation.Fingerprint {
+		wipe(key)
+		return nil, fmt.Errorf("key file %s does not match generation %s", generation.KeyFile, generation.ID)
+	}
+	return key, nil
+}
+
+func readHexKey(path string) ([]byte, error) {
+	keyHex, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(keyHex)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key: %v", err)
+	}
+	if len(key) != masterKeyLength {
+		wipe(key)
+		return nil, fmt.Errorf("invalid key length: expected %d bytes, got %d", masterKeyLength, len(key))
+	}
+	return key, nil
+}
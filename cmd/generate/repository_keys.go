@@ -0,0 +1,162 @@
+package main
+
+// Carrying repositories over to a new key generation.
+//
+// The secret in DISK_IMAGE_DIR/.../repository/key.encrypted is shared by
+// every snapshot of a repository, so unlike a snapshot it has to open with
+// the active generation: activating a generation rewraps it from the
+// previous key to the new one. Local trees get a slot for the new
+// generation next to their own, so garbage collection can read the trees
+// written before trees had a repository slot; this opens nothing the
+// rewrapped secret does not already open.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	repositoryDirName     = "repository"
+	repositoryKeyFilename = "key.encrypted"
+	repositoryTreeSuffix  = ".tree.encrypted"
+)
+
+// findRepositoryFiles lists the repository secrets and trees under
+// DISK_IMAGE_DIR, one repository per host in pull mode.
+func findRepositoryFiles() (keyFiles, trees []string, err error) {
+	err = filepath.WalkDir(diskImageDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && d.Name() == "chunks" && filepath.Base(filepath.Dir(path)) == repositoryDirName {
+			return filepath.SkipDir
+		}
+		switch {
+		case d.IsDir():
+		case d.Name() == repositoryKeyFilename && filepath.Base(filepath.Dir(path)) == repositoryDirName:
+			keyFiles = append(keyFiles, path)
+		case strings.HasSuffix(d.Name(), repositoryTreeSuffix):
+			trees = append(trees, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to scan %s: %v", diskImageDir, err)
+	}
+	return keyFiles, trees, nil
+}
+
+// readGenerationKey returns the key of a generation from KEY_DIR or, when
+// it is not stored on this host, from its shares.
+func readGenerationKey(generation *KeyGeneration, purpose string) ([]byte, error) {
+	if generation.KeyFile != "" {
+		return loadGenerationKey(generation)
+	}
+
+	fmt.Printf("Enter %d shares of the CURRENT master key (generation %s) %s.\n", generation.RequiredShares, generation.ID, purpose)
+	key, err := combineShares(readShares(generation.RequiredShares))
+	if err != nil {
+		return nil, err
+	}
+	if keyFingerprint(key) != generation.Fingerprint {
+		wipe(key)
+		return nil, fmt.Errorf("shares do not match key generation %s (%s)", generation.ID, generation.Fingerprint)
+	}
+	return key, nil
+}
+
+// carryRepositories rewraps every repository secret from oldKey to the new
+// generation and adds a slot for it to every local tree oldKey opens.
+func carryRepositories(oldKey []byte, newKeyID string, newKey []byte) error {
+	keyFiles, trees, err := findRepositoryFiles()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range keyFiles {
+		action, err := rewrapSnapshotFile(path, oldKey, newKeyID, newKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Printf("   🧩 %s (%s)\n", path, action)
+	}
+
+	added := 0
+	for _, path := range trees {
+		err := addGenerationSlot(path, oldKey, newKeyID, newKey)
+		if errors.Is(err, errAlreadyRewrapped) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		added++
+	}
+	if added > 0 {
+		fmt.Printf("   🧩 Added key generation %s to %d repository trees\n", newKeyID, added)
+	}
+	return nil
+}
+
+// addGenerationSlot adds a master slot for newKey to the file at path,
+// through a temporary file, keeping its modification time. Files oldKey
+// does not open are left alone.
+func addGenerationSlot(path string, oldKey []byte, newKeyID string, newKey []byte) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := describeSnapshotFile(src)
+	if err != nil {
+		return err
+	}
+	if !hasMasterSlot(header, oldKey) {
+		return errAlreadyRewrapped
+	}
+	if _, err := src.Seek(0, 0); err != nil {
+		return err
+	}
+
+	tmpPath := path + rotationTempSuffix
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(dst)
+	err = addKeySlot(out, src, oldKey, keySlotMaster, newKeyID, newKey)
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	return finishRewrappedFile(dst, tmpPath, path, info.ModTime())
+}
+
+// hasMasterSlot reports whether key opens one of the header's master slots.
+func hasMasterSlot(header *snapshotHeader, key []byte) bool {
+	if header == nil {
+		return false
+	}
+	fingerprint := keyFingerprint(key)
+	for _, slot := range header.KeySlots {
+		if slot.Type == keySlotMaster && slot.KeyFingerprint == fingerprint {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/vault/shamir"
+)
+
+const (
+	rotationJournalFilename = "rotation_journal.json"
+	rotationTempSuffix      = ".rotating"
+)
+
+// RotationJournal records the progress of a master key rotation so that an
+// interrupted run can be resumed without losing track of which snapshots
+// already open with the new key.
+type RotationJournal struct {
+	StartedAt      time.Time       `json:"started_at"`
+	OldKeyID       string          `json:"old_key_id"`
+	OldFingerprint string          `json:"old_fingerprint"`
+	NewKeyID       string          `json:"new_key_id"`
+	NewFingerprint string          `json:"new_fingerprint"`
+	IncludeS3      bool            `json:"include_s3"`
+	Completed      map[string]bool `json:"completed"`
+}
+
+func runRotation(args []string) {
+	fmt.Println("🔄 Master Key Rotation")
+	fmt.Println("======================")
+
+	includeS3 := false
+	for _, arg := range args {
+		switch arg {
+		case "--s3":
+			includeS3 = true
+		default:
+			fmt.Printf("❌ Unknown rotate option: %s\n", arg)
+			fmt.Println("Usage: generate_encryption rotate [--s3]")
+			os.Exit(1)
+		}
+	}
+
+	totalShares, threshold, err := validateShamirConfig()
+	if err != nil {
+		fmt.Printf("❌ Failed to load configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	journal, err := loadRotationJournal()
+	if err != nil {
+		fmt.Printf("❌ Failed to read rotation journal: %v\n", err)
+		os.Exit(1)
+	}
+
+	keyring, err := loadKeyring(keyDir, keyFile)
+	if err != nil {
+		fmt.Printf("❌ Failed to load keyring: %v\n", err)
+		os.Exit(1)
+	}
+
+	var oldGeneration *KeyGeneration
+	if journal != nil {
+		fmt.Printf("%s⚠️  Resuming rotation started at %s (%d items done)%s\n",
+			ColorYellow, journal.StartedAt.Format(time.RFC3339), len(journal.Completed), ColorReset)
+		includeS3 = includeS3 || journal.IncludeS3
+		oldGeneration = keyring.find(journal.OldKeyID)
+	} else {
+		oldGeneration = keyring.active()
+	}
+	if oldGeneration == nil {
+		fmt.Println("❌ No active key generation found, nothing to rotate")
+		os.Exit(1)
+	}
+
+	oldThreshold := threshold
+	if oldGeneration.RequiredShares > 0 {
+		oldThreshold = oldGeneration.RequiredShares
+	}
+
+	fmt.Printf("Enter %d shares of the CURRENT master key (generation %s).\n", oldThreshold, oldGeneration.ID)
+	oldKey, err := combineShares(readShares(oldThreshold))
+	if err != nil {
+		fmt.Printf("❌ Failed to reconstruct current master key: %v\n", err)
+		os.Exit(1)
+	}
+	defer wipe(oldKey)
+
+	if keyFingerprint(oldKey) != oldGeneration.Fingerprint {
+		fmt.Printf("❌ Shares do not match key generation %s (%s)\n", oldGeneration.ID, oldGeneration.Fingerprint)
+		os.Exit(1)
+	}
+
+	newKey, journal, err := prepareRotationKey(keyring, journal, oldGeneration, includeS3, totalShares, threshold)
+	if err != nil {
+		fmt.Printf("❌ Failed to prepare new master key: %v\n", err)
+		os.Exit(1)
+	}
+	defer wipe(newKey)
+
+	unlock, err := lockSnapshotRuns()
+	if err != nil {
+		fmt.Printf("❌ %v\n", err)
+		os.Exit(1)
+	}
+	defer unlock()
+
+	fmt.Printf("🔑 Rotating %s → %s\n", journal.OldKeyID, journal.NewKeyID)
+
+	if err := rotateLocalSnapshots(journal, oldKey, newKey); err != nil {
+		fmt.Printf("❌ Rotation interrupted: %v\n", err)
+		fmt.Println("   Fix the problem and run 'rotate' again to resume.")
+		os.Exit(1)
+	}
+
+	if includeS3 {
+		if err := rotateS3Snapshots(journal, oldKey, newKey); err != nil {
+			fmt.Printf("❌ Rotation interrupted: %v\n", err)
+			fmt.Println("   Fix the problem and run 'rotate' again to resume.")
+			os.Exit(1)
+		}
+	}
+
+	if err := activateKeyGeneration(keyring, journal.NewKeyID, oldKey, newKey); err != nil {
+		fmt.Printf("❌ Failed to activate new master key: %v\n", err)
+		os.Exit(1)
+	}
+
+	if !sealedMode {
+		shares, err := createKeyShares(hex.EncodeToString(newKey), totalShares, threshold)
+		if err != nil {
+			fmt.Printf("❌ Failed to create key shares: %v\n", err)
+			fmt.Println("   Run 'rotate' again to regenerate the shares of the new key.")
+			os.Exit(1)
+		}
+
+		displayKeyShares("master key generation "+journal.NewKeyID, shares, threshold)
+	}
+
+	if err := os.Remove(rotationJournalPath()); err != nil && !os.IsNotExist(err) {
+		fmt.Printf("⚠️  Failed to remove rotation journal: %v\n", err)
+	}
+
+	fmt.Printf("%s✅ Master key rotated: %d snapshots now use key generation %s%s\n",
+		ColorGreen, len(journal.Completed), journal.NewKeyID, ColorReset)
+	fmt.Println("⚠️  The old key shares no longer open any rotated snapshot. Destroy them.")
+	if sealedMode {
+		fmt.Println("🔒 The snapshot daemon seals itself before its next snapshot; unseal it with the new shares ('make unseal').")
+	}
+}
+
+// prepareRotationKey returns the key being rotated to. A fresh rotation
+// generates it and stores it as a pending keyring generation until every
+// snapshot has been rewrapped; a resumed rotation reloads it.
+func prepareRotationKey(keyring *Keyring, journal *RotationJournal, oldGeneration *KeyGeneration, includeS3 bool, totalShares, threshold int) ([]byte, *RotationJournal, error) {
+	if journal != nil {
+		generation := keyring.find(journal.NewKeyID)
+		if generation == nil {
+			return nil, nil, fmt.Errorf("key generation %s is missing from the keyring", journal.NewKeyID)
+		}
+		if sealedMode {
+			return readRotationKey(generation, journal)
+		}
+		key, err := loadGenerationKey(generation)
+		if err != nil {
+			return nil, nil, err
+		}
+		return key, journal, nil
+	}
+
+	newKey, err := generateMasterKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	generation, err := addKeyGeneration(keyring, newKey, totalShares, threshold, keyStatusPending)
+	if err != nil {
+		wipe(newKey)
+		return nil, nil, fmt.Errorf("failed to store new key generation: %v", err)
+	}
+
+	journal = &RotationJournal{
+		StartedAt:      time.Now(),
+		OldKeyID:       oldGeneration.ID,
+		OldFingerprint: oldGeneration.Fingerprint,
+		NewKeyID:       generation.ID,
+		NewFingerprint: generation.Fingerprint,
+		IncludeS3:      includeS3,
+		Completed:      make(map[string]bool),
+	}
+	if err := saveRotationJournal(journal); err != nil {
+		return nil, nil, err
+	}
+
+	if sealedMode {
+		// Nothing on disk can bring the new key back if the rotation is
+		// interrupted, so hand out its shares before rewrapping anything.
+		shares, err := createKeyShares(hex.EncodeToString(newKey), totalShares, threshold)
+		if err != nil {
+			return nil, nil, err
+		}
+		displayKeyShares("master key generation "+generation.ID, shares, threshold)
+		fmt.Printf("🔒 Key generation %s pending; its shares are needed to resume an interrupted rotation\n", generation.ID)
+		return newKey, journal, nil
+	}
+
+	fmt.Printf("🔑 Key generation %s pending in %s\n", generation.ID, generation.KeyFile)
+	return newKey, journal, nil
+}
+
+// readRotationKey reconstructs the pending key of a sealed-mode rotation
+// from the shares handed out when it started.
+func readRotationKey(generation *KeyGeneration, journal *RotationJournal) ([]byte, *RotationJournal, error) {
+	fmt.Printf("Enter %d shares of the NEW master key (generation %s).\n", generation.RequiredShares, generation.ID)
+	key, err := combineShares(readShares(generation.RequiredShares))
+	if err != nil {
+		return nil, nil, err
+	}
+	if keyFingerprint(key) != generation.Fingerprint {
+		wipe(key)
+		return nil, nil, fmt.Errorf("shares do not match key generation %s (%s)", generation.ID, generation.Fingerprint)
+	}
+	return key, journal, nil
+}
+
+func rotateLocalSnapshots(journal *RotationJournal, oldKey, newKey []byte) error {
+	var files []string
+	if _, err := os.Stat(testFile); err == nil {
+		files = append(files, testFile)
+	}
+
+	err := filepath.WalkDir(diskImageDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".encrypted") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to scan %s: %v", diskImageDir, err)
+	}
+	sort.Strings(files)
+
+	for _, path := range files {
+		entry := "local:" + path
+		if journal.Completed[entry] {
+			continue
+		}
+
+		action, err := rewrapSnapshotFile(path, oldKey, journal.NewKeyID, newKey)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		fmt.Printf("   🔁 %s (%s)\n", path, action)
+
+		journal.Completed[entry] = true
+		if err := saveRotationJournal(journal); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rewrapSnapshotFile rewrites a snapshot in place through a temporary file,
+// keeping its modification time so retention still sees the original age.
+func rewrapSnapshotFile(path string, oldKey []byte, newKeyID string, newKey []byte) (string, error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	tmpPath := path + rotationTempSuffix
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	out := bufio.NewWriter(dst)
+	reencrypted, err := rewrapStream(out, src, oldKey, newKeyID, newKey)
+	if errors.Is(err, errAlreadyRewrapped) {
+		dst.Close()
+		os.Remove(tmpPath)
+		return "already rotated", nil
+	}
+	if errors.Is(err, errNoMasterSlot) {
+		dst.Close()
+		os.Remove(tmpPath)
+		return "skipped, recipients only", nil
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return "", err
+	}
+
+	if err := finishRewrappedFile(dst, tmpPath, path, info.ModTime()); err != nil {
+		return "", err
+	}
+
+	if reencrypted {
+		return "re-encrypted", nil
+	}
+	return "rewrapped", nil
+}
+
+func finishRewrappedFile(dst *os.File, tmpPath, path string, modTime time.Time) error {
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Chtimes(tmpPath, modTime, modTime); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func rotationJournalPath() string {
+	return filepath.Join(keyDir, rotationJournalFilename)
+}
+
+func loadRotationJournal() (*RotationJournal, error) {
+	data, err := os.ReadFile(rotationJournalPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &RotationJournal{}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, err
+	}
+	if journal.Completed == nil {
+		journal.Completed = make(map[string]bool)
+	}
+	return journal, nil
+}
+
+// saveRotationJournal replaces the journal atomically so a crash never
+// leaves a half-written file behind.
+func saveRotationJournal(journal *RotationJournal) error {
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal rotation journal: %v", err)
+	}
+
+	tmpPath := rotationJournalPath() + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to save rotation journal: %v", err)
+	}
+	return os.Rename(tmpPath, rotationJournalPath())
+}
+
+func readShares(count int) []string {
+	reader := bufio.NewReader(os.Stdin)
+	shares := make([]string, count)
+	for i := 0; i < count; i++ {
+		fmt.Printf("Enter KEY SHARE #%d: ", i+1)
+		share, _ := reader.ReadString('\n')
+		shares[i] = strings.TrimSpace(share)
+	}
+	return shares
+}
+
+func combineShares(shares []string) ([]byte, error) {
+	shareBytes := make([][]byte, len(shares))
+	for i, share := range shares {
+		bytes, err := hex.DecodeString(share)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hex in share %d: %v", i+1, err)
+		}
+		shareBytes[i] = bytes
+	}
+
+	key, err := shamir.Combine(shareBytes)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keyLengthBytes {
+		return nil, fmt.Errorf("invalid key length: expected %d bytes, got %d", keyLengthBytes, len(key))
+	}
+	return key, nil
+}
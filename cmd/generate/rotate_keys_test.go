@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, keyLengthBytes)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// sealTestSnapshot encrypts plaintext with key and returns the file and the
+// length of its segments.
+func sealTestSnapshot(t *testing.T, plaintext, key []byte) ([]byte, int) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encryptStream(&buf, bytes.NewReader(plaintext), "old", key, nil, "", -1); err != nil {
+		t.Fatal(err)
+	}
+	segments := (len(plaintext) + streamSegmentSize - 1) / streamSegmentSize
+	return buf.Bytes(), len(plaintext) + segments*streamTagSize
+}
+
+func assertOpens(t *testing.T, data, key, plaintext []byte) {
+	t.Helper()
+	var out bytes.Buffer
+	if _, err := decryptStreamTo(&out, bytes.NewReader(data), key); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), plaintext) {
+		t.Fatal("decrypted plaintext differs")
+	}
+}
+
+func TestRewrapStreamIdempotent(t *testing.T) {
+	oldKey, newKey := testKey(t), testKey(t)
+	plaintext := make([]byte, 2*streamSegmentSize+5)
+	rand.Read(plaintext)
+	data, segments := sealTestSnapshot(t, plaintext, oldKey)
+
+	var rewrapped bytes.Buffer
+	reencrypted, err := rewrapStream(&rewrapped, bytes.NewReader(data), oldKey, "new", newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reencrypted {
+		t.Fatal("version 3 snapshot was re-encrypted instead of rewrapped")
+	}
+	if !bytes.Equal(rewrapped.Bytes()[rewrapped.Len()-segments:], data[len(data)-segments:]) {
+		t.Fatal("rewrapping changed the segments")
+	}
+	assertOpens(t, rewrapped.Bytes(), newKey, plaintext)
+	if _, err := decryptStreamTo(&bytes.Buffer{}, bytes.NewReader(rewrapped.Bytes()), oldKey); err == nil {
+		t.Fatal("rewrapped snapshot still opens with the old key")
+	}
+
+	var again bytes.Buffer
+	_, err = rewrapStream(&again, bytes.NewReader(rewrapped.Bytes()), oldKey, "new", newKey)
+	if !errors.Is(err, errAlreadyRewrapped) {
+		t.Fatalf("second rewrap: got %v, want errAlreadyRewrapped", err)
+	}
+	if again.Len() != 0 {
+		t.Fatal("second rewrap wrote output")
+	}
+}
+
+// A rotation interrupted after a snapshot got its new slot, but before the
+// old one was dropped, finishes the snapshot on the next run.
+func TestRewrapStreamHalfRotated(t *testing.T) {
+	oldKey, newKey := testKey(t), testKey(t)
+	plaintext := []byte("half rotated")
+	data, _ := sealTestSnapshot(t, plaintext, oldKey)
+
+	var both bytes.Buffer
+	if err := addKeySlot(&both, bytes.NewReader(data), oldKey, keySlotMaster, "new", newKey); err != nil {
+		t.Fatal(err)
+	}
+
+	var rewrapped bytes.Buffer
+	if _, err := rewrapStream(&rewrapped, bytes.NewReader(both.Bytes()), oldKey, "new", newKey); err != nil {
+		t.Fatal(err)
+	}
+	header, err := describeSnapshotFile(bytes.NewReader(rewrapped.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.KeySlots) != 1 || header.KeySlots[0].KeyFingerprint != keyFingerprint(newKey) {
+		t.Fatalf("got key slots %+v, want the new key's only", header.KeySlots)
+	}
+	assertOpens(t, rewrapped.Bytes(), newKey, plaintext)
+}
+
+func TestRewrapSnapshotFileIdempotent(t *testing.T) {
+	oldKey, newKey := testKey(t), testKey(t)
+	plaintext := []byte("rotate me")
+	data, _ := sealTestSnapshot(t, plaintext, oldKey)
+
+	path := filepath.Join(t.TempDir(), "snapshot.encrypted")
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rewrapSnapshotFile(path, oldKey, "new", newKey); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertOpens(t, rotated, newKey, plaintext)
+
+	action, err := rewrapSnapshotFile(path, oldKey, "new", newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if action != "already rotated" {
+		t.Fatalf("second rewrap: %s", action)
+	}
+	again, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, rotated) {
+		t.Fatal("second rewrap changed the file")
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.ModTime().Equal(modTime) {
+		t.Fatalf("modification time %s, want %s", info.ModTime(), modTime)
+	}
+	if _, err := os.Stat(path + rotationTempSuffix); !os.IsNotExist(err) {
+		t.Fatal("temporary file left behind")
+	}
+}
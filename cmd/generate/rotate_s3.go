@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// S3Config holds the bucket settings shared with the snapshot uploader
+type S3Config struct {
+	Endpoint        string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	BucketName      string
+	BucketPrefix    string
+}
+
+func getS3Config() (S3Config, error) {
+	envVars := readEnvFile()
+
+	cfg := S3Config{
+		Endpoint:        getConfigValue(envVars, "S3_ENDPOINT", "https://s3.gra.io.cloud.ovh.net"),
+		Region:          getConfigValue(envVars, "S3_REGION", "gra"),
+		AccessKeyID:     envVars["S3_ACCESS_KEY_ID"],
+		SecretAccessKey: envVars["S3_SECRET_ACCESS_KEY"],
+		BucketName:      envVars["S3_BUCKET_NAME"],
+		BucketPrefix:    getConfigValue(envVars, "S3_BUCKET_PREFIX", "backups"),
+	}
+
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return cfg, fmt.Errorf("S3 credentials are not configured")
+	}
+	if cfg.BucketName == "" {
+		return cfg, fmt.Errorf("S3 bucket name is not configured")
+	}
+	return cfg, nil
+}
+
+func newS3Client(cfg S3Config) (*s3.Client, error) {
+	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
+		return aws.Endpoint{
+			URL:               cfg.Endpoint,
+			SigningRegion:     cfg.Region,
+			HostnameImmutable: true,
+		}, nil
+	})
+
+	awsConfig, err := config.LoadDefaultConfig(context.TODO(),
+		config.WithRegion(cfg.Region),
+		config.WithEndpointResolverWithOptions(customResolver),
+		config.WithCredentialsProvider(credentials.NewStaticCredentialsProvider(
+			cfg.AccessKeyID,
+			cfg.SecretAccessKey,
+			"",
+		)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
+	}
+
+	return s3.NewFromConfig(awsConfig), nil
+}
+
+// rotateS3Snapshots rewraps every .encrypted object under the bucket prefix.
+// Objects are staged in temporary files so uploads always have a known
+// length, and each finished key is recorded in the journal.
+func rotateS3Snapshots(journal *RotationJournal, oldKey, newKey []byte) error {
+	cfg, err := getS3Config()
+	if err != nil {
+		return err
+	}
+
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("☁️ Rotating snapshots in s3://%s/%s\n", cfg.BucketName, cfg.BucketPrefix)
+
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(cfg.BucketName),
+		Prefix: aws.String(cfg.BucketPrefix),
+	})
+
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return fmt.Errorf("failed to list bucket: %v", err)
+		}
+
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			entry := "s3:" + key
+			if !strings.HasSuffix(key, ".encrypted") || journal.Completed[entry] {
+				continue
+			}
+
+			action, err := rewrapS3Object(client, cfg.BucketName, key, oldKey, journal.NewKeyID, newKey)
+			if err != nil {
+				return fmt.Errorf("s3://%s/%s: %v", cfg.BucketName, key, err)
+			}
+			fmt.Printf("   🔁 s3://%s/%s (%s)\n", cfg.BucketName, key, action)
+
+			journal.Completed[entry] = true
+			if err := saveRotationJournal(journal); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func rewrapS3Object(client *s3.Client, bucket, key string, oldKey []byte, newKeyID string, newKey []byte) (string, error) {
+	src, err := os.CreateTemp("", "rotate-src-*.encrypted")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(src.Name())
+	defer src.Close()
+
+	object, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to download: %v", err)
+	}
+	_, err = io.Copy(src, object.Body)
+	object.Body.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to download: %v", err)
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	dst, err := os.CreateTemp("", "rotate-dst-*.encrypted")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(dst.Name())
+	defer dst.Close()
+
+	out := bufio.NewWriter(dst)
+	reencrypted, err := rewrapStream(out, src, oldKey, newKeyID, newKey)
+	if errors.Is(err, errAlreadyRewrapped) {
+		return "already rotated", nil
+	}
+	if errors.Is(err, errNoMasterSlot) {
+		return "skipped, recipients only", nil
+	}
+	if err == nil {
+		err = out.Flush()
+	}
+	if err != nil {
+		return "", err
+	}
+	if _, err := dst.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Body:   dst,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload: %v", err)
+	}
+
+	if reencrypted {
+		return "re-encrypted", nil
+	}
+	return "rewrapped", nil
+}
@@ -0,0 +1,40 @@
+package main
+
+// The snapshot run lock, KEY_DIR/snapshot.lock, also taken by every
+// snapshot run (cmd/script/run_lock.go). Rewrapping files while a run
+// writes them could rewrap a half-written snapshot, or have the run
+// overwrite the rewrapped file, so rotation and activation hold it for
+// their whole sweep; snapshot runs starting meanwhile are skipped.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const runLockFilename = "snapshot.lock"
+
+// lockSnapshotRuns waits for a running snapshot to finish and takes the
+// run lock. The lock is released by the returned function, or when the
+// process exits.
+func lockSnapshotRuns() (func(), error) {
+	path := filepath.Join(keyDir, runLockFilename)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+
+	fd := int(file.Fd())
+	err = syscall.Flock(fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		fmt.Println("⏳ Waiting for the running snapshot to finish...")
+		err = syscall.Flock(fd, syscall.LOCK_EX)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return func() { file.Close() }, nil
+}
@@ -0,0 +1,416 @@
+package main
+
+// Point-in-time capture (CAPTURE_BACKEND).
+//
+// Walking a live tree archives each file as it is when read, so files
+// written during the walk can disagree with each other. With a capture
+// backend, the sources are frozen before they are walked:
+//
+//	btrfs  a read-only snapshot of the subvolume holding the source, in
+//	       <subvolume>/.mobula-snapshots
+//	lvm    a thin snapshot of the LVM thin volume mounted at the source,
+//	       mounted read-only under TEMP_MOUNT_POINT/capture
+//
+// The archive is then read from the snapshot, with the names, rules and
+// index of the live paths, and the snapshot is removed once the sources
+// are archived. Sources on the same subvolume or volume share a snapshot,
+// and all snapshots are taken before any source is walked. CAPTURE_BACKEND
+// auto uses whichever backend a source is on and archives the others live;
+// btrfs or lvm fail the snapshot when a source cannot be captured that way.
+// Snapshots left by an interrupted run are removed by the next one, before
+// it takes its own. Overlay filesystems, such as a container's root, are
+// always archived live.
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	captureLive  = "live"
+	captureAuto  = "auto"
+	captureBtrfs = "btrfs"
+	captureLVM   = "lvm"
+
+	btrfsSuperMagic     = 0x9123683e
+	btrfsSubvolumeInode = 256 // Every subvolume root has this inode number
+
+	captureSnapshotDir = ".mobula-snapshots"
+	capturePrefix      = "mobula-snap-"
+)
+
+// isCaptureBackend reports whether backend is a supported CAPTURE_BACKEND.
+func isCaptureBackend(backend string) bool {
+	switch backend {
+	case captureLive, captureAuto, captureBtrfs, captureLVM:
+		return true
+	}
+	return false
+}
+
+// capture is one frozen snapshot, shared by the sources it holds.
+type capture struct {
+	backend  string
+	origin   string // Live directory the snapshot was taken of
+	view     string // Where the snapshot's copy of origin can be read
+	snapshot string // btrfs subvolume or vg/lv to remove
+	mount    string // lvm: mount point to unmount
+}
+
+// sourceCapture maps a source to its frozen view.
+type sourceCapture struct {
+	capture *capture
+	view    string // Copy of the source path in the snapshot
+}
+
+// captureSources freezes the sources with CAPTURE_BACKEND and returns their
+// views, nil for the sources archived live. release removes the snapshots.
+func captureSources(sources []snapshotSource) (views []*sourceCapture, release func(), err error) {
+	views = make([]*sourceCapture, len(sources))
+	var captures []*capture
+	release = func() {
+		for i := len(captures) - 1; i >= 0; i-- {
+			captures[i].remove()
+		}
+	}
+	if captureBackend == captureLive {
+		return views, release, nil
+	}
+
+	cleanupStaleMounts()
+	byOrigin := make(map[string]*capture)
+	for i := range sources {
+		path, err := filepath.EvalSymlinks(sources[i].Path)
+		if err != nil {
+			continue // Skipped by the walk
+		}
+		c, err := findCapture(path, byOrigin)
+		if err == nil && c == nil {
+			err = fmt.Errorf("not on a btrfs subvolume or an LVM thin volume")
+		}
+		if err != nil {
+			if captureBackend == captureAuto {
+				logInfo("Archiving source %s live: %v", sources[i].Name, err)
+				continue
+			}
+			release()
+			return nil, nil, fmt.Errorf("cannot capture source %s with %s: %v", sources[i].Name, captureBackend, err)
+		}
+		if byOrigin[c.origin] == nil {
+			if err := c.create(sources[i].Name); err != nil {
+				if captureBackend == captureAuto {
+					logError("Archiving source %s live: %v", sources[i].Name, err)
+					continue
+				}
+				release()
+				return nil, nil, fmt.Errorf("cannot capture source %s: %v", sources[i].Name, err)
+			}
+			byOrigin[c.origin] = c
+			captures = append(captures, c)
+		} else {
+			c = byOrigin[c.origin]
+		}
+		rel, _ := filepath.Rel(c.origin, path)
+		views[i] = &sourceCapture{capture: c, view: filepath.Join(c.view, rel)}
+	}
+	return views, release, nil
+}
+
+// allCaptured reports whether every source of views is read from a
+// snapshot.
+func allCaptured(views []*sourceCapture) bool {
+	for _, view := range views {
+		if view == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// findCapture finds how the backend can freeze path: the btrfs subvolume
+// or mounted LVM thin volume holding it. It returns nil when path is on
+// neither.
+func findCapture(path string, known map[string]*capture) (*capture, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return nil, err
+	}
+	if fs.Type == btrfsSuperMagic && captureBackend != captureLVM {
+		root, err := btrfsSubvolumeRoot(path)
+		if err != nil {
+			return nil, err
+		}
+		if c := known[root]; c != nil {
+			return c, nil
+		}
+		return &capture{backend: captureBtrfs, origin: root}, nil
+	}
+	if captureBackend == captureBtrfs {
+		return nil, nil
+	}
+
+	mount, err := findMount(path)
+	if err != nil {
+		return nil, err
+	}
+	if mount.fstype == "overlay" {
+		return nil, fmt.Errorf("overlay filesystems cannot be snapshotted")
+	}
+	if c := known[mount.point]; c != nil {
+		return c, nil
+	}
+	vg, lv, thin, err := lvmVolume(mount.device)
+	if err != nil || !thin {
+		return nil, nil
+	}
+	return &capture{
+		backend:  captureLVM,
+		origin:   mount.point,
+		snapshot: vg + "/" + capturePrefix + lv,
+		mount:    filepath.Join(tempMountPoint, "capture", lv),
+		view:     filepath.Join(tempMountPoint, "capture", lv, mount.root),
+	}, nil
+}
+
+// btrfsSubvolumeRoot returns the root of the subvolume holding path.
+func btrfsSubvolumeRoot(path string) (string, error) {
+	for dir := path; ; dir = filepath.Dir(dir) {
+		var st syscall.Stat_t
+		if err := syscall.Stat(dir, &st); err != nil {
+			return "", err
+		}
+		if st.Ino == btrfsSubvolumeInode {
+			return dir, nil
+		}
+		if dir == "/" {
+			return "", fmt.Errorf("no btrfs subvolume root above %s", path)
+		}
+	}
+}
+
+// create takes the snapshot, after removing one an earlier run left.
+func (c *capture) create(name string) error {
+	switch c.backend {
+	case captureBtrfs:
+		dir := filepath.Join(c.origin, captureSnapshotDir)
+		removeStaleBtrfsSnapshots(dir)
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+		c.snapshot = filepath.Join(dir, capturePrefix+name)
+		c.view = c.snapshot
+		logInfo("📸 Taking read-only btrfs snapshot of %s...", c.origin)
+		return runTool(btrfsPath, "subvolume", "snapshot", "-r", c.origin, c.snapshot)
+	default:
+		if lvmVolumeExists(c.snapshot) {
+			logInfo("Removing stale LVM snapshot %s", c.snapshot)
+			if err := runTool(lvmPath, "lvremove", "-f", c.snapshot); err != nil {
+				return err
+			}
+		}
+		vg, lv, _ := strings.Cut(c.snapshot, "/")
+		origin := vg + "/" + strings.TrimPrefix(lv, capturePrefix)
+		logInfo("📸 Taking LVM thin snapshot of %s...", origin)
+		// -kn activates the snapshot, which thin snapshots skip by default
+		if err := runTool(lvmPath, "lvcreate", "-s", "-kn", "-n", lv, origin); err != nil {
+			return err
+		}
+		if err := c.mountSnapshot(); err != nil {
+			runTool(lvmPath, "lvremove", "-f", c.snapshot)
+			return err
+		}
+		return nil
+	}
+}
+
+// mountSnapshot mounts the LVM snapshot read-only. lvcreate freezes the
+// filesystem while it snapshots, so the snapshot needs no journal replay.
+func (c *capture) mountSnapshot() error {
+	device := "/dev/" + c.snapshot
+	mount, err := findMount(c.origin)
+	if err != nil {
+		return err
+	}
+	data := ""
+	if mount.fstype == "xfs" {
+		data = "nouuid" // The snapshot has the origin's UUID
+	}
+	if err := os.MkdirAll(c.mount, 0700); err != nil {
+		return err
+	}
+	if err := mountReadOnly(device, c.mount, mount.fstype, data); err != nil {
+		return fmt.Errorf("failed to mount %s: %v", device, err)
+	}
+	return nil
+}
+
+// remove unmounts and deletes the snapshot.
+func (c *capture) remove() {
+	if c.mount != "" {
+		if err := syscall.Unmount(c.mount, 0); err != nil {
+			logError("Failed to unmount %s: %v", c.mount, err)
+			return
+		}
+		os.Remove(c.mount)
+	}
+	var err error
+	if c.backend == captureBtrfs {
+		err = runTool(btrfsPath, "subvolume", "delete", c.snapshot)
+		os.Remove(filepath.Dir(c.snapshot))
+	} else {
+		err = runTool(lvmPath, "lvremove", "-f", c.snapshot)
+	}
+	if err != nil {
+		logError("Failed to remove snapshot %s, the next run retries: %v", c.snapshot, err)
+		return
+	}
+	logInfo("Removed snapshot %s", c.snapshot)
+}
+
+// removeStaleBtrfsSnapshots deletes the snapshots an earlier run left in dir.
+func removeStaleBtrfsSnapshots(dir string) {
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), capturePrefix) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		logInfo("Removing stale btrfs snapshot %s", path)
+		if err := runTool(btrfsPath, "subvolume", "delete", path); err != nil {
+			logError("Failed to remove stale snapshot %s: %v", path, err)
+		}
+	}
+}
+
+// cleanupStaleMounts unmounts the LVM snapshots an earlier run left
+// mounted, deepest first; create removes the snapshots themselves.
+func cleanupStaleMounts() {
+	mounts, err := readMounts()
+	if err != nil {
+		return
+	}
+	dir := filepath.Join(tempMountPoint, "capture") + "/"
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if strings.HasPrefix(mounts[i].point+"/", dir) {
+			logInfo("Unmounting stale snapshot %s", mounts[i].point)
+			if err := detachMount(mounts[i].point); err != nil {
+				logError("Failed to unmount %s: %v", mounts[i].point, err)
+			}
+		}
+	}
+}
+
+// lvmVolume looks up the logical volume of a device.
+func lvmVolume(device string) (vg, lv string, thin bool, err error) {
+	output, err := exec.Command(lvmPath, "lvs", "--noheadings", "--separator", "|",
+		"-o", "vg_name,lv_name,pool_lv", device).Output()
+	if err != nil {
+		return "", "", false, err
+	}
+	fields := strings.Split(strings.TrimSpace(string(output)), "|")
+	if len(fields) != 3 {
+		return "", "", false, fmt.Errorf("unexpected lvs output %q", output)
+	}
+	return fields[0], fields[1], fields[2] != "", nil
+}
+
+func lvmVolumeExists(name string) bool {
+	return exec.Command(lvmPath, "lvs", name).Run() == nil
+}
+
+// runTool runs a capture tool, returning its output on failure.
+func runTool(name string, args ...string) error {
+	if output, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s %s failed: %v: %s", name, args[0], err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// mountEntry is one line of /proc/self/mountinfo.
+type mountEntry struct {
+	point  string
+	root   string // Directory of the filesystem mounted there
+	fstype string
+	device string
+}
+
+// readMounts parses /proc/self/mountinfo, in mount order.
+func readMounts() ([]mountEntry, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var mounts []mountEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// id parent major:minor root point options [optional...] - fstype source superoptions
+		fields := strings.Fields(scanner.Text())
+		sep := -1
+		for i, field := range fields {
+			if field == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep < 5 || sep+2 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, mountEntry{
+			point:  unescapeMountField(fields[4]),
+			root:   unescapeMountField(fields[3]),
+			fstype: fields[sep+1],
+			device: unescapeMountField(fields[sep+2]),
+		})
+	}
+	return mounts, scanner.Err()
+}
+
+// findMount returns the mount holding path: the last one mounted on the
+// longest matching mount point.
+func findMount(path string) (mountEntry, error) {
+	mounts, err := readMounts()
+	if err != nil {
+		return mountEntry{}, err
+	}
+	var found *mountEntry
+	for i := range mounts {
+		point := mounts[i].point
+		if path == point || point == "/" || strings.HasPrefix(path, point+"/") {
+			if found == nil || len(point) >= len(found.point) {
+				found = &mounts[i]
+			}
+		}
+	}
+	if found == nil {
+		return mountEntry{}, fmt.Errorf("no mount holds %s", path)
+	}
+	return *found, nil
+}
+
+// unescapeMountField decodes the octal escapes (\040 for a space) of
+// mountinfo fields.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var b strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if n, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(n))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
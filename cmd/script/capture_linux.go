@@ -0,0 +1,13 @@
+package main
+
+import "syscall"
+
+// mountReadOnly mounts device on target read-only.
+func mountReadOnly(device, target, fstype, data string) error {
+	return syscall.Mount(device, target, fstype, syscall.MS_RDONLY, data)
+}
+
+// detachMount lazily unmounts target, even while it is busy.
+func detachMount(target string) error {
+	return syscall.Unmount(target, syscall.MNT_DETACH)
+}
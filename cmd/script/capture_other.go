@@ -0,0 +1,17 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// btrfs and LVM captures are only supported on Linux; CAPTURE_BACKEND=live
+// works everywhere.
+var errCaptureUnsupported = errors.New("snapshot captures are only supported on Linux")
+
+func mountReadOnly(device, target, fstype, data string) error {
+	return errCaptureUnsupported
+}
+
+func detachMount(target string) error {
+	return errCaptureUnsupported
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	gzipBlockSize = 1024 * 1024 // Input compressed by each parallel gzip worker
+
+	defaultCompressionLevel = -1 // COMPRESSION_LEVEL unset: the codec's own default
+)
+
+// compressionLevels bounds COMPRESSION_LEVEL per codec.
+var compressionLevels = map[string][2]int{
+	compressionGzip: {1, 9},
+	compressionZstd: {1, 19},
+	compressionXz:   {0, 9},
+}
+
+// xzDictCaps are the dictionary sizes of the xz presets 0 to 9, which is
+// all a level changes for LZMA2.
+var xzDictCaps = [10]int{
+	256 << 10, 1 << 20, 2 << 20, 4 << 20, 4 << 20,
+	8 << 20, 8 << 20, 16 << 20, 32 << 20, 64 << 20,
+}
+
+// validateCompression checks COMPRESSION_LEVEL against the codec.
+func validateCompression(codec string, level int) error {
+	bounds, ok := compressionLevels[codec]
+	if !ok || level == defaultCompressionLevel {
+		return nil
+	}
+	if level < bounds[0] || level > bounds[1] {
+		return fmt.Errorf("%s level must be between %d and %d, got %d", codec, bounds[0], bounds[1], level)
+	}
+	return nil
+}
+
+// compressionThreadCount resolves COMPRESSION_THREADS, 0 meaning every CPU.
+func compressionThreadCount() int {
+	if compressionThreads > 0 {
+		return compressionThreads
+	}
+	return runtime.NumCPU()
+}
+
+// newCompressor returns a writer compressing into dst with the configured
+// codec, level and threads; xz always compresses on one thread. Closing it
+// flushes the compressed stream but does not close dst.
+func newCompressor(dst io.Writer) (io.WriteCloser, error) {
+	threads := compressionThreadCount()
+
+	switch compressionCodec {
+	case compressionNone:
+		return nopWriteCloser{dst}, nil
+	case compressionGzip:
+		level := compressionLevel
+		if level == defaultCompressionLevel {
+			level = gzip.DefaultCompression
+		}
+		if threads > 1 {
+			return newParallelGzipWriter(dst, level, threads), nil
+		}
+		return gzip.NewWriterLevel(dst, level)
+	case compressionZstd:
+		level := zstd.SpeedDefault
+		if compressionLevel != defaultCompressionLevel {
+			level = zstd.EncoderLevelFromZstd(compressionLevel)
+		}
+		zw, err := zstd.NewWriter(dst, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(threads))
+		if err != nil {
+			return nil, err
+		}
+		return zw, nil
+	case compressionXz:
+		var config xz.WriterConfig
+		if compressionLevel != defaultCompressionLevel {
+			config.DictCap = xzDictCaps[compressionLevel]
+		}
+		xw, err := config.NewWriter(dst)
+		if err != nil {
+			return nil, err
+		}
+		return xw, nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", compressionCodec)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// parallelGzipWriter compresses fixed-size blocks concurrently, each as its
+// own gzip member, and writes the members in order. Concatenated members
+// form a valid gzip stream that gunzip and Go's gzip.Reader read as one.
+type parallelGzipWriter struct {
+	level   int
+	buf     []byte
+	blocks  int
+	pending chan *gzipBlock
+	done    chan error
+
+	mu  sync.Mutex
+	err error
+}
+
+type gzipBlock struct {
+	out   bytes.Buffer
+	err   error
+	ready chan struct{}
+}
+
+func newParallelGzipWriter(dst io.Writer, level, threads int) *parallelGzipWriter {
+	w := &parallelGzipWriter{
+		level:   level,
+		buf:     make([]byte, 0, gzipBlockSize),
+		pending: make(chan *gzipBlock, threads),
+		done:    make(chan error, 1),
+	}
+
+	go func() {
+		var err error
+		for block := range w.pending {
+			<-block.ready
+			if err == nil {
+				err = block.err
+			}
+			if err == nil {
+				_, err = dst.Write(block.out.Bytes())
+			}
+			if err != nil {
+				w.setErr(err)
+			}
+		}
+		w.done <- err
+	}()
+
+	return w
+}
+
+func (w *parallelGzipWriter) Write(p []byte) (int, error) {
+	if err := w.getErr(); err != nil {
+		return 0, err
+	}
+
+	n := len(p)
+	for len(p) > 0 {
+		copied := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+copied]
+		p = p[copied:]
+		if len(w.buf) == cap(w.buf) {
+			w.flushBlock()
+		}
+	}
+	return n, nil
+}
+
+// flushBlock hands the buffered input to a worker. Sending to pending
+// blocks once threads blocks are in flight, which bounds memory use.
+func (w *parallelGzipWriter) flushBlock() {
+	block := &gzipBlock{ready: make(chan struct{})}
+	data := w.buf
+	w.buf = make([]byte, 0, gzipBlockSize)
+	w.blocks++
+
+	w.pending <- block
+	go func() {
+		defer close(block.ready)
+		zw, err := gzip.NewWriterLevel(&block.out, w.level)
+		if err != nil {
+			block.err = err
+			return
+		}
+		if _, err := zw.Write(data); err != nil {
+			block.err = err
+			return
+		}
+		block.err = zw.Close()
+	}()
+}
+
+func (w *parallelGzipWriter) Close() error {
+	// An empty input still needs one member to be valid gzip
+	if len(w.buf) > 0 || w.blocks == 0 {
+		w.flushBlock()
+	}
+	close(w.pending)
+	return <-w.done
+}
+
+func (w *parallelGzipWriter) setErr(err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.err = err
+}
+
+func (w *parallelGzipWriter) getErr() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
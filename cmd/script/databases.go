@@ -0,0 +1,294 @@
+package main
+
+// Database sources.
+//
+// A live copy of a database's files is torn: the files change while they
+// are read, and the copy may not restore. DATABASES=name:type,... dumps
+// databases with their own tools instead, at the start of every snapshot,
+// and archives each dump under databases/ next to the filesystem sources:
+//
+//	postgres  pg_dump --format=custom          databases/<name>.pgdump  (pg_restore)
+//	mysql     mysqldump --single-transaction   databases/<name>.sql
+//	sqlite    sqlite3 .backup                  databases/<name>.sqlite
+//	redis     redis-cli --rdb (a BGSAVE)       databases/<name>.rdb
+//
+// Connection settings are DATABASE_<NAME>_HOST, _PORT, _USER, _PASSWORD and
+// _DBNAME, and _PATH for SQLite files. Passwords go through the tools'
+// environment variables, never their command line. Dumps are written to
+// TEMP_MOUNT_POINT first, as tar needs each entry's size before its data,
+// and each one gets DATABASE_DUMP_TIMEOUT. A failed dump is left out of the
+// snapshot, which is taken anyway; the info file records every dump with
+// its tool version and exit status.
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	databasePostgres = "postgres"
+	databaseMySQL    = "mysql"
+	databaseSQLite   = "sqlite"
+	databaseRedis    = "redis"
+
+	databasesDir = "databases"
+)
+
+// databaseSource is one database dumped by each snapshot.
+type databaseSource struct {
+	Name     string
+	Type     string
+	Host     string
+	Port     string
+	User     string
+	Password string
+	DBName   string
+	Path     string // SQLite database file
+}
+
+// databaseDump is the outcome of dumping one database.
+type databaseDump struct {
+	source   *databaseSource
+	file     string // Dump in the spool directory, "" when it failed
+	name     string // Archive name
+	version  string // First line of the tool's --version
+	status   string
+	duration time.Duration
+}
+
+// parseDatabases parses DATABASES: "name:type,name:type".
+func parseDatabases(value string) ([]databaseSource, error) {
+	var databases []databaseSource
+	seen := make(map[string]bool)
+	for _, entry := range splitPatterns(value) {
+		name, kind, ok := strings.Cut(entry, ":")
+		if !ok || !sourceNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid database %q, expected name:type with a lower-case name", entry)
+		}
+		switch kind {
+		case databasePostgres, databaseMySQL, databaseSQLite, databaseRedis:
+		default:
+			return nil, fmt.Errorf("database %s: unknown type %q (postgres, mysql, sqlite or redis)", name, kind)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("database %s is listed twice", name)
+		}
+		seen[name] = true
+		databases = append(databases, databaseSource{Name: name, Type: kind})
+	}
+	return databases, nil
+}
+
+// databaseSettingKey splits DATABASE_<NAME>_<SETTING> keys into the
+// database name and the setting.
+func databaseSettingKey(key string) (name, setting string, ok bool) {
+	rest, ok := strings.CutPrefix(key, "DATABASE_")
+	if !ok {
+		return "", "", false
+	}
+	for _, setting := range []string{"HOST", "PORT", "USER", "PASSWORD", "DBNAME", "PATH"} {
+		if name, ok := strings.CutSuffix(rest, "_"+setting); ok && name != "" {
+			return name, setting, true
+		}
+	}
+	return "", "", false
+}
+
+// applyDatabaseSettings attaches the DATABASE_<NAME>_* settings, by
+// upper-cased name, and drops the databases missing a required one.
+func applyDatabaseSettings(databases []databaseSource, settings map[string]map[string]string) []databaseSource {
+	var valid []databaseSource
+	for _, db := range databases {
+		key := strings.ToUpper(strings.ReplaceAll(db.Name, "-", "_"))
+		s := settings[key]
+		delete(settings, key)
+		db.Host, db.Port, db.User, db.Password = s["HOST"], s["PORT"], s["USER"], s["PASSWORD"]
+		db.DBName, db.Path = s["DBNAME"], s["PATH"]
+
+		switch {
+		case db.Type == databaseSQLite && db.Path == "":
+			logError("Ignoring database %s: DATABASE_%s_PATH is not set", db.Name, key)
+		case (db.Type == databasePostgres || db.Type == databaseMySQL) && db.DBName == "":
+			logError("Ignoring database %s: DATABASE_%s_DBNAME is not set", db.Name, key)
+		default:
+			valid = append(valid, db)
+		}
+	}
+	for name := range settings {
+		logError("Ignoring DATABASE_%s_* settings: no such database", name)
+	}
+	return valid
+}
+
+// dumpCommand returns the tool, arguments, environment and file extension
+// dumping db to file.
+func (db *databaseSource) dumpCommand(file string) (string, []string, []string, string) {
+	var args, env []string
+	switch db.Type {
+	case databasePostgres:
+		args = append(args, "--format=custom", "--no-password", "--file="+file)
+		args = appendOption(args, "--host=", db.Host)
+		args = appendOption(args, "--port=", db.Port)
+		args = appendOption(args, "--username=", db.User)
+		args = append(args, "--dbname="+db.DBName)
+		if db.Password != "" {
+			env = append(env, "PGPASSWORD="+db.Password)
+		}
+		return pgDumpPath, args, env, ".pgdump"
+	case databaseMySQL:
+		args = append(args, "--single-transaction", "--quick", "--routines", "--triggers", "--events", "--result-file="+file)
+		args = appendOption(args, "--host=", db.Host)
+		args = appendOption(args, "--port=", db.Port)
+		args = appendOption(args, "--user=", db.User)
+		args = append(args, "--", db.DBName)
+		if db.Password != "" {
+			env = append(env, "MYSQL_PWD="+db.Password)
+		}
+		return mysqldumpPath, args, env, ".sql"
+	case databaseSQLite:
+		// The online backup API copies a consistent state while writers go on
+		args = append(args, "-bail", db.Path, ".backup '"+file+"'")
+		return sqlite3Path, args, nil, ".sqlite"
+	default:
+		args = appendOption(args, "-h", db.Host)
+		args = appendOption(args, "-p", db.Port)
+		if db.User != "" {
+			args = append(args, "--user", db.User)
+		}
+		args = append(args, "--rdb", file)
+		if db.Password != "" {
+			env = append(env, "REDISCLI_AUTH="+db.Password)
+		}
+		return redisCliPath, args, env, ".rdb"
+	}
+}
+
+func appendOption(args []string, option, value string) []string {
+	if value == "" {
+		return args
+	}
+	if strings.HasSuffix(option, "=") {
+		return append(args, option+value)
+	}
+	return append(args, option, value)
+}
+
+// dumpDatabases dumps every database into spool, one after the other.
+func dumpDatabases(databases []databaseSource, spool string) []databaseDump {
+	dumps := make([]databaseDump, 0, len(databases))
+	for i := range databases {
+		db := &databases[i]
+		file := filepath.Join(spool, db.Name)
+		tool, args, env, ext := db.dumpCommand(file)
+		dump := databaseDump{
+			source:  db,
+			name:    databasesDir + "/" + db.Name + ext,
+			version: toolVersion(tool),
+		}
+
+		logInfo("🛢️ Dumping %s database %s...", db.Type, db.Name)
+		start := time.Now()
+		err := runLogged(databaseDumpTimeout, env, tool, args...)
+		dump.duration = time.Since(start).Round(time.Millisecond)
+		if err == nil {
+			_, err = os.Stat(file)
+		}
+		if err != nil {
+			dump.status = err.Error()
+			logError("Failed to dump database %s, leaving it out: %v", db.Name, err)
+			os.Remove(file)
+		} else {
+			dump.file = file
+			dump.status = "exited with status 0"
+			logInfo("Database %s dumped in %s", db.Name, dump.duration)
+		}
+		dumps = append(dumps, dump)
+	}
+	return dumps
+}
+
+// toolVersion returns the first line a tool prints for --version.
+func toolVersion(tool string) string {
+	output, err := exec.Command(tool, "--version").Output()
+	if err != nil {
+		return "unknown version"
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	return line
+}
+
+// describe formats a dump for info files.
+func (d *databaseDump) describe() string {
+	if d.file == "" {
+		return fmt.Sprintf("%s (%s, %s): failed, %s, not archived", d.source.Name, d.source.Type, d.version, d.status)
+	}
+	return fmt.Sprintf("%s (%s, %s): %s, %s in %s", d.source.Name, d.source.Type, d.version, d.name, d.status, d.duration)
+}
+
+// describeDatabases lists the configured databases for info files.
+func describeDatabases(databases []databaseSource) []string {
+	var lines []string
+	for _, db := range databases {
+		line := fmt.Sprintf("%s (%s)", db.Name, db.Type)
+		if db.Type == databaseSQLite {
+			line += " " + db.Path
+		} else if db.DBName != "" {
+			line += " " + db.DBName
+		}
+		if db.Host != "" {
+			line += " on " + db.Host
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// scanDatabaseDumps adds the successful dumps, under databases/, to the
+// pending entries.
+func (a *filesystemArchiver) scanDatabaseDumps(dumps []databaseDump, now time.Time) error {
+	a.pending = append(a.pending, pendingEntry{
+		hdr: &tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     databasesDir + "/",
+			Mode:     0700,
+			ModTime:  now,
+			Format:   tar.FormatPAX,
+		},
+		dump: true,
+	})
+	if a.index != nil {
+		a.index.Entries[databasesDir] = indexEntry{MTime: now.UnixNano()}
+	}
+	for _, dump := range dumps {
+		if dump.file == "" {
+			continue
+		}
+		info, err := os.Stat(dump.file)
+		if err != nil {
+			return fmt.Errorf("failed to archive dump of %s: %v", dump.source.Name, err)
+		}
+		a.pending = append(a.pending, pendingEntry{
+			path: dump.file,
+			hdr: &tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     dump.name,
+				Mode:     0600,
+				Size:     info.Size(),
+				ModTime:  now,
+				Format:   tar.FormatPAX,
+			},
+			dump: true,
+		})
+		// A dump differs every time, so incrementals always carry it; its
+		// hash is recorded once it is archived
+		if a.index != nil {
+			a.index.Entries[dump.name] = newIndexEntry(info)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+// Minimal Docker Engine API client, over the daemon's unix socket. Shared
+// by the snapshot job, which lists and pauses, and the restore tool, which
+// recreates volumes.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const dockerAPITimeout = 30 * time.Second
+
+// dockerVolume is a volume as the Engine API describes it.
+type dockerVolume struct {
+	Name       string            `json:"Name"`
+	Driver     string            `json:"Driver"`
+	Mountpoint string            `json:"Mountpoint"`
+	Labels     map[string]string `json:"Labels"`
+}
+
+// dockerMount is one mount of a container.
+type dockerMount struct {
+	Type string `json:"Type"`
+	Name string `json:"Name"` // Volume name, for volume mounts
+}
+
+// dockerContainer is a container as /containers/json lists it.
+type dockerContainer struct {
+	ID     string        `json:"Id"`
+	Names  []string      `json:"Names"`
+	State  string        `json:"State"`
+	Mounts []dockerMount `json:"Mounts"`
+}
+
+type dockerClient struct {
+	http *http.Client
+}
+
+func newDockerClient(socket string) *dockerClient {
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}
+	return &dockerClient{http: &http.Client{Transport: transport, Timeout: dockerAPITimeout}}
+}
+
+// do sends a request and decodes the JSON response into out, if not nil.
+func (c *dockerClient) do(method, path string, query url.Values, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	u := "http://docker" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, u, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("docker API: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("docker API %s %s: %s: %s", method, path, resp.Status, apiErr.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// labelFilter builds the filters parameter selecting a label, "key" or
+// "key=value".
+func labelFilter(label string) url.Values {
+	filters, _ := json.Marshal(map[string][]string{"label": {label}})
+	return url.Values{"filters": {string(filters)}}
+}
+
+func (c *dockerClient) listVolumes(label string) ([]dockerVolume, error) {
+	var resp struct {
+		Volumes []dockerVolume `json:"Volumes"`
+	}
+	err := c.do(http.MethodGet, "/volumes", labelFilter(label), nil, &resp)
+	return resp.Volumes, err
+}
+
+func (c *dockerClient) inspectVolume(name string) (*dockerVolume, error) {
+	var volume dockerVolume
+	if err := c.do(http.MethodGet, "/volumes/"+url.PathEscape(name), nil, nil, &volume); err != nil {
+		return nil, err
+	}
+	return &volume, nil
+}
+
+func (c *dockerClient) createVolume(name string, labels map[string]string) (*dockerVolume, error) {
+	var volume dockerVolume
+	body := map[string]interface{}{"Name": name, "Labels": labels}
+	if err := c.do(http.MethodPost, "/volumes/create", nil, body, &volume); err != nil {
+		return nil, err
+	}
+	return &volume, nil
+}
+
+// listContainers lists the running containers, all of them when label is
+// empty.
+func (c *dockerClient) listContainers(label string) ([]dockerContainer, error) {
+	var query url.Values
+	if label != "" {
+		query = labelFilter(label)
+	}
+	var containers []dockerContainer
+	err := c.do(http.MethodGet, "/containers/json", query, nil, &containers)
+	return containers, err
+}
+
+func (c *dockerClient) pauseContainer(id string) error {
+	return c.do(http.MethodPost, "/containers/"+url.PathEscape(id)+"/pause", nil, nil, nil)
+}
+
+func (c *dockerClient) unpauseContainer(id string) error {
+	return c.do(http.MethodPost, "/containers/"+url.PathEscape(id)+"/unpause", nil, nil, nil)
+}
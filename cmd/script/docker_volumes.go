@@ -0,0 +1,156 @@
+package main
+
+// Docker volume sources.
+//
+// With DOCKER_BACKUP_LABEL set (mobula.backup=true, or just a label key),
+// every snapshot asks the Docker Engine API on DOCKER_SOCKET for the volumes
+// carrying the label and the volumes mounted by running containers carrying
+// it, and archives each one as a source under volumes/<name>/. Volumes are
+// read at their Mountpoint, so the host's /var/lib/docker/volumes must be
+// mounted into this container at the same path, next to the socket.
+//
+// With DOCKER_PAUSE_CONTAINERS=true, the running containers using those
+// volumes are paused while the sources are archived, and unpaused as soon
+// as the walk ends, whatever happens. 'decrypt restore-volume' recreates a
+// volume from a snapshot.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const dockerVolumesDir = "volumes"
+
+// dockerVolumeSources lists the labelled volumes as sources, and the
+// running containers using them.
+func dockerVolumeSources(client *dockerClient) ([]snapshotSource, []dockerContainer, error) {
+	volumes, err := client.listVolumes(dockerBackupLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	selected := make(map[string]dockerVolume)
+	for _, volume := range volumes {
+		selected[volume.Name] = volume
+	}
+
+	labelled, err := client.listContainers(dockerBackupLabel)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, container := range labelled {
+		for _, mount := range container.Mounts {
+			if mount.Type != "volume" || mount.Name == "" {
+				continue
+			}
+			if _, ok := selected[mount.Name]; ok {
+				continue
+			}
+			volume, err := client.inspectVolume(mount.Name)
+			if err != nil {
+				return nil, nil, err
+			}
+			selected[volume.Name] = *volume
+		}
+	}
+
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var sources []snapshotSource
+	for _, name := range names {
+		volume := selected[name]
+		if volume.Mountpoint == "" {
+			logError("Skipping volume %s: the %s driver has no mountpoint", name, volume.Driver)
+			continue
+		}
+		sources = append(sources, snapshotSource{
+			Name:   name,
+			Path:   volume.Mountpoint,
+			Prefix: dockerVolumesDir + "/" + name + "/",
+		})
+	}
+
+	running, err := client.listContainers("")
+	if err != nil {
+		return nil, nil, err
+	}
+	var users []dockerContainer
+	for _, container := range running {
+		for _, mount := range container.Mounts {
+			if _, ok := selected[mount.Name]; ok && mount.Type == "volume" {
+				users = append(users, container)
+				break
+			}
+		}
+	}
+	return sources, users, nil
+}
+
+// pauseContainers pauses the running containers and returns a function
+// unpausing those it paused, which can be called more than once.
+func pauseContainers(client *dockerClient, containers []dockerContainer) func() {
+	var paused []dockerContainer
+	for _, container := range containers {
+		if container.State != "running" {
+			continue
+		}
+		if err := client.pauseContainer(container.ID); err != nil {
+			logError("Failed to pause container %s: %v", containerName(container), err)
+			continue
+		}
+		logInfo("⏸️ Paused container %s", containerName(container))
+		paused = append(paused, container)
+	}
+	return func() {
+		for _, container := range paused {
+			if err := client.unpauseContainer(container.ID); err != nil {
+				logError("Failed to unpause container %s: %v", containerName(container), err)
+			} else {
+				logInfo("▶️ Unpaused container %s", containerName(container))
+			}
+		}
+		paused = nil
+	}
+}
+
+func containerName(container dockerContainer) string {
+	if len(container.Names) > 0 {
+		return strings.TrimPrefix(container.Names[0], "/")
+	}
+	return container.ID[:min(12, len(container.ID))]
+}
+
+// withDockerVolumes returns the sources followed by the Docker volumes, and
+// a function resuming the containers paused for them. A Docker API failure
+// is logged and the snapshot is taken without the volumes.
+func withDockerVolumes(sources []snapshotSource) ([]snapshotSource, func()) {
+	if dockerBackupLabel == "" {
+		return sources, func() {}
+	}
+	client := newDockerClient(dockerSocket)
+	volumes, users, err := dockerVolumeSources(client)
+	if err != nil {
+		logError("Not archiving Docker volumes: %v", err)
+		return sources, func() {}
+	}
+	logInfo("🐳 Archiving %d Docker volumes labelled %s", len(volumes), dockerBackupLabel)
+
+	all := append(append([]snapshotSource{}, sources...), volumes...)
+	if !dockerPauseContainers {
+		return all, func() {}
+	}
+	return all, pauseContainers(client, users)
+}
+
+// describeDockerVolumes formats the DOCKER_BACKUP_LABEL setting for info
+// files.
+func describeDockerVolumes() string {
+	line := fmt.Sprintf("volumes labelled %s via %s", dockerBackupLabel, dockerSocket)
+	if dockerPauseContainers {
+		line += ", containers paused"
+	}
+	return line
+}
@@ -1,69 +1,122 @@
 package main
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/hex"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"strings"
+	"path/filepath"
 	"time"
 )
 
-const (
-	keyLengthBytes = 32 // AES-256 key length
-)
-
-func loadMasterKey() ([]byte, error) {
-	keyHex, err := os.ReadFile(keyFile)
+// loadMasterKey returns the active keyring generation and its key.
+func loadMasterKey() (string, []byte, error) {
+	keyring, err := loadKeyring(keyDir, keyFile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read master key: %v", err)
+		return "", nil, err
 	}
 
-	keyStr := strings.TrimSpace(string(keyHex))
-	key, err := hex.DecodeString(keyStr)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode master key: %v", err)
+	generation := keyring.active()
+	if generation == nil {
+		return "", nil, fmt.Errorf("keyring has no active key generation")
 	}
 
-	if len(key) != keyLengthBytes {
-		return nil, fmt.Errorf("invalid key length: expected %d bytes, got %d", keyLengthBytes, len(key))
+	key, err := loadGenerationKey(generation)
+	if err != nil {
+		return "", nil, err
 	}
 
-	return key, nil
+	return generation.ID, key, nil
 }
 
-func encryptFile(srcFile, dstFile string, key []byte) error {
-	plaintext, err := os.ReadFile(srcFile)
+func encryptFile(src io.Reader, dstFile, keyID string, key []byte, targets []recipient, compression string) error {
+	dst, err := os.OpenFile(dstFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
 
-	block, err := aes.NewCipher(key)
-	if err != nil {
+	// The archive is streamed, so its size is not known up front; the
+	// signed manifest records it once the snapshot is written
+	if err := encryptStream(dst, bufio.NewReader(src), keyID, key, targets, compression, -1); err != nil {
+		dst.Close()
+		os.Remove(dstFile)
 		return err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	return dst.Close()
+}
+
+// createEncryptedArchive archives the root filesystem, compresses it and
+// encrypts it to encryptedPath in one pass, without temporary files.
+func createEncryptedArchive(encryptedPath, keyID string, key []byte, now time.Time, plan *incrementalPlan, listing *fileManifest) error {
+	logInfo("Archiving filesystem (%s compression, %d threads)...", compressionCodec, compressionThreadCount())
+
+	pr, pw := io.Pipe()
+	compressor, err := newCompressor(pw)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to start %s compression: %v", compressionCodec, err)
 	}
+	var archiveErr error
+	archived := make(chan struct{})
+	go func() {
+		defer close(archived)
+		archiveErr = writeSnapshotArchive(compressor, now, plan, listing)
+		if closeErr := compressor.Close(); archiveErr == nil {
+			archiveErr = closeErr
+		}
+		pw.CloseWithError(archiveErr)
+	}()
 
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return err
+	err = encryptDiskImage(pr, encryptedPath, keyID, key, compressionCodec)
+	// Stops the archiver if encryption failed first, and waits for it: the
+	// plan's index and the listing are complete, and its cleanups over,
+	// before the caller goes on. An archiver failing first already failed
+	// the encryption through the pipe.
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-archived
+	if err == nil {
+		err = archiveErr
 	}
+	return err
+}
 
-	ciphertext := gcm.Seal(nonce, nonce, plaintext, nil)
-
-	return os.WriteFile(dstFile, ciphertext, 0600)
+// loadShamirGroups returns the Shamir groups recorded in the keyring.
+func loadShamirGroups() ([]recipient, error) {
+	keyring, err := loadKeyring(keyDir, keyFile)
+	if err == errNoKeyring {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return keyring.groups()
 }
 
-func encryptDiskImage(diskPath, encryptedPath string, key []byte) error {
-	logInfo("Encrypting disk image...")
+// encryptDiskImage encrypts to the master key, when there is one, to every
+// configured recipient and to every Shamir group.
+func encryptDiskImage(src io.Reader, encryptedPath, keyID string, key []byte, compression string) error {
+	groups, err := loadShamirGroups()
+	if err != nil {
+		return fmt.Errorf("failed to load Shamir groups: %v", err)
+	}
+	targets := append(append([]recipient{}, recipients...), groups...)
+
+	if key != nil {
+		logInfo("Encrypting disk image with a fresh data key (master key %s)...", keyID)
+	}
+	for _, r := range targets {
+		if r.RequiredShares > 0 {
+			logInfo("Encrypting disk image to Shamir group %s (%d of %d shares)", r.Name, r.RequiredShares, r.TotalShares)
+		} else {
+			logInfo("Encrypting disk image to recipient %s (%s)", r.Name, keyFingerprint(r.PublicKey))
+		}
+	}
 
-	if err := encryptFile(diskPath, encryptedPath, key); err != nil {
+	if err := encryptFile(src, encryptedPath, keyID, key, targets, compression); err != nil {
 		return fmt.Errorf("failed to encrypt disk image: %v", err)
 	}
 
@@ -71,7 +124,133 @@ func encryptDiskImage(diskPath, encryptedPath string, key []byte) error {
 	return nil
 }
 
-func updateSnapshotInfoFile(diskImageName, encryptedDiskPath string) error {
+// writeSnapshotManifest signs a manifest describing the encrypted snapshot
+// and stores it next to it. parent is the snapshot an incremental builds on.
+func writeSnapshotManifest(encryptedPath, keyID string, createdAt time.Time, parent string) (string, error) {
+	signingKey, created, err := loadSigningKey(keyDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to load signing key: %v", err)
+	}
+	if created {
+		logInfo("🖋️ Created host signing key %s, public key in %s",
+			keyFingerprint(signingKey.Public().(ed25519.PublicKey)), filepath.Join(keyDir, signingPubFilename))
+	}
+
+	file, err := os.Open(encryptedPath)
+	if err != nil {
+		return "", err
+	}
+	digest, size, header, err := digestSnapshot(file)
+	file.Close()
+	if err != nil {
+		return "", fmt.Errorf("failed to hash snapshot: %v", err)
+	}
+
+	head, err := loadChainHead(keyDir)
+	if err != nil {
+		return "", fmt.Errorf("failed to load manifest chain: %v", err)
+	}
+
+	hostname, _ := os.Hostname()
+	manifest := &snapshotManifest{
+		Version:   manifestVersion,
+		File:      filepath.Base(encryptedPath),
+		Size:      size,
+		SHA256:    digest,
+		KeyID:     keyID,
+		CreatedAt: createdAt.UTC(),
+		Hostname:  hostname,
+		Sequence:  head.Sequence + 1,
+		Previous:  head.Hash,
+		Parent:    parent,
+	}
+	if header != nil {
+		manifest.PlaintextSize = segmentsPlaintextSize(size-int64(len(header.aad)), header.ChunkSize)
+	}
+	for _, slot := range headerSlots(header) {
+		if isRecipientSlot(slot) {
+			manifest.Recipients = append(manifest.Recipients, slot.KeyID)
+		}
+	}
+	if sidecar, err := os.Open(fileManifestPathFor(encryptedPath)); err == nil {
+		manifest.FilesSHA256, _, _, err = digestSnapshot(sidecar)
+		sidecar.Close()
+		if err != nil {
+			return "", fmt.Errorf("failed to hash file manifest: %v", err)
+		}
+	}
+
+	data, err := signManifest(manifest, signingKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign manifest: %v", err)
+	}
+
+	manifestPath := manifestPathFor(encryptedPath)
+	if err := os.WriteFile(manifestPath, data, 0644); err != nil {
+		return "", err
+	}
+
+	head = &chainHead{
+		Sequence:  manifest.Sequence,
+		File:      manifest.File,
+		Hash:      manifestHash(data),
+		CreatedAt: manifest.CreatedAt,
+	}
+	if err := saveChainHead(keyDir, head); err != nil {
+		return "", fmt.Errorf("failed to update manifest chain: %v", err)
+	}
+	return manifestPath, nil
+}
+
+// writeFileManifestSidecar encrypts the file manifest of the snapshot at
+// encryptedPath next to it, to the same keys, and returns its path.
+func writeFileManifestSidecar(encryptedPath, keyID string, key []byte, listing *fileManifest) (string, error) {
+	groups, err := loadShamirGroups()
+	if err != nil {
+		return "", fmt.Errorf("failed to load Shamir groups: %v", err)
+	}
+	targets := append(append([]recipient{}, recipients...), groups...)
+
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if err := json.NewEncoder(gz).Encode(listing); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	path := fileManifestPathFor(encryptedPath)
+	if err := encryptFile(&compressed, path, keyID, key, targets, compressionGzip); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func headerSlots(header *snapshotHeader) []keySlot {
+	if header == nil {
+		return nil
+	}
+	return header.KeySlots
+}
+
+// snapshotFileCompression returns the codec recorded in a snapshot's header:
+// images that compress themselves are encrypted without one.
+func snapshotFileCompression(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	header, err := describeSnapshotFile(file)
+	if err != nil {
+		return "", err
+	}
+	return snapshotCompression(header), nil
+}
+
+func updateSnapshotInfoFile(diskImageName, encryptedDiskPath, parent string) error {
 	infoFilePath := "/app/" + infoFileName
 
 	file, err := os.Create(infoFilePath)
@@ -97,10 +276,53 @@ func updateSnapshotInfoFile(diskImageName, encryptedDiskPath string) error {
 	fmt.Fprintf(file, "Creation Time: %s\n", now.Format("15:04:05"))
 	fmt.Fprintf(file, "Full Timestamp: %s\n", now.Format(time.RFC3339))
 	fmt.Fprintf(file, "Hostname: %s\n", hostname)
+	if pulledHost != nil {
+		fmt.Fprintf(file, "Remote host: %s\n", pulledHost.describe())
+		for _, line := range describeSources(pulledHost.sources()) {
+			fmt.Fprintf(file, "Source: %s\n", line)
+		}
+	} else {
+		for _, line := range describeSources(snapshotSources) {
+			fmt.Fprintf(file, "Source: %s\n", line)
+		}
+		if dockerBackupLabel != "" {
+			fmt.Fprintf(file, "Docker: %s\n", describeDockerVolumes())
+		}
+		for _, line := range describeDatabases(databaseSources) {
+			fmt.Fprintf(file, "Database: %s\n", line)
+		}
+	}
+	if len(excludeRules) > 0 {
+		fmt.Fprintf(file, "Exclude file: %s (%d rules)\n", excludeFile, len(excludeRules))
+	}
 	fmt.Fprintf(file, "File Path: %s\n", encryptedDiskPath)
 	fmt.Fprintf(file, "File Size: %.2f MB\n", float64(fileSize)/1024/1024)
-	fmt.Fprintf(file, "Encryption: AES-256-GCM\n")
-	fmt.Fprintf(file, "\nSnapshot Type: Full OS Disk Image\n")
+	if keyMode == keyModeRecipients {
+		fmt.Fprintf(file, "Encryption: AES-256-GCM (per-snapshot data key wrapped for X25519 recipients)\n")
+	} else {
+		fmt.Fprintf(file, "Encryption: AES-256-GCM (per-snapshot data key wrapped by master key)\n")
+	}
+	for _, r := range recipients {
+		fmt.Fprintf(file, "Recipient: %s (%s)\n", r.Name, keyFingerprint(r.PublicKey))
+	}
+	if codec, err := snapshotFileCompression(encryptedDiskPath); err == nil {
+		fmt.Fprintf(file, "Compression: %s\n", codec)
+	}
+	if imageFormat == imageFormatISO || imageFormat == imageFormatSquashfs {
+		fmt.Fprintf(file, "Squashfs compression: %s\n", compressionCodec)
+	}
+	switch {
+	case imageFormat == imageFormatRawExt4:
+		fmt.Fprintf(file, "\nSnapshot Type: Full OS Disk Image (raw ext4)\n")
+	case imageFormat == imageFormatISO:
+		fmt.Fprintf(file, "\nSnapshot Type: Full OS Disk Image (bootable live ISO)\n")
+	case imageFormat == imageFormatSquashfs:
+		fmt.Fprintf(file, "\nSnapshot Type: Full OS Disk Image (squashfs)\n")
+	case parent != "":
+		fmt.Fprintf(file, "\nSnapshot Type: Incremental OS Disk Image (on top of %s)\n", parent)
+	default:
+		fmt.Fprintf(file, "\nSnapshot Type: Full OS Disk Image\n")
+	}
 	fmt.Fprintf(file, "Next Snapshot: %s (estimated)\n", now.Add(time.Minute).Format("15:04:05"))
 
 	logInfo("Updated snapshot info file: %s", infoFilePath)
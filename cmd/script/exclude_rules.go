@@ -0,0 +1,242 @@
+package main
+
+// Exclude file (EXCLUDE_FILE).
+//
+// One rule per line, gitignore style, applied after the EXCLUDE_* patterns
+// and the source rules, the last matching rule deciding:
+//
+//	# comment, only at the start of a line
+//	*.log                 a name at any depth
+//	/var/cache/*          a pattern with a / matches the whole path
+//	/srv/**/tmp/          ** spans directories; a trailing / only matches directories
+//	!/var/log/important.log   ! includes back what an earlier rule excluded
+//	@max-size 500M        regular files larger than the size (K, M, G, T)
+//	@max-size 10M *.log   ... only those matching the pattern
+//	@marker .nobackup     directories containing a file of that name
+//
+// A leading \ escapes #, ! and @ in names. As with gitignore, nothing below
+// an excluded directory can be included back, since it is never walked.
+
+import (
+	"bufio"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// excludeRule is one line of the exclude file.
+type excludeRule struct {
+	text    string         // As written, for the run summary
+	pattern *regexp.Regexp // nil matches everything
+	base    bool           // Pattern matches the file name, not the path
+	negate  bool
+	dirOnly bool
+	maxSize int64  // @max-size: only files larger than this match
+	marker  string // @marker: only directories holding this file match
+}
+
+// loadExcludeFile parses an exclude file.
+func loadExcludeFile(path string) ([]excludeRule, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var rules []excludeRule
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		rule, err := parseExcludeRule(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+func parseExcludeRule(line string) (excludeRule, error) {
+	rule := excludeRule{text: line}
+
+	switch {
+	case strings.HasPrefix(line, "@max-size "):
+		fields := strings.Fields(strings.TrimPrefix(line, "@max-size "))
+		if len(fields) == 0 || len(fields) > 2 {
+			return rule, fmt.Errorf("expected @max-size <size> [pattern]")
+		}
+		size, err := parseSize(fields[0])
+		if err != nil {
+			return rule, err
+		}
+		rule.maxSize = size
+		if len(fields) == 2 {
+			err = rule.setPattern(fields[1])
+		}
+		return rule, err
+	case strings.HasPrefix(line, "@marker "):
+		rule.marker = strings.TrimSpace(strings.TrimPrefix(line, "@marker "))
+		if rule.marker == "" || strings.Contains(rule.marker, "/") {
+			return rule, fmt.Errorf("expected @marker <file name>")
+		}
+		rule.dirOnly = true
+		return rule, nil
+	case strings.HasPrefix(line, "@"):
+		return rule, fmt.Errorf("unknown directive %q", strings.Fields(line)[0])
+	case strings.HasPrefix(line, "!"):
+		rule.negate = true
+		line = line[1:]
+	case strings.HasPrefix(line, `\`):
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if line == "" {
+		return rule, fmt.Errorf("empty pattern")
+	}
+	return rule, rule.setPattern(line)
+}
+
+// setPattern compiles a gitignore pattern. Patterns without a slash match
+// the file name at any depth; the others match the absolute path.
+func (r *excludeRule) setPattern(pattern string) error {
+	r.base = !strings.Contains(pattern, "/")
+	expr := globToRegexp(strings.TrimPrefix(pattern, "/"))
+	if !r.base {
+		expr = "/" + expr
+	}
+	re, err := regexp.Compile("^" + expr + "$")
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	r.pattern = re
+	return nil
+}
+
+// globToRegexp translates *, ?, [...] and ** to a regular expression.
+func globToRegexp(glob string) string {
+	var b strings.Builder
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; {
+		case strings.HasPrefix(glob[i:], "**/"):
+			b.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case c == '*':
+			b.WriteString("[^/]*")
+		case c == '?':
+			b.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(glob):
+			i++
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	return b.String()
+}
+
+// parseSize parses a positive size with an optional K, M, G or T (binary)
+// suffix. Zero is refused: a rule's maxSize of 0 means it has no limit.
+func parseSize(value string) (int64, error) {
+	units := map[byte]int64{'K': 1 << 10, 'M': 1 << 20, 'G': 1 << 30, 'T': 1 << 40}
+	multiplier := int64(1)
+	upper := strings.ToUpper(strings.TrimSuffix(strings.TrimSuffix(value, "B"), "b"))
+	if n := len(upper); n > 0 {
+		if unit, ok := units[upper[n-1]]; ok {
+			multiplier = unit
+			upper = upper[:n-1]
+		}
+	}
+	size, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || size <= 0 || size > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q, expected a size greater than 0", value)
+	}
+	return size * multiplier, nil
+}
+
+// matches reports whether the rule applies to path.
+func (r *excludeRule) matches(path string, info fs.FileInfo) bool {
+	if r.dirOnly && !info.IsDir() {
+		return false
+	}
+	if r.maxSize > 0 && !(info.Mode().IsRegular() && info.Size() > r.maxSize) {
+		return false
+	}
+	if r.pattern != nil {
+		subject := path
+		if r.base {
+			subject = filepath.Base(path)
+		}
+		if !r.pattern.MatchString(subject) {
+			return false
+		}
+	}
+	if r.marker != "" {
+		if _, err := os.Lstat(filepath.Join(path, r.marker)); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// applyExcludeRules runs the rules over a path already excluded or not,
+// and returns the outcome and the rule that decided it, if any.
+func applyExcludeRules(rules []excludeRule, path string, info fs.FileInfo, excluded bool) (bool, string) {
+	decidedBy := ""
+	for i := range rules {
+		if rules[i].matches(path, info) {
+			excluded = !rules[i].negate
+			decidedBy = rules[i].text
+		}
+	}
+	return excluded, decidedBy
+}
+
+// exclusionSummary formats exclusion counts, most frequent rule first.
+func exclusionSummary(counts map[string]int) (int, string) {
+	rules := make([]string, 0, len(counts))
+	total := 0
+	for rule, count := range counts {
+		rules = append(rules, rule)
+		total += count
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		if counts[rules[i]] != counts[rules[j]] {
+			return counts[rules[i]] > counts[rules[j]]
+		}
+		return rules[i] < rules[j]
+	})
+
+	parts := make([]string, len(rules))
+	for i, rule := range rules {
+		parts[i] = fmt.Sprintf("%d × %s", counts[rule], rule)
+	}
+	return total, strings.Join(parts, ", ")
+}
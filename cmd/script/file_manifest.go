@@ -0,0 +1,141 @@
+package main
+
+// Per-file manifests.
+//
+// Every snapshot lists the entries it archived, with their type, size,
+// mode, owner, mtime and, for regular files, the SHA-256 of their content,
+// as JSON in <SNAPSHOT_INFO_DIR>/file_manifest.json inside the snapshot and
+// in a <name>.files.encrypted sidecar next to it. The sidecar is a small
+// gzip-compressed stream encrypted to the same keys as the snapshot, so a
+// snapshot can be searched, compared and verified without decrypting the
+// image; the signed manifest records its digest.
+//
+// The manifest is the first entry of tar archives, from a walk of the
+// sources before any content is read, so it has no hashes there; the
+// sidecar holds the complete one. Image formats stage the archive first and
+// hold the complete manifest.
+//
+// This file is shared by cmd/script and cmd/test; keep the copies identical.
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	fileManifestVersion = 1
+	fileManifestName    = "file_manifest.json"
+	fileManifestSuffix  = ".files.encrypted"
+)
+
+// fileManifest lists what one snapshot archived. An incremental snapshot
+// only lists the entries that changed.
+type fileManifest struct {
+	Version   int                 `json:"version"`
+	Snapshot  string              `json:"snapshot"` // Base name of the .encrypted file
+	CreatedAt time.Time           `json:"created_at"`
+	Entries   []fileManifestEntry `json:"entries"`
+}
+
+// fileManifestEntry is one archived path.
+type fileManifestEntry struct {
+	Path   string    `json:"path"` // Archive name, without the trailing slash of directories
+	Type   string    `json:"type"` // file, dir, symlink, hardlink, char, block or fifo
+	Size   int64     `json:"size"`
+	Mode   string    `json:"mode"` // Octal permission bits, setuid, setgid and sticky included
+	UID    int       `json:"uid"`
+	GID    int       `json:"gid"`
+	User   string    `json:"user,omitempty"`
+	Group  string    `json:"group,omitempty"`
+	MTime  time.Time `json:"mtime"`
+	SHA256 string    `json:"sha256,omitempty"` // Content of regular files
+	Link   string    `json:"link,omitempty"`   // Symlink target, or the entry a hard link shares content with
+}
+
+// fileManifestPathFor returns the sidecar path of an .encrypted file.
+func fileManifestPathFor(snapshotPath string) string {
+	return strings.TrimSuffix(snapshotPath, ".encrypted") + fileManifestSuffix
+}
+
+// isFileManifest reports whether name is a sidecar rather than a snapshot.
+func isFileManifest(name string) bool {
+	return strings.HasSuffix(name, fileManifestSuffix)
+}
+
+// newFileManifestEntry describes an archived entry from its tar header.
+func newFileManifestEntry(hdr *tar.Header, sum string) fileManifestEntry {
+	entry := fileManifestEntry{
+		Path:   strings.TrimSuffix(hdr.Name, "/"),
+		Type:   entryTypeName(hdr.Typeflag),
+		Mode:   fmt.Sprintf("%04o", hdr.Mode&07777),
+		UID:    hdr.Uid,
+		GID:    hdr.Gid,
+		User:   hdr.Uname,
+		Group:  hdr.Gname,
+		MTime:  hdr.ModTime.UTC(),
+		SHA256: sum,
+		Link:   hdr.Linkname,
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		entry.Size = hdr.Size
+	}
+	return entry
+}
+
+func entryTypeName(flag byte) string {
+	switch flag {
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	case tar.TypeFifo:
+		return "fifo"
+	default:
+		return "file"
+	}
+}
+
+// readFileManifest decodes a file manifest.
+func readFileManifest(r io.Reader) (*fileManifest, error) {
+	manifest := &fileManifest{}
+	if err := json.NewDecoder(r).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse file manifest: %v", err)
+	}
+	if manifest.Version != fileManifestVersion {
+		return nil, fmt.Errorf("unsupported file manifest version %d", manifest.Version)
+	}
+	return manifest, nil
+}
+
+// verifyFileManifest checks the sidecar of snapshotPath against the digest
+// its signed manifest records.
+func verifyFileManifest(snapshotPath string, manifest *snapshotManifest) error {
+	if manifest.FilesSHA256 == "" {
+		return fmt.Errorf("the signed manifest records no file manifest")
+	}
+	file, err := os.Open(fileManifestPathFor(snapshotPath))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	digest, _, _, err := digestSnapshot(file)
+	if err != nil {
+		return err
+	}
+	if digest != manifest.FilesSHA256 {
+		return fmt.Errorf("file manifest does not match the signed manifest (sha256 %s, expected %s)", digest, manifest.FilesSHA256)
+	}
+	return nil
+}
@@ -0,0 +1,853 @@
+package main
+
+// In-process filesystem archiver.
+//
+// The sources (the root filesystem by default, see sources.go) are walked
+// once, followed by the database dumps (see databases.go), and streamed as
+// a PAX tar straight into the compressor and the encryptor, with no
+// staging copy. The walk only collects the entries and their headers, so
+// that the archive can start with the file manifest listing all of them
+// (see file_manifest.go); their content is read afterwards. Like the
+// 'rsync -aHAXx' it replaces, it keeps owners, modes and times, extended
+// attributes (which carry POSIX ACLs as system.posix_acl_*), hard links,
+// symlinks and device nodes, and stays on the filesystem of each source.
+// Sparse files are stored as GNU sparse 1.0 entries so holes take no
+// space; GNU tar and Go's archive/tar restore them.
+//
+// For incremental snapshots the archiver also builds the file index and
+// skips the paths the previous index shows unchanged (see incremental.go).
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const tarBlockSize = 512
+
+// fileID identifies an inode, to store later names of a hard link as links.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+type filesystemArchiver struct {
+	out        io.Writer // Underlying stream, for entries tar.Writer cannot encode
+	tw         *tar.Writer
+	source     *snapshotSource // Source being walked
+	view       string          // Frozen copy of the source path being read, "" when live
+	remote     *remoteHost     // Host the entries are pulled from, nil for this one
+	rootDev    uint64          // Device of the source path
+	excludes   []string
+	rules      []excludeRule
+	excludedBy map[string]int // Excluded entries by deciding rule
+	links      map[fileID]string
+	pending    []pendingEntry  // Entries found by the walk, archived after the file manifest
+	unreadable map[string]bool // Pending entries that could not be read, by archive name
+	previous   *fileIndex      // Index of the snapshot an incremental builds on
+	index      *fileIndex      // Index being built, nil unless incremental
+	listing    *fileManifest   // Per-file manifest being built, hashes included
+
+	files     int
+	bytes     int64
+	skipped   int
+	unchanged int
+}
+
+// pendingEntry is an entry found by the walk, with its header but without
+// its extended attributes, which are read with its content.
+type pendingEntry struct {
+	path   string // Path read: in the frozen view when there is one, in the spool for dumps
+	hdr    *tar.Header
+	sparse bool // Fewer blocks allocated than the size implies holes
+	dump   bool // Database dump, which has no extended attributes to keep
+}
+
+// writeSnapshotArchive streams the tar of one snapshot, listing its entries
+// in listing: the host being pulled, or this host's sources.
+func writeSnapshotArchive(w io.Writer, now time.Time, plan *incrementalPlan, listing *fileManifest) error {
+	if pulledHost != nil {
+		return writeRemoteArchive(w, pulledHost, now, listing)
+	}
+	return writeFilesystemArchive(w, snapshotSources, now, plan, listing)
+}
+
+// writeFilesystemArchive streams a tar of the sources to w, starting with
+// the file manifest and the snapshot info file. With a plan, it fills the
+// plan's index and, for an incremental, only archives what changed.
+func writeFilesystemArchive(w io.Writer, sources []snapshotSource, now time.Time, plan *incrementalPlan, listing *fileManifest) error {
+	a := &filesystemArchiver{
+		out:        w,
+		tw:         tar.NewWriter(w),
+		excludes:   excludePatterns,
+		rules:      excludeRules,
+		excludedBy: make(map[string]int),
+		links:      make(map[fileID]string),
+		unreadable: make(map[string]bool),
+		listing:    listing,
+	}
+	if plan != nil {
+		a.previous = plan.previous
+		a.index = plan.index
+	}
+
+	// Databases are dumped first, for the info file to record the outcome
+	var dumps []databaseDump
+	if len(databaseSources) > 0 {
+		if err := os.MkdirAll(tempMountPoint, 0700); err != nil {
+			return err
+		}
+		spool, err := os.MkdirTemp(tempMountPoint, "databases-")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(spool)
+		dumps = dumpDatabases(databaseSources, spool)
+	}
+
+	// Containers stay paused until their volumes are captured or archived
+	configured := len(sources)
+	sources, resume := withDockerVolumes(sources)
+	defer resume()
+
+	views, release, err := captureSources(sources)
+	if err != nil {
+		return err
+	}
+	defer release()
+	if allCaptured(views[configured:]) {
+		resume()
+	}
+	// Nothing is read live, so the applications can resume already
+	if allCaptured(views) && currentHooks != nil {
+		logInfo("🪝 Every source is captured, running post-snapshot hooks")
+		currentHooks.runPost("captured")
+	}
+
+	for i := range sources {
+		a.walkSource(&sources[i], views[i])
+	}
+	if len(dumps) > 0 {
+		if err := a.scanDatabaseDumps(dumps, now); err != nil {
+			return err
+		}
+	}
+
+	if err := a.writeFileManifest(a.pendingManifest(), now); err != nil {
+		return fmt.Errorf("failed to add file manifest: %v", err)
+	}
+	if err := a.writeInfoFile(sources, views, dumps, now); err != nil {
+		return fmt.Errorf("failed to add snapshot info: %v", err)
+	}
+	for _, entry := range a.pending {
+		if err := a.writePending(entry); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", entry.hdr.Name, err)
+		}
+	}
+	a.pending = nil
+	resume()
+
+	if a.previous != nil {
+		deleted := deletedPaths(a.previous, a.index)
+		if err := a.writeDeletedPaths(deleted, now); err != nil {
+			return fmt.Errorf("failed to add deletion list: %v", err)
+		}
+		logInfo("📇 %d entries unchanged since %s, %d deleted", a.unchanged, a.previous.Snapshot, len(deleted))
+	}
+
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+
+	logInfo("Archived %d entries (%.2f MB of file data)", a.files, float64(a.bytes)/1024/1024)
+	if total, summary := exclusionSummary(a.excludedBy); total > 0 {
+		logInfo("🚫 Excluded %d entries (a directory counts once): %s", total, summary)
+	}
+	if a.skipped > 0 {
+		logError("%d files could not be read and were skipped", a.skipped)
+	}
+	return nil
+}
+
+// walkSource adds the entries of one source to the pending entries, from
+// its frozen view when it has one. The source path itself is only an entry
+// for named sources; the root of the default source has no archive name.
+func (a *filesystemArchiver) walkSource(source *snapshotSource, captured *sourceCapture) {
+	a.source = source
+	a.view = ""
+	// A source given as a symlink is archived as the tree it points to
+	resolved, err := filepath.EvalSymlinks(source.Path)
+	var info fs.FileInfo
+	if err == nil && captured != nil {
+		a.view = captured.view
+		info, err = os.Stat(a.view)
+	} else if err == nil {
+		info, err = os.Stat(resolved)
+	}
+	if err != nil {
+		logError("Skipping source %s: %v", source.Name, err)
+		a.skipped++
+		a.keepPrevious(source.Path)
+		return
+	}
+	resolvedSource := *source
+	resolvedSource.Path = resolved
+	source = &resolvedSource
+	a.source = source
+	a.rootDev = uint64(info.Sys().(*syscall.Stat_t).Dev)
+
+	root := source.Path
+	if a.view != "" {
+		root = a.view
+	}
+	filepath.WalkDir(root, func(walked string, d fs.DirEntry, err error) error {
+		// Rules, names and the index use the live path
+		path := a.livePath(walked)
+		if err != nil {
+			// Files vanish and permissions change while a live system is
+			// archived; rsync warns and carries on too
+			logError("Skipping %s: %v", path, err)
+			a.skipped++
+			a.keepPrevious(path)
+			return nil
+		}
+		if path == source.Path && source.Prefix == "" {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			logError("Skipping %s: %v", path, err)
+			a.skipped++
+			a.keepPrevious(path)
+			return nil
+		}
+		if path != source.Path && a.excluded(path, info) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if a.changed(path, info) {
+			a.scan(walked, path, info)
+		}
+
+		// Like rsync -x: keep mount points but not what is mounted on them
+		if d.IsDir() && uint64(info.Sys().(*syscall.Stat_t).Dev) != a.rootDev {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// livePath maps a path read from the frozen view to the live path it is a
+// copy of.
+func (a *filesystemArchiver) livePath(path string) string {
+	if a.view == "" {
+		return path
+	}
+	rel, err := filepath.Rel(a.view, path)
+	if err != nil {
+		return path
+	}
+	return filepath.Join(a.source.Path, rel)
+}
+
+// excluded reports whether an exclusion pattern matches path. Patterns
+// starting with / match the whole path, others the file name, as in rsync.
+// The source's include patterns win over its excludes and EXCLUDE_*, and
+// the EXCLUDE_FILE rules come last. The disk image directory, the image
+// staging areas and the btrfs capture snapshots of this host are always
+// excluded.
+func (a *filesystemArchiver) excluded(path string, info fs.FileInfo) bool {
+	if a.remote == nil && a.localArea(path, info) {
+		return true
+	}
+	if a.source.matchSourcePattern(a.source.Include, path) {
+		return false
+	}
+
+	excluded, decidedBy := false, ""
+	if a.source.matchSourcePattern(a.source.Exclude, path) {
+		excluded, decidedBy = true, "SOURCE_"+strings.ToUpper(a.source.Name)+"_EXCLUDE"
+	}
+	for _, pattern := range a.excludes {
+		if excluded {
+			break
+		}
+		subject := path
+		if !strings.HasPrefix(pattern, "/") {
+			subject = filepath.Base(path)
+		}
+		if matched, _ := filepath.Match(pattern, subject); matched {
+			excluded, decidedBy = true, pattern
+		}
+	}
+	if fileExcluded, rule := applyExcludeRules(a.rules, path, info, excluded); rule != "" {
+		excluded, decidedBy = fileExcluded, rule
+	}
+
+	if excluded {
+		a.excludedBy[decidedBy]++
+	}
+	return excluded
+}
+
+// localArea reports whether path is one of this tool's own directories.
+func (a *filesystemArchiver) localArea(path string, info fs.FileInfo) bool {
+	for _, dir := range []string{diskImageDir, tempMountPoint, tempISODir} {
+		if strings.HasPrefix(path, dir+"/") {
+			return true
+		}
+	}
+	if path == tempISOFile {
+		return true
+	}
+	return info.IsDir() && filepath.Base(path) == captureSnapshotDir
+}
+
+// changed records path in the index being built and reports whether it has
+// to be archived: always for a full snapshot, and for an incremental when
+// it is new or its size, times or inode changed.
+func (a *filesystemArchiver) changed(path string, info fs.FileInfo) bool {
+	if a.index == nil {
+		return true
+	}
+
+	name := a.source.archiveName(path)
+	entry := newIndexEntry(info)
+	if a.previous != nil {
+		if old, ok := a.previous.Entries[name]; ok && old.sameFile(entry) {
+			entry.SHA256 = old.SHA256
+			a.index.Entries[name] = entry
+			a.unchanged++
+			return false
+		}
+	}
+	a.index.Entries[name] = entry
+	return true
+}
+
+// keepPrevious carries the previous index entries of an unreadable path,
+// and of everything below it, into the new index: restores keep the last
+// copy that could be read instead of deleting it.
+func (a *filesystemArchiver) keepPrevious(path string) {
+	a.keepPreviousName(a.source.archiveName(path))
+}
+
+func (a *filesystemArchiver) keepPreviousName(name string) {
+	if a.previous == nil {
+		return
+	}
+	for previous, entry := range a.previous.Entries {
+		if name == "" || previous == name || strings.HasPrefix(previous, name+"/") {
+			if _, ok := a.index.Entries[previous]; !ok {
+				a.index.Entries[previous] = entry
+			}
+		}
+	}
+}
+
+// forget undoes changed for an entry that could not be archived after all:
+// the previous copy is kept, or the next snapshot tries again.
+func (a *filesystemArchiver) forget(name string) {
+	if a.index == nil {
+		return
+	}
+	delete(a.index.Entries, name)
+	a.keepPreviousName(name)
+}
+
+// recordHash stores the hex SHA-256 of the content archived for name.
+func (a *filesystemArchiver) recordHash(name, sum string) {
+	if a.index == nil {
+		return
+	}
+	entry := a.index.Entries[name]
+	entry.SHA256 = sum
+	a.index.Entries[name] = entry
+}
+
+// contentHash returns a hash of archived content, or nil when neither an
+// index nor a file manifest is being built.
+func (a *filesystemArchiver) contentHash() hash.Hash {
+	if a.index == nil && a.listing == nil {
+		return nil
+	}
+	return sha256.New()
+}
+
+// list adds an archived entry to the file manifest.
+func (a *filesystemArchiver) list(hdr *tar.Header, sum string) {
+	if a.listing != nil {
+		a.listing.Entries = append(a.listing.Entries, newFileManifestEntry(hdr, sum))
+	}
+}
+
+// pendingManifest lists the pending entries for the file manifest.
+func (a *filesystemArchiver) pendingManifest() []fileManifestEntry {
+	entries := make([]fileManifestEntry, len(a.pending))
+	for i, entry := range a.pending {
+		entries[i] = newFileManifestEntry(entry.hdr, "")
+	}
+	return entries
+}
+
+// writeFileManifest starts the archive with the file manifest of the
+// entries to come. Their content has not been read yet, so the hashes are
+// left out; the sidecar written once the archive is complete has them.
+func (a *filesystemArchiver) writeFileManifest(entries []fileManifestEntry, now time.Time) error {
+	if a.listing == nil {
+		return nil
+	}
+	manifest := *a.listing
+	manifest.Entries = entries
+	content, err := json.Marshal(&manifest)
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(filepath.Join(snapshotInfoDir, fileManifestName)),
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  now,
+		Format:   tar.FormatPAX,
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = a.tw.Write(content)
+	return err
+}
+
+// writeDeletedPaths ends an incremental snapshot with the paths deleted
+// since the previous snapshot.
+func (a *filesystemArchiver) writeDeletedPaths(deleted []string, now time.Time) error {
+	content := formatDeletedPaths(deleted)
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     filepath.ToSlash(filepath.Join(snapshotInfoDir, deletedFilesName)),
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  now,
+		Format:   tar.FormatPAX,
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(content)
+	return err
+}
+
+func (a *filesystemArchiver) writeInfoFile(sources []snapshotSource, views []*sourceCapture, dumps []databaseDump, now time.Time) error {
+	var content bytes.Buffer
+	fmt.Fprintf(&content, "Last Snapshot Information\n")
+	fmt.Fprintf(&content, "========================\n")
+	fmt.Fprintf(&content, "Disk image created: %s\n", now.Format(time.RFC3339))
+	if a.remote != nil {
+		fmt.Fprintf(&content, "Remote host: %s\n", a.remote.describe())
+	}
+	for _, line := range describeSources(sources) {
+		fmt.Fprintf(&content, "Source: %s\n", line)
+	}
+	for i, view := range views {
+		if view != nil {
+			fmt.Fprintf(&content, "Capture: %s from a %s snapshot of %s\n", sources[i].Name, view.capture.backend, view.capture.origin)
+		}
+	}
+	for _, dump := range dumps {
+		fmt.Fprintf(&content, "Database: %s\n", dump.describe())
+	}
+	if len(excludeRules) > 0 {
+		fmt.Fprintf(&content, "Exclude file: %s (%d rules)\n", excludeFile, len(excludeRules))
+	}
+	fmt.Fprintf(&content, "Type: Compressed tar archive (%s)\n", compressionCodec)
+	if a.previous != nil {
+		fmt.Fprintf(&content, "Snapshot: Incremental on top of %s (full snapshot %s)\n", a.previous.Snapshot, a.previous.Full)
+		fmt.Fprintf(&content, "Deleted paths: %s\n", filepath.ToSlash(filepath.Join(snapshotInfoDir, deletedFilesName)))
+	} else {
+		fmt.Fprintf(&content, "Snapshot: Full\n")
+	}
+	if a.listing != nil {
+		fmt.Fprintf(&content, "File manifest: %s, with content hashes in the %s sidecar\n",
+			filepath.ToSlash(filepath.Join(snapshotInfoDir, fileManifestName)), fileManifestSuffix)
+	}
+	fmt.Fprintf(&content, "Encryption: AES-256-GCM with Shamir Secret Sharing\n")
+	fmt.Fprintf(&content, "\nTo restore:\n")
+	fmt.Fprintf(&content, "1. Decrypt with 3 key shares\n")
+	fmt.Fprintf(&content, "2. Extract with: tar -xpf <file>.tar%s --xattrs --acls --numeric-owner -C <target>\n", compressionExtension(compressionCodec))
+	if a.previous != nil {
+		fmt.Fprintf(&content, "   Restore the full snapshot and every incremental before this one first,\n")
+		fmt.Fprintf(&content, "   or use 'decrypt restore', which replays the chain and applies deletions\n")
+	}
+
+	name := filepath.ToSlash(filepath.Join(snapshotInfoDir, diskImageInfoFile))
+	dirHeader := &tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     filepath.ToSlash(snapshotInfoDir) + "/",
+		Mode:     0755,
+		ModTime:  now,
+		Format:   tar.FormatPAX,
+	}
+	if err := a.tw.WriteHeader(dirHeader); err != nil {
+		return err
+	}
+	fileHeader := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(content.Len()),
+		ModTime:  now,
+		Format:   tar.FormatPAX,
+	}
+	if err := a.tw.WriteHeader(fileHeader); err != nil {
+		return err
+	}
+	_, err := a.tw.Write(content.Bytes())
+	return err
+}
+
+// scan adds an entry found by the walk to the pending entries. Later names
+// of a hard link are stored as links to the first one.
+func (a *filesystemArchiver) scan(path, live string, info fs.FileInfo) {
+	if info.Mode()&fs.ModeSocket != 0 {
+		return // Sockets cannot be archived and are recreated by their owner
+	}
+
+	name := a.source.archiveName(live)
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(path); err != nil {
+			logError("Skipping %s: %v", live, err)
+			a.skipped++
+			a.forget(name)
+			return
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		logError("Skipping %s: %v", live, err)
+		a.skipped++
+		a.forget(name)
+		return
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+
+	entry := pendingEntry{path: path, hdr: hdr}
+	if info.Mode().IsRegular() {
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Nlink > 1 {
+			id := fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+			if first, ok := a.links[id]; ok {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = first
+				hdr.Size = 0
+			} else {
+				a.links[id] = hdr.Name
+			}
+		}
+		entry.sparse = hdr.Typeflag == tar.TypeReg && stat.Blocks*512 < stat.Size
+	}
+	a.pending = append(a.pending, entry)
+}
+
+// writePending archives an entry found by the walk. A file that vanished
+// or cannot be opened since is skipped, like the walk skips what it cannot
+// read.
+func (a *filesystemArchiver) writePending(entry pendingEntry) error {
+	hdr := entry.hdr
+	name := strings.TrimSuffix(hdr.Name, "/")
+	if hdr.Typeflag == tar.TypeLink && a.unreadable[hdr.Linkname] {
+		logError("Skipping %s: hard link to unreadable %s", name, hdr.Linkname)
+		a.skipped++
+		a.forget(name)
+		return nil
+	}
+
+	var file *os.File
+	if hdr.Typeflag == tar.TypeReg {
+		var err error
+		if file, err = os.Open(entry.path); err != nil {
+			logError("Skipping %s: %v", name, err)
+			a.skipped++
+			a.unreadable[name] = true
+			a.forget(name)
+			return nil
+		}
+		defer file.Close()
+	}
+
+	if hdr.Typeflag != tar.TypeSymlink && !entry.dump {
+		xattrs, err := listXattrs(entry.path)
+		if err != nil {
+			logError("Cannot read extended attributes of %s: %v", entry.path, err)
+		}
+		for attr, value := range xattrs {
+			if hdr.PAXRecords == nil {
+				hdr.PAXRecords = make(map[string]string)
+			}
+			hdr.PAXRecords["SCHILY.xattr."+attr] = value
+		}
+	}
+
+	a.files++
+	if hdr.Typeflag == tar.TypeLink {
+		if a.index != nil {
+			a.recordHash(hdr.Name, a.index.Entries[hdr.Linkname].SHA256)
+		}
+		a.list(hdr, "")
+		return a.tw.WriteHeader(hdr)
+	}
+	if file == nil {
+		a.list(hdr, "")
+		return a.tw.WriteHeader(hdr)
+	}
+
+	if entry.sparse {
+		regions, err := dataRegions(file, hdr.Size)
+		if err == nil && sparseWorthIt(regions, hdr.Size) {
+			return a.writeSparseFile(hdr, file, regions)
+		}
+	}
+
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	dst := io.Writer(a.tw)
+	h := a.contentHash()
+	if h != nil {
+		dst = io.MultiWriter(a.tw, h)
+	}
+	n, err := io.Copy(dst, io.LimitReader(file, hdr.Size))
+	a.bytes += n
+	if err != nil {
+		return err
+	}
+	if n < hdr.Size {
+		// The file shrank since the walk; pad to the recorded size so the
+		// archive stays readable
+		logError("%s shrank while being archived", entry.path)
+		if _, err := io.CopyN(dst, zeroReader{}, hdr.Size-n); err != nil {
+			return err
+		}
+	}
+	sum := ""
+	if h != nil {
+		sum = hex.EncodeToString(h.Sum(nil))
+		a.recordHash(hdr.Name, sum)
+	}
+	a.list(hdr, sum)
+	return nil
+}
+
+// sparseRegion is a range of a file that holds data.
+type sparseRegion struct {
+	offset int64
+	length int64
+}
+
+func sparseWorthIt(regions []sparseRegion, size int64) bool {
+	var data int64
+	for _, r := range regions {
+		data += r.length
+	}
+	return size-data >= tarBlockSize
+}
+
+// writeSparseFile writes a GNU sparse 1.0 entry: PAX records name the file
+// and its real size, and the data starts with the map of data regions.
+// tar.Writer refuses GNU.sparse records, so the headers are written to the
+// underlying stream directly, between two tar.Writer entries.
+func (a *filesystemArchiver) writeSparseFile(hdr *tar.Header, file *os.File, regions []sparseRegion) error {
+	var sparseMap bytes.Buffer
+	fmt.Fprintf(&sparseMap, "%d\n", len(regions))
+	var dataSize int64
+	for _, r := range regions {
+		fmt.Fprintf(&sparseMap, "%d\n%d\n", r.offset, r.length)
+		dataSize += r.length
+	}
+	sparseMap.Write(make([]byte, blockPadding(int64(sparseMap.Len()))))
+
+	records := map[string]string{
+		"GNU.sparse.major":    "1",
+		"GNU.sparse.minor":    "0",
+		"GNU.sparse.name":     hdr.Name,
+		"GNU.sparse.realsize": strconv.FormatInt(hdr.Size, 10),
+		"mtime":               formatPAXTime(hdr.ModTime),
+		"uname":               hdr.Uname,
+		"gname":               hdr.Gname,
+		"uid":                 strconv.Itoa(hdr.Uid),
+		"gid":                 strconv.Itoa(hdr.Gid),
+	}
+	for key, value := range hdr.PAXRecords {
+		records[key] = value
+	}
+
+	if err := a.tw.Flush(); err != nil {
+		return err
+	}
+
+	dir, name := filepath.Split(hdr.Name)
+	entry := *hdr
+	entry.Name = filepath.ToSlash(filepath.Join(dir, "GNUSparseFile.0", name))
+	entry.Size = int64(sparseMap.Len()) + dataSize
+
+	paxData := encodePAXRecords(records)
+	paxHeader := tar.Header{
+		Typeflag: tar.TypeXHeader,
+		Name:     filepath.ToSlash(filepath.Join(dir, "PaxHeaders.0", name)),
+		Mode:     0644,
+		Size:     int64(len(paxData)),
+		ModTime:  hdr.ModTime,
+	}
+	if _, err := a.out.Write(ustarBlock(&paxHeader)); err != nil {
+		return err
+	}
+	if _, err := a.out.Write(append(paxData, make([]byte, blockPadding(int64(len(paxData))))...)); err != nil {
+		return err
+	}
+	if _, err := a.out.Write(ustarBlock(&entry)); err != nil {
+		return err
+	}
+	if _, err := a.out.Write(sparseMap.Bytes()); err != nil {
+		return err
+	}
+
+	// The content hash covers the file as restored, holes included
+	dst := a.out
+	h := a.contentHash()
+	if h != nil {
+		dst = io.MultiWriter(a.out, h)
+	}
+	var end int64
+	for _, r := range regions {
+		if h != nil {
+			io.CopyN(h, zeroReader{}, r.offset-end)
+		}
+		end = r.offset + r.length
+
+		n, err := io.Copy(dst, io.NewSectionReader(file, r.offset, r.length))
+		a.bytes += n
+		if err != nil {
+			return err
+		}
+		if n < r.length {
+			logError("%s shrank while being archived", hdr.Name)
+			if _, err := io.CopyN(dst, zeroReader{}, r.length-n); err != nil {
+				return err
+			}
+		}
+	}
+	sum := ""
+	if h != nil {
+		sum = hex.EncodeToString(h.Sum(nil))
+		a.recordHash(hdr.Name, sum)
+	}
+	a.list(hdr, sum)
+	_, err := a.out.Write(make([]byte, blockPadding(entry.Size)))
+	return err
+}
+
+// encodePAXRecords formats records as "<length> <key>=<value>\n", where the
+// length counts the whole record including its own digits.
+func encodePAXRecords(records map[string]string) []byte {
+	keys := make([]string, 0, len(records))
+	for key, value := range records {
+		if value != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	for _, key := range keys {
+		record := " " + key + "=" + records[key] + "\n"
+		size := len(record) + len(strconv.Itoa(len(record)))
+		if len(strconv.Itoa(size)) > len(strconv.Itoa(len(record))) {
+			size++ // One more digit once the length is counted
+		}
+		buf.WriteString(strconv.Itoa(size) + record)
+	}
+	return buf.Bytes()
+}
+
+// ustarBlock encodes the ustar fields of hdr in one 512-byte block. Fields
+// that do not fit are carried by the PAX records written before it.
+func ustarBlock(hdr *tar.Header) []byte {
+	block := make([]byte, tarBlockSize)
+	putString := func(field []byte, s string) {
+		copy(field, s)
+	}
+	putOctal := func(field []byte, n int64) {
+		s := strconv.FormatInt(n, 8)
+		if len(s) >= len(field) {
+			s = strings.Repeat("7", len(field)-1) // Overflow, the PAX record wins
+		}
+		copy(field, strings.Repeat("0", len(field)-1-len(s))+s)
+	}
+
+	name := hdr.Name
+	if len(name) > 100 {
+		name = name[len(name)-100:] // The real name is in GNU.sparse.name
+	}
+	putString(block[0:100], name)
+	putOctal(block[100:108], hdr.Mode&07777)
+	putOctal(block[108:116], int64(hdr.Uid))
+	putOctal(block[116:124], int64(hdr.Gid))
+	putOctal(block[124:136], hdr.Size)
+	putOctal(block[136:148], hdr.ModTime.Unix())
+	block[156] = hdr.Typeflag
+	putString(block[257:263], "ustar\x00")
+	putString(block[263:265], "00")
+	if len(hdr.Uname) <= 32 {
+		putString(block[265:297], hdr.Uname)
+	}
+	if len(hdr.Gname) <= 32 {
+		putString(block[297:329], hdr.Gname)
+	}
+
+	copy(block[148:156], "        ")
+	var sum int64
+	for _, b := range block {
+		sum += int64(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+	return block
+}
+
+func formatPAXTime(t time.Time) string {
+	return fmt.Sprintf("%d.%09d", t.Unix(), t.Nanosecond())
+}
+
+func blockPadding(size int64) int64 {
+	return -size & (tarBlockSize - 1)
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -7,6 +7,9 @@ require (
 	github.com/aws/aws-sdk-go-v2/config v1.27.27
 	github.com/aws/aws-sdk-go-v2/credentials v1.17.27
 	github.com/aws/aws-sdk-go-v2/service/s3 v1.58.2
+	github.com/hashicorp/vault v1.15.2
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
 )
 
 require (
@@ -0,0 +1,167 @@
+package main
+
+// Snapshot hooks.
+//
+// PRE_SNAPSHOT_HOOKS run before the filesystem is captured, to flush caches,
+// pause writers or dump databases, and POST_SNAPSHOT_HOOKS run as soon as
+// it is captured, so applications are paused as briefly as possible: right
+// after the btrfs or LVM snapshots are taken when every source is frozen by
+// CAPTURE_BACKEND, else once the archive or image is written, before it is
+// signed and uploaded. Both are comma-separated commands run one after the
+// other with /bin/sh -c.
+//
+// Each hook gets HOOK_TIMEOUT, after which its whole process group is
+// killed, and the snapshot in its environment:
+//
+//	SNAPSHOT_PHASE      pre or post
+//	SNAPSHOT_NAME       the encrypted snapshot's base name
+//	SNAPSHOT_PATH       the encrypted snapshot's path
+//	SNAPSHOT_TIMESTAMP  the snapshot time, RFC 3339
+//	SNAPSHOT_FORMAT     IMAGE_FORMAT
+//	SNAPSHOT_SOURCES    the source paths, space-separated
+//	SNAPSHOT_HOST       in pull mode, the remote host's name, else empty
+//	SNAPSHOT_STATUS     post hooks only: captured, success, failed or aborted
+//
+// Their output goes to the log line by line. With HOOK_FAILURE_POLICY=abort
+// (the default) a failing or timed out pre hook aborts the snapshot; with
+// continue it is logged and the snapshot is taken anyway. Post hooks run
+// even when the snapshot failed or was aborted, so whatever the pre hooks
+// paused is resumed, and their failures are only logged. They run once per
+// snapshot: after a capture, with status captured, they are not run again
+// when the archive is written or fails.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	hookPolicyAbort    = "abort"
+	hookPolicyContinue = "continue"
+
+	// How long a hook's output may stay open once it exits or is killed
+	hookOutputDelay = 5 * time.Second
+)
+
+// snapshotHooks runs the hooks of one snapshot.
+type snapshotHooks struct {
+	env    []string
+	posted sync.Once // The archiver runs the post hooks once it captured
+}
+
+func newSnapshotHooks(name, path string, now time.Time) *snapshotHooks {
+	sources, host := snapshotSources, ""
+	if pulledHost != nil {
+		sources, host = pulledHost.sources(), pulledHost.Name
+	}
+	var paths []string
+	for _, s := range sources {
+		paths = append(paths, s.Path)
+	}
+	return &snapshotHooks{env: []string{
+		"SNAPSHOT_NAME=" + name,
+		"SNAPSHOT_PATH=" + path,
+		"SNAPSHOT_TIMESTAMP=" + now.Format(time.RFC3339),
+		"SNAPSHOT_FORMAT=" + imageFormat,
+		"SNAPSHOT_SOURCES=" + strings.Join(paths, " "),
+		"SNAPSHOT_HOST=" + host,
+	}}
+}
+
+// runPre runs the pre-snapshot hooks, and returns an error when one fails
+// and HOOK_FAILURE_POLICY is abort.
+func (h *snapshotHooks) runPre() error {
+	for _, command := range preSnapshotHooks {
+		err := runHook(command, append(h.env, "SNAPSHOT_PHASE=pre"))
+		if err == nil {
+			continue
+		}
+		if hookFailurePolicy == hookPolicyAbort {
+			return fmt.Errorf("pre-snapshot hook %q: %v", command, err)
+		}
+		logError("Pre-snapshot hook %q: %v, continuing", command, err)
+	}
+	return nil
+}
+
+// runPost runs every post-snapshot hook, whatever the others do, unless
+// they already ran for this snapshot.
+func (h *snapshotHooks) runPost(status string) {
+	h.posted.Do(func() {
+		for _, command := range postSnapshotHooks {
+			if err := runHook(command, append(h.env, "SNAPSHOT_PHASE=post", "SNAPSHOT_STATUS="+status)); err != nil {
+				logError("Post-snapshot hook %q: %v", command, err)
+			}
+		}
+	})
+}
+
+// runHook runs one hook command with HOOK_TIMEOUT, logging its output.
+func runHook(command string, env []string) error {
+	logInfo("🪝 Running hook: %s", command)
+	start := time.Now()
+	if err := runLogged(hookTimeout, env, "/bin/sh", "-c", command); err != nil {
+		return err
+	}
+	logInfo("Hook done in %s", time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// runLogged runs a command with extra environment variables, logging its
+// output line by line, and kills its whole process group after timeout.
+func runLogged(timeout time.Duration, env []string, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	output := &hookOutput{}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = hookOutputDelay
+	killProcessGroupOnCancel(cmd)
+
+	err := cmd.Run()
+	output.flush()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", timeout)
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("exited with status %d", exitErr.ExitCode())
+	}
+	return err
+}
+
+// hookOutput logs a hook's output line by line. exec calls Write from one
+// goroutine at a time when Stdout and Stderr are the same writer.
+type hookOutput struct {
+	partial []byte
+}
+
+func (o *hookOutput) Write(p []byte) (int, error) {
+	o.partial = append(o.partial, p...)
+	for {
+		i := bytes.IndexByte(o.partial, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		logInfo("  │ %s", strings.TrimRight(string(o.partial[:i]), "\r"))
+		o.partial = o.partial[i+1:]
+	}
+}
+
+// flush logs an unterminated last line.
+func (o *hookOutput) flush() {
+	if len(o.partial) > 0 {
+		logInfo("  │ %s", o.partial)
+		o.partial = nil
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+// killProcessGroupOnCancel leaves cmd as is: without process groups only
+// the hook itself is killed on timeout, not its children.
+func killProcessGroupOnCancel(cmd *exec.Cmd) {}
@@ -0,0 +1,264 @@
+package main
+
+// Incremental snapshots.
+//
+// With INCREMENTAL=true the snapshot job keeps an index of every archived
+// path (size, mtime, ctime, inode and the SHA-256 of regular files) in
+// DISK_IMAGE_DIR/file_index.json.gz. The next snapshot only archives the
+// paths whose size, mtime, ctime or inode changed since the index was
+// written, and ends with <SNAPSHOT_INFO_DIR>/deleted_files.txt, listing the
+// paths that disappeared. Its signed manifest names the snapshot it builds
+// on, so 'decrypt restore' can replay the full snapshot and every
+// incremental after it.
+//
+// A full snapshot is taken when there is no usable index, when the snapshot
+// the index describes is no longer in DISK_IMAGE_DIR, and once
+// FULL_SNAPSHOT_INTERVAL has passed since the last full snapshot. The index
+// is only replaced once a snapshot and its manifest are stored, so a failed
+// run is followed by an incremental against the last good snapshot.
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	fileIndexVersion  = 1
+	fileIndexFilename = "file_index.json.gz"
+	deletedFilesName  = "deleted_files.txt"
+)
+
+// fileIndex describes the tree captured by one snapshot.
+type fileIndex struct {
+	Version  int                   `json:"version"`
+	Snapshot string                `json:"snapshot"` // Relative to DISK_IMAGE_DIR
+	Full     string                `json:"full"`     // Full snapshot the chain starts from
+	FullAt   time.Time             `json:"full_at"`
+	Entries  map[string]indexEntry `json:"entries"` // By archive path
+}
+
+// indexEntry is what a path looked like when it was last archived.
+type indexEntry struct {
+	Size   int64  `json:"size"`
+	MTime  int64  `json:"mtime"` // Unix nanoseconds
+	CTime  int64  `json:"ctime"` // Unix nanoseconds, catches mode, owner and xattr changes
+	Inode  uint64 `json:"inode"`
+	SHA256 string `json:"sha256,omitempty"` // Archived content of regular files
+}
+
+// incrementalPlan is the index a snapshot is compared against, nil for a
+// full snapshot, and the index the archiver builds for the next one.
+type incrementalPlan struct {
+	previous *fileIndex
+	index    *fileIndex
+}
+
+func fileIndexPath() string {
+	return filepath.Join(diskImageDir, fileIndexFilename)
+}
+
+// planSnapshot decides between a full and an incremental snapshot. It
+// returns nil when incremental snapshots are disabled.
+func planSnapshot(now time.Time) *incrementalPlan {
+	if !incrementalEnabled {
+		return nil
+	}
+
+	plan := &incrementalPlan{
+		index: &fileIndex{
+			Version: fileIndexVersion,
+			FullAt:  now,
+			Entries: make(map[string]indexEntry),
+		},
+	}
+
+	previous, err := loadFileIndex(fileIndexPath())
+	switch {
+	case os.IsNotExist(err):
+		logInfo("📇 No file index yet, taking a full snapshot")
+	case err != nil:
+		logError("Cannot read file index, taking a full snapshot: %v", err)
+	case now.Sub(previous.FullAt) >= fullSnapshotInterval:
+		logInfo("📇 Last full snapshot is older than %s, taking a full snapshot", fullSnapshotInterval)
+	case !fileExists(filepath.Join(diskImageDir, previous.Snapshot)):
+		logInfo("📇 Previous snapshot %s is gone, taking a full snapshot", previous.Snapshot)
+	default:
+		logInfo("📇 Taking an incremental snapshot on top of %s", previous.Snapshot)
+		plan.previous = previous
+		plan.index.Full = previous.Full
+		plan.index.FullAt = previous.FullAt
+	}
+	return plan
+}
+
+// parent is the snapshot an incremental builds on, empty for full ones.
+func (p *incrementalPlan) parent() string {
+	if p == nil || p.previous == nil {
+		return ""
+	}
+	return p.previous.Snapshot
+}
+
+// commit saves the index built for the snapshot stored at encryptedPath.
+func (p *incrementalPlan) commit(encryptedPath string) error {
+	if p == nil {
+		return nil
+	}
+
+	rel, err := filepath.Rel(diskImageDir, encryptedPath)
+	if err != nil {
+		return err
+	}
+	p.index.Snapshot = filepath.ToSlash(rel)
+	if p.previous == nil {
+		p.index.Full = p.index.Snapshot
+	}
+	return saveFileIndex(fileIndexPath(), p.index)
+}
+
+func loadFileIndex(path string) (*fileIndex, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, err
+	}
+	index := &fileIndex{}
+	if err := json.NewDecoder(zr).Decode(index); err != nil {
+		return nil, err
+	}
+	if index.Version != fileIndexVersion {
+		return nil, fmt.Errorf("unsupported file index version %d", index.Version)
+	}
+	return index, nil
+}
+
+// saveFileIndex replaces the index atomically, so an interrupted run never
+// leaves a half-written one behind.
+func saveFileIndex(path string, index *fileIndex) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(file)
+	err = json.NewEncoder(zw).Encode(index)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// newIndexEntry records the attributes compared between snapshots.
+func newIndexEntry(info fs.FileInfo) indexEntry {
+	stat := info.Sys().(*syscall.Stat_t)
+	return indexEntry{
+		Size:  info.Size(),
+		MTime: info.ModTime().UnixNano(),
+		CTime: changeTime(stat),
+		Inode: uint64(stat.Ino),
+	}
+}
+
+// sameFile reports whether a path is unchanged since it was indexed.
+func (e indexEntry) sameFile(other indexEntry) bool {
+	return e.Size == other.Size && e.MTime == other.MTime && e.CTime == other.CTime && e.Inode == other.Inode
+}
+
+// deletedPaths lists the paths of previous that are not in index.
+func deletedPaths(previous, index *fileIndex) []string {
+	var deleted []string
+	for path := range previous.Entries {
+		if _, ok := index.Entries[path]; !ok {
+			deleted = append(deleted, path)
+		}
+	}
+	sort.Strings(deleted)
+	return deleted
+}
+
+// formatDeletedPaths writes one path per line. The rare names containing a
+// newline, or starting with a quote, are written as Go quoted strings.
+func formatDeletedPaths(paths []string) []byte {
+	var b strings.Builder
+	for _, path := range paths {
+		if strings.ContainsRune(path, '\n') || strings.HasPrefix(path, `"`) {
+			path = strconv.Quote(path)
+		}
+		b.WriteString(path)
+		b.WriteByte('\n')
+	}
+	return []byte(b.String())
+}
+
+// snapshotParent returns the snapshot an incremental snapshot builds on,
+// from its signed manifest, or "" for full snapshots. A missing or
+// unverifiable manifest is an error: the snapshot may be incremental.
+func snapshotParent(snapshotPath string, publicKey []byte) (string, error) {
+	data, err := os.ReadFile(manifestPathFor(snapshotPath))
+	if err != nil {
+		return "", err
+	}
+	manifest, err := openManifest(data, publicKey)
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", manifestPathFor(snapshotPath), err)
+	}
+	if manifest.Parent == "" {
+		return "", nil
+	}
+	return filepath.Join(diskImageDir, filepath.FromSlash(manifest.Parent)), nil
+}
+
+// chainAncestors returns every snapshot the given snapshots need to be
+// restored: their parents, their parents' parents, up to the full snapshot.
+// It fails if any link of the ancestry cannot be resolved.
+func chainAncestors(snapshots []string) (map[string]bool, error) {
+	needed := make(map[string]bool)
+	if len(snapshots) == 0 {
+		return needed, nil
+	}
+	publicKey, err := loadSigningPublicKey(keyDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signing public key: %v", err)
+	}
+
+	for _, path := range snapshots {
+		for path != "" && !needed[path] {
+			parent, err := snapshotParent(path, publicKey)
+			if err != nil {
+				return nil, err
+			}
+			if parent != "" {
+				needed[parent] = true
+			}
+			path = parent
+		}
+	}
+	return needed, nil
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// changeTime returns the inode change time of stat, in nanoseconds.
+func changeTime(stat *syscall.Stat_t) int64 {
+	return time.Unix(int64(stat.Ctim.Sec), int64(stat.Ctim.Nsec)).UnixNano()
+}
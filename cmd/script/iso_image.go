@@ -0,0 +1,176 @@
+package main
+
+// Bootable live ISOs (IMAGE_FORMAT=iso).
+//
+// A container root filesystem has no kernel, so the kernel and initrd come
+// from ISO_KERNEL and ISO_INITRD; the initrd must include live-boot (Debian
+// live-boot-initramfs-tools or an equivalent). The ISO uses the live-boot
+// layout:
+//
+//	isolinux/isolinux.bin, ldlinux.c32, isolinux.cfg   El Torito boot image
+//	live/vmlinuz, live/initrd.img                      ISO_KERNEL, ISO_INITRD
+//	live/filesystem.squashfs                           the snapshot's root filesystem
+//
+// isolinux boots the kernel with ISO_BOOT_OPTIONS ("boot=live components"
+// by default), and live-boot finds the squashfs on the CD and mounts it as
+// the root filesystem under a tmpfs overlay. Every boot file is checked
+// before the filesystem is staged, and a missing one fails the snapshot.
+//
+// The squashfs is compressed with COMPRESSION already (see
+// squashfs_image.go), so the ISO itself is encrypted without compression;
+// the kernel must support the codec.
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	isoVolumeLabel = "MOBULA_SNAPSHOT"
+
+	// genisoimage cannot store files of 4 GiB or more in ISO 9660
+	isoMaxFileSize = 4*1024*1024*1024 - 1
+)
+
+// isoBootFile is a file copied into the ISO.
+type isoBootFile struct {
+	source string
+	dest   string // Relative to the ISO root
+}
+
+// isoBootFiles lists the boot files of the ISO, and fails with every
+// missing file or tool at once.
+func isoBootFiles() ([]isoBootFile, error) {
+	files := []isoBootFile{
+		{source: isoKernel, dest: "live/vmlinuz"},
+		{source: isoInitrd, dest: "live/initrd.img"},
+		{source: filepath.Join(isolinuxLibPath, "isolinux.bin"), dest: "isolinux/isolinux.bin"},
+		{source: filepath.Join(syslinuxLibPath, "ldlinux.c32"), dest: "isolinux/ldlinux.c32"},
+	}
+
+	var problems []string
+	if isoKernel == "" {
+		problems = append(problems, "ISO_KERNEL is not set")
+	}
+	if isoInitrd == "" {
+		problems = append(problems, "ISO_INITRD is not set")
+	}
+	for _, file := range files {
+		if file.source == "" {
+			continue
+		}
+		if info, err := os.Stat(file.source); err != nil {
+			problems = append(problems, err.Error())
+		} else if !info.Mode().IsRegular() {
+			problems = append(problems, file.source+" is not a regular file")
+		}
+	}
+	for _, tool := range []string{genisoimagePath, mksquashfsPath} {
+		if _, err := exec.LookPath(tool); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("cannot build a bootable ISO: %s", strings.Join(problems, "; "))
+	}
+	return files, nil
+}
+
+// createBootableISO builds a live ISO of the root filesystem and encrypts
+// it to encryptedPath.
+func createBootableISO(encryptedPath, keyID string, key []byte, now time.Time, listing *fileManifest) error {
+	files, err := isoBootFiles()
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(tempISODir, 0700); err != nil {
+		return err
+	}
+	isoDir, err := os.MkdirTemp(tempISODir, "iso-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(isoDir)
+	if err := os.Chmod(isoDir, 0755); err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if err := copyBootFile(file.source, filepath.Join(isoDir, file.dest)); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", file.source, err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(isoDir, "isolinux", "isolinux.cfg"), isolinuxConfig(now), 0644); err != nil {
+		return err
+	}
+
+	squashfsPath := filepath.Join(isoDir, "live", "filesystem.squashfs")
+	if err := makeSquashfsImage(squashfsPath, now, listing); err != nil {
+		return err
+	}
+	if info, err := os.Stat(squashfsPath); err != nil {
+		return err
+	} else if info.Size() > isoMaxFileSize {
+		return fmt.Errorf("filesystem.squashfs is %.2f GB, ISO 9660 cannot hold files of 4 GiB or more; exclude more paths",
+			float64(info.Size())/1024/1024/1024)
+	}
+
+	logInfo("Building bootable ISO %s...", tempISOFile)
+	defer os.Remove(tempISOFile)
+	cmd := exec.Command(genisoimagePath,
+		"-o", tempISOFile,
+		"-b", "isolinux/isolinux.bin",
+		"-c", "isolinux/boot.cat",
+		"-no-emul-boot", "-boot-load-size", "4", "-boot-info-table",
+		"-iso-level", "3", "-R", "-J",
+		"-V", isoVolumeLabel,
+		isoDir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", genisoimagePath, err, strings.TrimSpace(string(output)))
+	}
+	// The squashfs is in the ISO now
+	os.RemoveAll(isoDir)
+
+	return encryptImageFile(tempISOFile, encryptedPath, keyID, key, false)
+}
+
+// isolinuxConfig boots the live kernel straight away.
+func isolinuxConfig(now time.Time) []byte {
+	var cfg strings.Builder
+	fmt.Fprintf(&cfg, "DEFAULT live\n")
+	fmt.Fprintf(&cfg, "PROMPT 0\n")
+	fmt.Fprintf(&cfg, "TIMEOUT 0\n\n")
+	fmt.Fprintf(&cfg, "LABEL live\n")
+	fmt.Fprintf(&cfg, "  MENU LABEL Mobula snapshot %s\n", now.Format("2006-01-02 15:04"))
+	fmt.Fprintf(&cfg, "  KERNEL /live/vmlinuz\n")
+	fmt.Fprintf(&cfg, "  APPEND initrd=/live/initrd.img %s\n", isoBootOptions)
+	return []byte(cfg.String())
+}
+
+func copyBootFile(source, dest string) error {
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	src, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// lockedBuffer holds key material in an anonymous mapping that is locked
+// into RAM (never swapped) and excluded from core dumps.
+type lockedBuffer struct {
+	mapping []byte
+	data    []byte
+}
+
+func newLockedBuffer(size int) (*lockedBuffer, error) {
+	pageSize := syscall.Getpagesize()
+	length := ((size + pageSize - 1) / pageSize) * pageSize
+
+	mapping, err := syscall.Mmap(-1, 0, length, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_PRIVATE|syscall.MAP_ANON)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map secure memory: %v", err)
+	}
+
+	if err := syscall.Mlock(mapping); err != nil {
+		syscall.Munmap(mapping)
+		return nil, fmt.Errorf("failed to lock secure memory (is the memlock limit too low?): %v", err)
+	}
+
+	// Best effort: keep the page out of core dumps even if dumping is re-enabled
+	syscall.Madvise(mapping, madvDontDump)
+
+	return &lockedBuffer{mapping: mapping, data: mapping[:size]}, nil
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	return b.data
+}
+
+// Destroy zeroes the buffer and releases the mapping.
+func (b *lockedBuffer) Destroy() {
+	if b == nil || b.mapping == nil {
+		return
+	}
+	wipe(b.mapping)
+	syscall.Munlock(b.mapping)
+	syscall.Munmap(b.mapping)
+	b.mapping, b.data = nil, nil
+}
+
+const madvDontDump = 0x10 // MADV_DONTDUMP
+
+// hardenProcess stops the kernel from writing core dumps of this process and
+// other users' ptrace access, so an unsealed key cannot leak through them.
+func hardenProcess() error {
+	_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_SET_DUMPABLE, 0, 0)
+	if errno != 0 {
+		return errno
+	}
+
+	var limit syscall.Rlimit
+	return syscall.Setrlimit(syscall.RLIMIT_CORE, &limit)
+}
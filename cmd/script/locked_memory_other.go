@@ -0,0 +1,35 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// Sealed mode keeps key material in locked, non-dumpable memory, which is
+// only implemented for Linux; elsewhere the daemon cannot hold a key.
+var errLockedMemoryUnsupported = errors.New("locked key memory is only supported on Linux")
+
+// lockedBuffer holds key material in memory locked into RAM.
+type lockedBuffer struct {
+	data []byte
+}
+
+func newLockedBuffer(size int) (*lockedBuffer, error) {
+	return nil, errLockedMemoryUnsupported
+}
+
+func (b *lockedBuffer) Bytes() []byte {
+	return b.data
+}
+
+// Destroy zeroes the buffer.
+func (b *lockedBuffer) Destroy() {
+	if b != nil {
+		wipe(b.data)
+		b.data = nil
+	}
+}
+
+// hardenProcess would disable core dumps and ptrace access to the process.
+func hardenProcess() error {
+	return errLockedMemoryUnsupported
+}
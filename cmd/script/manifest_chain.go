@@ -0,0 +1,489 @@
+package main
+
+// Manifest hash chain.
+//
+// Each manifest links to the previous one by hash, forming an append-only
+// chain per host. The chain head (sequence, file and hash of the newest
+// manifest) is kept in KEY_DIR/manifest_chain.json next to the signing key,
+// so it survives retention cleanup of old snapshots.
+//
+// 'snapshot verify-chain' walks DISK_IMAGE_DIR and the S3 prefix and reports:
+//   - missing sequence numbers (a snapshot and its manifest were deleted),
+//   - manifests that do not link to their predecessor (replaced snapshots),
+//   - creation times going backwards (reordering),
+//   - a chain ending before the recorded head (the newest snapshots were
+//     removed), and
+//   - snapshots missing or not matching their manifest, and local file
+//     manifest sidecars not matching it.
+//
+// Retention cleanup records the sequence numbers of the manifests it
+// removes in KEY_DIR/manifest_tombstones.json, signed with the host key, so
+// the gaps it leaves in the local chain (expired snapshots between kept
+// incremental ancestors, or between the snapshots of pulled hosts) are not
+// reported. The bucket keeps the whole chain and accepts no gap.
+//
+// Snapshots taken before manifests were chained have no sequence number and
+// are only counted.
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	chainHeadFilename      = "manifest_chain.json"
+	tombstonesFilename     = "manifest_tombstones.json"
+	tombstoneSignaturePref = "mobula manifest tombstones\x00"
+	maxManifestSize        = 1 << 20
+)
+
+// chainHead is the newest link of the manifest chain.
+type chainHead struct {
+	Sequence  uint64    `json:"sequence"`
+	File      string    `json:"file"`
+	Hash      string    `json:"hash"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// chainTombstones lists the sequence numbers of the manifests retention
+// cleanup removed, as merged inclusive ranges.
+type chainTombstones struct {
+	Removed [][2]uint64 `json:"removed"`
+}
+
+// signedTombstones is the on-disk tombstone list, signed like manifests.
+type signedTombstones struct {
+	Tombstones json.RawMessage `json:"tombstones"`
+	Signer     string          `json:"signer"`
+	Signature  []byte          `json:"signature"`
+}
+
+// chainEntry is a manifest found while verifying the chain.
+type chainEntry struct {
+	location string // Local path or S3 key of the manifest
+	hash     string
+	manifest *snapshotManifest
+}
+
+// loadChainHead reads the chain head; an empty head starts a new chain.
+func loadChainHead(keyDir string) (*chainHead, error) {
+	data, err := os.ReadFile(filepath.Join(keyDir, chainHeadFilename))
+	if os.IsNotExist(err) {
+		return &chainHead{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	head := &chainHead{}
+	if err := json.Unmarshal(data, head); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", chainHeadFilename, err)
+	}
+	return head, nil
+}
+
+// saveChainHead atomically replaces the chain head.
+func saveChainHead(keyDir string, head *chainHead) error {
+	data, err := json.MarshalIndent(head, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(keyDir, chainHeadFilename)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// loadTombstones reads and checks the tombstone list; a missing list is
+// empty.
+func loadTombstones(keyDir string, publicKey ed25519.PublicKey) (*chainTombstones, error) {
+	data, err := os.ReadFile(filepath.Join(keyDir, tombstonesFilename))
+	if os.IsNotExist(err) {
+		return &chainTombstones{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signed := signedTombstones{}
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", tombstonesFilename, err)
+	}
+	raw := bytes.Buffer{}
+	if err := json.Compact(&raw, signed.Tombstones); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", tombstonesFilename, err)
+	}
+	if signed.Signer != keyFingerprint(publicKey) ||
+		!ed25519.Verify(publicKey, append([]byte(tombstoneSignaturePref), raw.Bytes()...), signed.Signature) {
+		return nil, errors.New(tombstonesFilename + " signature is invalid")
+	}
+
+	tombstones := &chainTombstones{}
+	if err := json.Unmarshal(raw.Bytes(), tombstones); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", tombstonesFilename, err)
+	}
+	return tombstones, nil
+}
+
+// saveTombstones signs and atomically replaces the tombstone list.
+func saveTombstones(keyDir string, tombstones *chainTombstones, signingKey ed25519.PrivateKey) error {
+	raw, err := json.Marshal(tombstones)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(signedTombstones{
+		Tombstones: raw,
+		Signer:     keyFingerprint(signingKey.Public().(ed25519.PublicKey)),
+		Signature:  ed25519.Sign(signingKey, append([]byte(tombstoneSignaturePref), raw...)),
+	})
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(keyDir, tombstonesFilename)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// recordTombstones adds removed sequence numbers to the tombstone list.
+func recordTombstones(keyDir string, sequences []uint64) error {
+	signingKey, _, err := loadSigningKey(keyDir)
+	if err != nil {
+		return err
+	}
+	tombstones, err := loadTombstones(keyDir, signingKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		return err
+	}
+	for _, sequence := range sequences {
+		tombstones.Removed = append(tombstones.Removed, [2]uint64{sequence, sequence})
+	}
+	sort.Slice(tombstones.Removed, func(i, j int) bool {
+		return tombstones.Removed[i][0] < tombstones.Removed[j][0]
+	})
+	merged := tombstones.Removed[:0]
+	for _, r := range tombstones.Removed {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1]+1 {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	tombstones.Removed = merged
+	return saveTombstones(keyDir, tombstones, signingKey)
+}
+
+// covers reports whether retention cleanup removed every manifest from
+// first to last.
+func (t *chainTombstones) covers(first, last uint64) bool {
+	if t == nil {
+		return false
+	}
+	for _, r := range t.Removed {
+		if r[0] <= first && last <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// count returns how many sequence numbers from first to last are covered.
+func (t *chainTombstones) count(first, last uint64) uint64 {
+	if t == nil {
+		return 0
+	}
+	var n uint64
+	for _, r := range t.Removed {
+		if from, to := max(r[0], first), min(r[1], last); from <= to {
+			n += to - from + 1
+		}
+	}
+	return n
+}
+
+func runVerifyChain() {
+	fmt.Println("🔗 Snapshot Manifest Chain Verification")
+	fmt.Println("=======================================")
+
+	publicKey, err := loadSigningPublicKey(keyDir)
+	if err != nil {
+		fmt.Printf("%s❌ Cannot load signing public key: %v%s\n", ColorRed, err, ColorReset)
+		os.Exit(1)
+	}
+	head, err := loadChainHead(keyDir)
+	if err != nil {
+		fmt.Printf("%s❌ Cannot load chain head: %v%s\n", ColorRed, err, ColorReset)
+		os.Exit(1)
+	}
+	if head.Sequence > 0 {
+		fmt.Printf("📌 Chain head: #%d %s (%s)\n", head.Sequence, head.File, head.CreatedAt.Format(time.RFC3339))
+	}
+
+	problems := 0
+	tombstones, err := loadTombstones(keyDir, publicKey)
+	if err != nil {
+		reportChainProblem("cannot load retention tombstones: %v", err)
+		problems++
+	}
+
+	fmt.Println()
+	fmt.Printf("📁 Local snapshots in %s\n", diskImageDir)
+	entries, localProblems := collectLocalManifests(diskImageDir, publicKey)
+	problems += localProblems + verifyChain(entries, head, getRetentionDays() > 0, tombstones)
+
+	cfg := getCloudConfig()
+	if cfg.Enabled {
+		fmt.Println()
+		fmt.Printf("☁️ S3 snapshots in s3://%s/%s\n", cfg.BucketName, cfg.BucketPrefix)
+		entries, s3Problems, err := collectS3Manifests(cfg, publicKey)
+		if err != nil {
+			fmt.Printf("%s❌ Cannot list S3 snapshots: %v%s\n", ColorRed, err, ColorReset)
+			problems++
+		} else {
+			// Retention only prunes local copies, the bucket keeps the whole chain
+			problems += s3Problems + verifyChain(entries, head, false, nil)
+		}
+	}
+
+	fmt.Println()
+	if problems > 0 {
+		fmt.Printf("%s❌ %d problems found: snapshots may have been deleted or tampered with%s\n", ColorRed, problems, ColorReset)
+		os.Exit(1)
+	}
+	fmt.Printf("%s✅ Manifest chain is intact%s\n", ColorGreen, ColorReset)
+}
+
+// collectLocalManifests verifies every manifest under root together with its
+// snapshot and returns the valid ones.
+func collectLocalManifests(root string, publicKey []byte) ([]chainEntry, int) {
+	var entries []chainEntry
+	problems := 0
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() || !strings.HasSuffix(info.Name(), manifestSuffix) {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			reportChainProblem("%s: %v", path, err)
+			problems++
+			return nil
+		}
+		manifest, err := openManifest(data, publicKey)
+		if err != nil {
+			reportChainProblem("%s: %v", path, err)
+			problems++
+			return nil
+		}
+
+		snapshotPath := filepath.Join(filepath.Dir(path), manifest.File)
+		if _, err := verifySnapshotManifest(snapshotPath, publicKey); os.IsNotExist(err) {
+			reportChainProblem("%s: snapshot %s is missing", path, manifest.File)
+			problems++
+		} else if err != nil {
+			reportChainProblem("%s: %v", snapshotPath, err)
+			problems++
+		}
+		if manifest.FilesSHA256 != "" {
+			if err := verifyFileManifest(snapshotPath, manifest); err != nil {
+				reportChainProblem("%s: %v", fileManifestPathFor(snapshotPath), err)
+				problems++
+			}
+		}
+
+		entries = append(entries, chainEntry{location: path, hash: manifestHash(data), manifest: manifest})
+		return nil
+	})
+
+	return entries, problems
+}
+
+// collectS3Manifests reads every manifest under the bucket prefix and checks
+// that the snapshot it describes is in the bucket too. Snapshot contents are
+// not downloaded.
+func collectS3Manifests(cfg CloudConfig, publicKey []byte) ([]chainEntry, int, error) {
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(cfg.BucketName)}
+	if cfg.BucketPrefix != "" {
+		input.Prefix = aws.String(cfg.BucketPrefix + "/")
+	}
+
+	objects := make(map[string]bool)
+	var manifestKeys []string
+	paginator := s3.NewListObjectsV2Paginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			objects[key] = true
+			if strings.HasSuffix(key, manifestSuffix) {
+				manifestKeys = append(manifestKeys, key)
+			}
+		}
+	}
+
+	var entries []chainEntry
+	problems := 0
+	for _, key := range manifestKeys {
+		output, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket: aws.String(cfg.BucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			reportChainProblem("%s: %v", key, err)
+			problems++
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(output.Body, maxManifestSize))
+		output.Body.Close()
+		if err != nil {
+			reportChainProblem("%s: %v", key, err)
+			problems++
+			continue
+		}
+
+		manifest, err := openManifest(data, publicKey)
+		if err != nil {
+			reportChainProblem("%s: %v", key, err)
+			problems++
+			continue
+		}
+		if !objects[path.Join(path.Dir(key), manifest.File)] {
+			reportChainProblem("%s: snapshot %s is missing", key, manifest.File)
+			problems++
+		}
+
+		entries = append(entries, chainEntry{location: key, hash: manifestHash(data), manifest: manifest})
+	}
+
+	return entries, problems, nil
+}
+
+// verifyChain checks the links between manifests and against the chain
+// head, and returns the number of problems found. Gaps covered by
+// tombstones were left by retention cleanup; with pruned set, so are gaps
+// before the oldest manifest, which cleanups older than the tombstones
+// left.
+func verifyChain(entries []chainEntry, head *chainHead, pruned bool, tombstones *chainTombstones) int {
+	var chained []chainEntry
+	unchained := 0
+	for _, entry := range entries {
+		if entry.manifest.Sequence == 0 {
+			unchained++
+		} else {
+			chained = append(chained, entry)
+		}
+	}
+	sort.Slice(chained, func(i, j int) bool {
+		return chained[i].manifest.Sequence < chained[j].manifest.Sequence
+	})
+
+	if unchained > 0 {
+		fmt.Printf("   ℹ️ %d snapshots predate the manifest chain\n", unchained)
+	}
+	if len(chained) == 0 {
+		if head.Sequence > 0 {
+			reportChainProblem("no chained manifest found, but the chain head is at #%d", head.Sequence)
+			return 1
+		}
+		fmt.Println("   ℹ️ No chained manifests yet")
+		return 0
+	}
+
+	problems := 0
+	first := chained[0].manifest
+	if first.Sequence > 1 {
+		if pruned || tombstones.covers(1, first.Sequence-1) {
+			fmt.Printf("   ℹ️ Snapshots %s removed by retention cleanup\n", sequenceRange(1, first.Sequence-1))
+		} else {
+			reportChainProblem("snapshots %s are missing before %s", sequenceRange(1, first.Sequence-1), chained[0].location)
+			problems++
+		}
+	}
+
+	for i := 1; i < len(chained); i++ {
+		previous, current := chained[i-1], chained[i]
+		switch {
+		case current.manifest.Sequence == previous.manifest.Sequence:
+			reportChainProblem("%s and %s both claim #%d", previous.location, current.location, current.manifest.Sequence)
+			problems++
+			continue
+		case current.manifest.Sequence > previous.manifest.Sequence+1 &&
+			tombstones.covers(previous.manifest.Sequence+1, current.manifest.Sequence-1):
+			// The link goes to a removed manifest
+		case current.manifest.Sequence > previous.manifest.Sequence+1:
+			reportChainProblem("snapshots %s are missing between %s and %s",
+				sequenceRange(previous.manifest.Sequence+1, current.manifest.Sequence-1), previous.manifest.File, current.manifest.File)
+			problems++
+		case current.manifest.Previous != previous.hash:
+			reportChainProblem("%s does not link to %s: the previous snapshot was replaced", current.location, previous.location)
+			problems++
+		}
+		if current.manifest.CreatedAt.Before(previous.manifest.CreatedAt) {
+			reportChainProblem("%s (#%d) was created before %s (#%d): snapshots were reordered",
+				current.manifest.File, current.manifest.Sequence, previous.manifest.File, previous.manifest.Sequence)
+			problems++
+		}
+	}
+
+	last := chained[len(chained)-1]
+	switch {
+	case last.manifest.Sequence < head.Sequence:
+		reportChainProblem("the newest %d snapshots are missing: chain ends at #%d, head is #%d (%s)",
+			head.Sequence-last.manifest.Sequence, last.manifest.Sequence, head.Sequence, head.File)
+		problems++
+	case last.manifest.Sequence == head.Sequence && last.hash != head.Hash:
+		reportChainProblem("%s is not the manifest recorded as chain head", last.location)
+		problems++
+	case last.manifest.Sequence > head.Sequence:
+		reportChainProblem("%s (#%d) is beyond the chain head #%d", last.location, last.manifest.Sequence, head.Sequence)
+		problems++
+	}
+
+	if removed := tombstones.count(first.Sequence+1, last.manifest.Sequence-1); removed > 0 {
+		fmt.Printf("   ℹ️ %d snapshots between #%d and #%d removed by retention cleanup\n", removed, first.Sequence, last.manifest.Sequence)
+	}
+	if problems == 0 {
+		fmt.Printf("   %s✅ %d chained snapshots, #%d to #%d%s\n", ColorGreen, len(chained), first.Sequence, last.manifest.Sequence, ColorReset)
+	}
+	return problems
+}
+
+func sequenceRange(from, to uint64) string {
+	if from == to {
+		return fmt.Sprintf("#%d", from)
+	}
+	return fmt.Sprintf("#%d-#%d", from, to)
+}
+
+func reportChainProblem(format string, args ...interface{}) {
+	fmt.Printf("   %s❌ %s%s\n", ColorRed, fmt.Sprintf(format, args...), ColorReset)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testChain returns a chain of n linked manifests and its head.
+func testChain(n int) ([]chainEntry, *chainHead) {
+	created := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	var entries []chainEntry
+	previous := ""
+	for i := 1; i <= n; i++ {
+		manifest := &snapshotManifest{
+			File:      fmt.Sprintf("snapshot-%d.encrypted", i),
+			CreatedAt: created.Add(time.Duration(i) * time.Hour),
+			Sequence:  uint64(i),
+			Previous:  previous,
+		}
+		entry := chainEntry{
+			location: manifest.File,
+			hash:     manifestHash([]byte(manifest.File)),
+			manifest: manifest,
+		}
+		entries = append(entries, entry)
+		previous = entry.hash
+	}
+	last := entries[n-1]
+	return entries, &chainHead{Sequence: last.manifest.Sequence, File: last.manifest.File, Hash: last.hash}
+}
+
+// withoutSequences drops the manifests with the given sequence numbers.
+func withoutSequences(entries []chainEntry, sequences ...uint64) []chainEntry {
+	removed := make(map[uint64]bool)
+	for _, sequence := range sequences {
+		removed[sequence] = true
+	}
+	var kept []chainEntry
+	for _, entry := range entries {
+		if !removed[entry.manifest.Sequence] {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// testTombstones records sequences as removed by retention cleanup in a
+// fresh KEY_DIR and loads them back.
+func testTombstones(t *testing.T, sequences ...uint64) *chainTombstones {
+	t.Helper()
+	dir := t.TempDir()
+	if err := recordTombstones(dir, sequences); err != nil {
+		t.Fatal(err)
+	}
+	signingKey, _, err := loadSigningKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstones, err := loadTombstones(dir, signingKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tombstones
+}
+
+func TestVerifyChain(t *testing.T) {
+	entries, head := testChain(6)
+
+	replaced := append([]chainEntry(nil), entries...)
+	manifest := *replaced[3].manifest
+	manifest.Previous = manifestHash([]byte("planted"))
+	replaced[3].manifest = &manifest
+
+	reordered := append([]chainEntry(nil), entries...)
+	manifest = *reordered[4].manifest
+	manifest.CreatedAt = entries[1].manifest.CreatedAt
+	reordered[4].manifest = &manifest
+
+	cases := []struct {
+		name       string
+		entries    []chainEntry
+		tombstones *chainTombstones
+		problems   bool
+	}{
+		{"intact", entries, &chainTombstones{}, false},
+		{"gap", withoutSequences(entries, 3, 4), &chainTombstones{}, true},
+		{"gap with tombstones", withoutSequences(entries, 3, 4), testTombstones(t, 3, 4), false},
+		{"gap wider than tombstones", withoutSequences(entries, 3, 4), testTombstones(t, 3), true},
+		{"gaps between tombstoned ancestors", withoutSequences(entries, 2, 4), testTombstones(t, 2, 4), false},
+		{"oldest removed", withoutSequences(entries, 1, 2), &chainTombstones{}, true},
+		{"oldest tombstoned", withoutSequences(entries, 1, 2), testTombstones(t, 1, 2), false},
+		{"newest removed", withoutSequences(entries, 6), testTombstones(t, 6), true},
+		{"replaced", replaced, &chainTombstones{}, true},
+		{"reordered", reordered, &chainTombstones{}, true},
+		{"duplicate", append(append([]chainEntry(nil), entries...), entries[2]), &chainTombstones{}, true},
+	}
+	for _, c := range cases {
+		if problems := verifyChain(c.entries, head, false, c.tombstones); (problems > 0) != c.problems {
+			t.Errorf("%s: %d problems", c.name, problems)
+		}
+	}
+}
+
+func TestRecordTombstonesMerges(t *testing.T) {
+	dir := t.TempDir()
+	for _, sequences := range [][]uint64{{3}, {7, 5}, {4}, {9}} {
+		if err := recordTombstones(dir, sequences); err != nil {
+			t.Fatal(err)
+		}
+	}
+	signingKey, _, err := loadSigningKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tombstones, err := loadTombstones(dir, signingKey.Public().(ed25519.PublicKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][2]uint64{{3, 5}, {7, 7}, {9, 9}}
+	if fmt.Sprint(tombstones.Removed) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", tombstones.Removed, want)
+	}
+	if !tombstones.covers(3, 5) || tombstones.covers(5, 7) || tombstones.count(1, 10) != 5 {
+		t.Fatal("tombstone ranges do not cover what was recorded")
+	}
+}
+
+func TestTombstonesTampered(t *testing.T) {
+	dir := t.TempDir()
+	if err := recordTombstones(dir, []uint64{3}); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, tombstonesFilename)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(data, []byte("[[3,3]]"), []byte("[[2,3]]"), 1)
+	if bytes.Equal(tampered, data) {
+		t.Fatalf("unexpected tombstone file %s", data)
+	}
+	if err := os.WriteFile(path, tampered, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	signingKey, _, err := loadSigningKey(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadTombstones(dir, signingKey.Public().(ed25519.PublicKey)); err == nil {
+		t.Fatal("tampered tombstones were accepted")
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+// Raw ext4 disk images (IMAGE_FORMAT=raw-ext4).
+//
+// The filesystem archive is extracted into a staging directory under
+// TEMP_MOUNT_POINT, then 'mkfs.ext4 -d' builds a sparse raw image from it
+// without mounting anything. The image is compressed and encrypted like an
+// archive; 'make decrypt' writes it back as a sparse .img that can be dd'd
+// to a disk or attached to a VM. Raw images are always full snapshots and
+// are never stored in the deduplicated repository.
+//
+// Unless RAW_IMAGE_SIZE_MB is set, the image is sized from the staged tree:
+// its data plus a quarter for free space and ext4 metadata, 256 MiB for the
+// journal, and room for the inode tables.
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	imageFormatTar      = "tar"
+	imageFormatRawExt4  = "raw-ext4"
+	imageFormatISO      = "iso"
+	imageFormatSquashfs = "squashfs"
+
+	ext4BlockSize     = 4096
+	ext4InodeSize     = 256
+	ext4JournalMargin = 256 * 1024 * 1024
+	rawImageLabel     = "mobula-snapshot"
+)
+
+// isImageFormat reports whether format is a supported IMAGE_FORMAT.
+func isImageFormat(format string) bool {
+	switch format {
+	case imageFormatTar, imageFormatRawExt4, imageFormatISO, imageFormatSquashfs:
+		return true
+	}
+	return false
+}
+
+// stagedTree counts what the staging directory holds, to size the image.
+type stagedTree struct {
+	entries  int64
+	bytes    int64 // Allocated in ext4 blocks
+	warnings int
+}
+
+// createRawExt4Image builds an ext4 image of the root filesystem and
+// compresses and encrypts it to encryptedPath.
+func createRawExt4Image(encryptedPath, keyID string, key []byte, now time.Time, listing *fileManifest) error {
+	staging, staged, err := stageFilesystem(now, listing)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	imagePath := filepath.Join(tempMountPoint, "disk_image.img")
+	defer os.Remove(imagePath)
+	if err := makeExt4Image(imagePath, staging, staged); err != nil {
+		return err
+	}
+	// The image holds everything now; free the staging space before
+	// compressing
+	os.RemoveAll(staging)
+
+	return encryptImageFile(imagePath, encryptedPath, keyID, key, true)
+}
+
+// stageFilesystem extracts the filesystem archive into a new staging
+// directory under TEMP_MOUNT_POINT, which the caller removes.
+func stageFilesystem(now time.Time, listing *fileManifest) (string, *stagedTree, error) {
+	if err := os.MkdirAll(tempMountPoint, 0700); err != nil {
+		return "", nil, err
+	}
+	staging, err := os.MkdirTemp(tempMountPoint, "rootfs-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	logInfo("Staging filesystem in %s...", staging)
+	pr, pw := io.Pipe()
+	archived := make(chan struct{})
+	go func() {
+		defer close(archived)
+		pw.CloseWithError(writeSnapshotArchive(pw, now, nil, listing))
+	}()
+	staged, err := stageArchive(tar.NewReader(pr), staging)
+	if err == nil {
+		// tar.Reader stops at the end-of-archive blocks; the archiver's
+		// error only arrives with the end of the stream
+		_, err = io.Copy(io.Discard, pr)
+	}
+	// Stops the archiver if staging failed first, and waits for it: its
+	// cleanups (captures, paused containers) are over before the image is
+	// built
+	pr.CloseWithError(io.ErrClosedPipe)
+	<-archived
+	if err != nil {
+		os.RemoveAll(staging)
+		return "", nil, fmt.Errorf("failed to stage filesystem: %v", err)
+	}
+	if listing != nil {
+		// The archive starts with the file manifest, before any content
+		// hash is known; the image holds the complete one
+		content, err := json.Marshal(listing)
+		path := filepath.Join(staging, snapshotInfoDir, fileManifestName)
+		if err == nil {
+			err = os.WriteFile(path, content, 0644)
+		}
+		if err == nil {
+			err = os.Chtimes(path, now, now)
+		}
+		if err != nil {
+			os.RemoveAll(staging)
+			return "", nil, fmt.Errorf("failed to stage file manifest: %v", err)
+		}
+		staged.bytes += int64(len(content))
+	}
+	if staged.warnings > 0 {
+		logError("%d owners, times or extended attributes could not be staged", staged.warnings)
+	}
+	return staging, staged, nil
+}
+
+// encryptImageFile encrypts an image file to encryptedPath, compressing it
+// with COMPRESSION first unless the image is compressed already.
+func encryptImageFile(imagePath, encryptedPath, keyID string, key []byte, compress bool) error {
+	image, err := os.Open(imagePath)
+	if err != nil {
+		return err
+	}
+	defer image.Close()
+
+	if !compress {
+		return encryptDiskImage(image, encryptedPath, keyID, key, compressionNone)
+	}
+
+	logInfo("Compressing image (%s compression, %d threads)...", compressionCodec, compressionThreadCount())
+	pr, pw := io.Pipe()
+	compressor, err := newCompressor(pw)
+	if err != nil {
+		return fmt.Errorf("failed to start %s compression: %v", compressionCodec, err)
+	}
+	go func() {
+		_, err := io.Copy(compressor, image)
+		if closeErr := compressor.Close(); err == nil {
+			err = closeErr
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err = encryptDiskImage(pr, encryptedPath, keyID, key, compressionCodec)
+	pr.CloseWithError(io.ErrClosedPipe)
+	return err
+}
+
+// makeExt4Image creates a sparse image file and formats it with the staged
+// tree as its content.
+func makeExt4Image(imagePath, staging string, staged *stagedTree) error {
+	size := int64(rawImageSizeMB) * 1024 * 1024
+	if size == 0 {
+		size = staged.bytes + staged.bytes/4 + ext4JournalMargin + staged.entries*ext4InodeSize
+		size = (size + 1024*1024 - 1) / (1024 * 1024) * 1024 * 1024
+	}
+	inodes := staged.entries + staged.entries/4 + 16384
+
+	image, err := os.OpenFile(imagePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = image.Truncate(size)
+	if closeErr := image.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create raw image: %v", err)
+	}
+
+	logInfo("Formatting %.2f MB ext4 image with %d inodes...", float64(size)/1024/1024, inodes)
+	cmd := exec.Command(mkfsExt4Path, "-q", "-F",
+		"-b", strconv.Itoa(ext4BlockSize),
+		"-I", strconv.Itoa(ext4InodeSize),
+		"-N", strconv.FormatInt(inodes, 10),
+		"-L", rawImageLabel,
+		"-d", staging,
+		imagePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		msg := strings.TrimSpace(string(output))
+		if rawImageSizeMB > 0 {
+			msg += " (is RAW_IMAGE_SIZE_MB large enough?)"
+		}
+		return fmt.Errorf("%s failed: %v: %s", mkfsExt4Path, err, msg)
+	}
+	return nil
+}
+
+// stageArchive extracts the filesystem archive into staging, which must be
+// empty. Directory times are set last, as extracting into a directory
+// changes its mtime.
+func stageArchive(tr *tar.Reader, staging string) (*stagedTree, error) {
+	// mkfs.ext4 -d gives the image root the staging directory's mode
+	if err := os.Chmod(staging, 0755); err != nil {
+		return nil, err
+	}
+
+	staged := &stagedTree{}
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		path, err := stagingPath(staging, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+		if err := stageEntry(hdr, tr, path, staging, staged); err != nil {
+			return nil, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: path, mtime: hdr.ModTime})
+		}
+		staged.entries++
+	}
+
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil {
+			staged.warnings++
+		}
+	}
+	return staged, nil
+}
+
+// stagingPath maps an archive name to a path under staging.
+func stagingPath(staging, name string) (string, error) {
+	clean := filepath.Clean("/" + filepath.FromSlash(name))
+	if clean == "/" {
+		return "", errors.New("archive entry for the root directory")
+	}
+	return filepath.Join(staging, clean), nil
+}
+
+// stageEntry creates one archive entry, with its owner, mode, extended
+// attributes and times, and counts the blocks it takes.
+func stageEntry(hdr *tar.Header, src io.Reader, path, staging string, staged *stagedTree) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return err
+		}
+		staged.bytes += ext4BlockSize
+	case tar.TypeReg:
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		written, err := copySparse(file, src)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		staged.bytes += (written + ext4BlockSize - 1) / ext4BlockSize * ext4BlockSize
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			staged.warnings++
+		}
+		return nil
+	case tar.TypeLink:
+		target, err := stagingPath(staging, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(target, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := makeDevice(path, hdr); err != nil {
+			return err
+		}
+	default:
+		logError("Skipping %s: unsupported entry type %q", hdr.Name, hdr.Typeflag)
+		return nil
+	}
+
+	// Owner first: chown clears the setuid and setgid bits
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		staged.warnings++
+	}
+	if err := os.Chmod(path, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	for record, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(record, "SCHILY.xattr."); ok {
+			if err := setXattr(path, name, value); err != nil {
+				staged.warnings++
+			}
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			staged.warnings++
+		}
+	}
+	return nil
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"archive/tar"
+	"syscall"
+)
+
+// makeDevice creates the device node or FIFO described by hdr.
+func makeDevice(path string, hdr *tar.Header) error {
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeChar:
+		mode |= syscall.S_IFCHR
+	case tar.TypeBlock:
+		mode |= syscall.S_IFBLK
+	case tar.TypeFifo:
+		mode |= syscall.S_IFIFO
+	}
+	return syscall.Mknod(path, mode, int(mkdev(uint64(hdr.Devmajor), uint64(hdr.Devminor))))
+}
+
+// mkdev encodes a device number the way glibc's makedev does.
+func mkdev(major, minor uint64) uint64 {
+	return (major&0xfffff000)<<32 | (major&0x00000fff)<<8 |
+		(minor&0xffffff00)<<12 | (minor & 0x000000ff)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+)
+
+// makeDevice creates the device node or FIFO described by hdr; images are
+// only staged on Linux.
+func makeDevice(path string, hdr *tar.Header) error {
+	return errors.New("device nodes can only be staged on Linux")
+}
@@ -0,0 +1,194 @@
+package main
+
+// X25519 recipients.
+//
+// Besides (or instead of) the master key, a snapshot's data key can be
+// wrapped for X25519 public keys, age-style: each slot stores a fresh
+// ephemeral public key, and the data key is sealed with AES-256-GCM under
+//
+//	HKDF-SHA256(ECDH(ephemeral, recipient), salt = ephemeral || recipient, info)
+//
+// using the header as additional data. Only the holder of the recipient's
+// private key (or of enough Shamir shares to rebuild it) can unwrap it, so
+// the host taking snapshots never needs to be able to decrypt them.
+//
+// Recipients are configured as a comma separated list of name:publickey,
+// with the public key in hex.
+//
+// A Shamir group is a recipient whose private key was split among the
+// group's members. Its slots have type shamir_group and carry the group's
+// quorum, so any decrypt tool knows how many shares to ask for; independent
+// groups (e.g. 2-of-3 ops OR 3-of-5 security) each get their own slot.
+//
+// This file is shared by cmd/script, cmd/test, cmd/generate and
+// test_encryption; keep the copies identical.
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	keySlotX25519      = "x25519"       // Data key wrapped for an X25519 recipient
+	keySlotShamirGroup = "shamir_group" // Same, for a recipient split among a group
+	x25519WrapInfo     = "mobula snapshot x25519 key wrap"
+)
+
+// recipient is a named X25519 public key snapshots are encrypted to.
+// RequiredShares and TotalShares are only set for Shamir groups.
+type recipient struct {
+	Name           string
+	PublicKey      []byte
+	RequiredShares int
+	TotalShares    int
+}
+
+// parseRecipients reads a RECIPIENTS value: name:publickey[,name:publickey].
+// A recipient without a name is named after its fingerprint.
+func parseRecipients(value string) ([]recipient, error) {
+	var recipients []recipient
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, keyHex, found := strings.Cut(entry, ":")
+		if !found {
+			name, keyHex = "", entry
+		}
+
+		publicKey, err := hex.DecodeString(strings.TrimSpace(keyHex))
+		if err != nil {
+			return nil, fmt.Errorf("recipient %q: invalid hex public key: %v", entry, err)
+		}
+		if _, err := ecdh.X25519().NewPublicKey(publicKey); err != nil {
+			return nil, fmt.Errorf("recipient %q: %v", entry, err)
+		}
+
+		name = strings.TrimSpace(name)
+		if name == "" {
+			name = keyFingerprint(publicKey)
+		}
+		recipients = append(recipients, recipient{Name: name, PublicKey: publicKey})
+	}
+	return recipients, nil
+}
+
+// x25519PublicKey derives the public key of a 32-byte X25519 private key.
+func x25519PublicKey(privateKey []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return key.PublicKey().Bytes(), nil
+}
+
+func x25519WrapKey(shared, ephemeral, publicKey []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeral...), publicKey...)
+	return hkdf.Key(sha256.New, shared, salt, x25519WrapInfo, dataKeyLength)
+}
+
+// wrapDataKeyX25519 seals the data key for one recipient, bound to the header.
+func wrapDataKeyX25519(dataKey []byte, r recipient, aad []byte) (keySlot, error) {
+	publicKey, err := ecdh.X25519().NewPublicKey(r.PublicKey)
+	if err != nil {
+		return keySlot{}, err
+	}
+
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return keySlot{}, err
+	}
+	shared, err := ephemeral.ECDH(publicKey)
+	if err != nil {
+		return keySlot{}, err
+	}
+	defer wipe(shared)
+
+	wrapKey, err := x25519WrapKey(shared, ephemeral.PublicKey().Bytes(), r.PublicKey)
+	if err != nil {
+		return keySlot{}, err
+	}
+	defer wipe(wrapKey)
+
+	aead, err := newStreamAEAD(wrapKey)
+	if err != nil {
+		return keySlot{}, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return keySlot{}, err
+	}
+
+	slot := keySlot{
+		Type:           keySlotX25519,
+		KeyID:          r.Name,
+		KeyFingerprint: keyFingerprint(r.PublicKey),
+		EphemeralKey:   ephemeral.PublicKey().Bytes(),
+		WrappedKey:     aead.Seal(nonce, nonce, dataKey, aad),
+	}
+	if r.RequiredShares > 0 {
+		slot.Type = keySlotShamirGroup
+		slot.RequiredShares = r.RequiredShares
+		slot.TotalShares = r.TotalShares
+	}
+	return slot, nil
+}
+
+// isRecipientSlot reports whether a slot is wrapped for an X25519 key.
+func isRecipientSlot(slot keySlot) bool {
+	return slot.Type == keySlotX25519 || slot.Type == keySlotShamirGroup
+}
+
+// unwrapDataKeyX25519 opens a recipient slot with its private key.
+func unwrapDataKeyX25519(slot keySlot, privateKey, aad []byte) ([]byte, error) {
+	key, err := ecdh.X25519().NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := ecdh.X25519().NewPublicKey(slot.EphemeralKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ephemeral key: %v", err)
+	}
+	shared, err := key.ECDH(ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(shared)
+
+	wrapKey, err := x25519WrapKey(shared, slot.EphemeralKey, key.PublicKey().Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(wrapKey)
+
+	return openWrappedKey(slot, wrapKey, aad)
+}
+
+// openWrappedKey opens a slot's nonce || AES-GCM(data key) with wrapKey.
+func openWrappedKey(slot keySlot, wrapKey, aad []byte) ([]byte, error) {
+	aead, err := newStreamAEAD(wrapKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(slot.WrappedKey) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key too short")
+	}
+
+	nonce := slot.WrappedKey[:aead.NonceSize()]
+	dataKey, err := aead.Open(nil, nonce, slot.WrappedKey[aead.NonceSize():], aad)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %v", err)
+	}
+	if len(dataKey) != dataKeyLength {
+		return nil, fmt.Errorf("invalid data key length %d", len(dataKey))
+	}
+	return dataKey, nil
+}
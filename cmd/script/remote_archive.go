@@ -0,0 +1,423 @@
+package main
+
+// Remote archives.
+//
+// The remote tar streams a PAX archive with extended attributes, POSIX ACLs
+// (as SCHILY.acl.* records, restored by GNU tar --acls) and sparse files;
+// the EXCLUDE_* patterns and the @marker rules of EXCLUDE_FILE are passed
+// to it, so excluded trees never cross the network. Its entries are then
+// filtered again with the other EXCLUDE_FILE rules, hashed for the file
+// manifest, re-encoded after our file manifest and info file, and named as
+// for the default source: relative to /. Holes of sparse files arrive as
+// zeros, which compress to next to nothing.
+//
+// For the archive to start with the file manifest, the same tar first
+// runs with /dev/null as its archive, which GNU tar creates without reading
+// any file data, and its verbose listing gives the entries to come.
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GNU tar exits with status 1 when files changed while being read
+const tarStatusChanged = 1
+
+// writeRemoteArchive streams a tar of the host's paths to w, starting with
+// the file manifest and the snapshot info file.
+func writeRemoteArchive(w io.Writer, host *remoteHost, now time.Time, listing *fileManifest) error {
+	rules, markers := splitMarkerRules(excludeRules)
+	a := &filesystemArchiver{
+		out:        w,
+		tw:         tar.NewWriter(w),
+		source:     &snapshotSource{Name: host.Name, Path: "/"},
+		remote:     host,
+		excludes:   excludePatterns,
+		rules:      rules,
+		excludedBy: make(map[string]int),
+		listing:    listing,
+	}
+
+	logInfo("🛰️ Listing %s on %s", strings.Join(host.Paths, " "), host.target())
+	entries, err := a.listRemoteEntries(markers)
+	if err != nil {
+		return err
+	}
+	if err := a.writeFileManifest(entries, now); err != nil {
+		return fmt.Errorf("failed to add file manifest: %v", err)
+	}
+	if err := a.writeInfoFile(host.sources(), nil, nil, now); err != nil {
+		return fmt.Errorf("failed to add snapshot info: %v", err)
+	}
+
+	logInfo("🛰️ Pulling %s from %s", strings.Join(host.Paths, " "), host.target())
+	output := &hookOutput{}
+	changed, err := runRemoteTar(host, remoteArchiveCommand(host.Paths, markers, false), output, func(r io.Reader) error {
+		return a.copyRemoteEntries(tar.NewReader(r))
+	})
+	output.flush()
+	if err != nil {
+		return err
+	}
+	if changed {
+		logError("Some files on %s changed while being archived", host.Name)
+	}
+	if err := a.tw.Close(); err != nil {
+		return err
+	}
+
+	logInfo("Archived %d entries from %s (%.2f MB of file data)", a.files, host.Name, float64(a.bytes)/1024/1024)
+	if total, summary := exclusionSummary(a.excludedBy); total > 0 {
+		logInfo("🚫 Excluded %d entries (a directory counts once): %s", total, summary)
+	}
+	if a.skipped > 0 {
+		logError("%d entries could not be archived and were skipped", a.skipped)
+	}
+	return nil
+}
+
+// listRemoteEntries returns the entries the remote tar is about to stream,
+// filtered as copyRemoteEntries filters them. Its warnings are only logged
+// if the listing fails: the archive pass repeats them.
+func (a *filesystemArchiver) listRemoteEntries(markers []string) ([]fileManifestEntry, error) {
+	// The archive pass counts the exclusions
+	scan := *a
+	scan.excludedBy = make(map[string]int)
+	filter := newRemoteFilter(&scan)
+
+	var entries []fileManifestEntry
+	var stderr bytes.Buffer
+	_, err := runRemoteTar(a.remote, remoteArchiveCommand(a.remote.Paths, markers, true), &stderr, func(r io.Reader) error {
+		lines := bufio.NewScanner(r)
+		lines.Buffer(make([]byte, 64*1024), 1024*1024)
+		for lines.Scan() {
+			hdr, err := parseRemoteListing(lines.Text())
+			if err != nil {
+				return fmt.Errorf("failed to read the listing from %s: %v", a.remote.Name, err)
+			}
+			if keep, _ := filter.keep(hdr); keep {
+				entries = append(entries, newFileManifestEntry(hdr, ""))
+			}
+		}
+		return lines.Err()
+	})
+	if err != nil {
+		output := &hookOutput{}
+		output.Write(stderr.Bytes())
+		output.flush()
+		return nil, err
+	}
+	return entries, nil
+}
+
+// copyRemoteEntries re-encodes the remote tar's entries into the archive.
+func (a *filesystemArchiver) copyRemoteEntries(tr *tar.Reader) error {
+	filter := newRemoteFilter(a)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read the archive from %s: %v", a.remote.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		path := "/" + remoteEntryName(hdr.Name)
+		keep, err := filter.keep(hdr)
+		if err != nil {
+			logError("Skipping %s: %v", path, err)
+			a.skipped++
+			continue
+		}
+		if !keep {
+			continue
+		}
+		hdr.Format = tar.FormatPAX
+		// tar.Reader already expanded sparse files, and tar.Writer refuses
+		// the records describing them
+		for key := range hdr.PAXRecords {
+			if strings.HasPrefix(key, "GNU.sparse.") {
+				delete(hdr.PAXRecords, key)
+			}
+		}
+
+		if err := a.tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to archive %s: %v", path, err)
+		}
+		a.files++
+		sum := ""
+		if hdr.Typeflag == tar.TypeReg {
+			h := sha256.New()
+			n, err := io.Copy(io.MultiWriter(a.tw, h), tr)
+			a.bytes += n
+			if err != nil {
+				return fmt.Errorf("failed to archive %s: %v", path, err)
+			}
+			sum = hex.EncodeToString(h.Sum(nil))
+		}
+		a.list(hdr, sum)
+	}
+}
+
+// remoteFilter applies the EXCLUDE_FILE rules the remote tar cannot apply
+// to the entries it lists or streams, in order.
+type remoteFilter struct {
+	a             *filesystemArchiver
+	excludedDir   string          // tar lists the content of a directory right after it
+	excludedFiles map[string]bool // Hard link targets left out
+}
+
+func newRemoteFilter(a *filesystemArchiver) *remoteFilter {
+	return &remoteFilter{a: a, excludedFiles: make(map[string]bool)}
+}
+
+// keep names an entry relative to / and reports whether it is archived. A
+// hard link to an entry left out cannot be, and is reported as an error.
+func (f *remoteFilter) keep(hdr *tar.Header) (bool, error) {
+	name := remoteEntryName(hdr.Name)
+	if name == "" {
+		return false, nil // The root itself
+	}
+	path := "/" + name
+	if f.excludedDir != "" && strings.HasPrefix(path, f.excludedDir+"/") {
+		return false, nil
+	}
+	info := hdr.FileInfo()
+	if f.a.excluded(path, info) {
+		if info.IsDir() {
+			f.excludedDir = path
+		} else {
+			f.excludedFiles[name] = true
+		}
+		return false, nil
+	}
+
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname = remoteEntryName(hdr.Linkname)
+		target := "/" + hdr.Linkname
+		if f.excludedFiles[hdr.Linkname] || f.excludedDir != "" && strings.HasPrefix(target, f.excludedDir+"/") {
+			return false, fmt.Errorf("hard link to excluded %s", target)
+		}
+	}
+	hdr.Name = name
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	return true, nil
+}
+
+// runRemoteTar runs a tar command on the host and hands its output to
+// read. It reports whether tar warned that files changed while it read
+// them.
+func runRemoteTar(host *remoteHost, command string, stderr io.Writer, read func(io.Reader) error) (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, sshPath, host.sshArgs(command)...)
+	cmd.Stderr = stderr
+	cmd.WaitDelay = hookOutputDelay
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("failed to run ssh: %v", err)
+	}
+
+	readErr := read(stdout)
+	if readErr == nil {
+		// tar pads its output past the end-of-archive blocks
+		_, readErr = io.Copy(io.Discard, stdout)
+	} else {
+		cancel()
+	}
+	waitErr := cmd.Wait()
+	if readErr != nil {
+		return false, readErr
+	}
+	var exitErr *exec.ExitError
+	switch {
+	case errors.As(waitErr, &exitErr) && exitErr.ExitCode() == tarStatusChanged:
+		return true, nil
+	case errors.As(waitErr, &exitErr) && exitErr.ExitCode() == 255:
+		return false, fmt.Errorf("ssh to %s failed", host.target())
+	case errors.As(waitErr, &exitErr):
+		return false, fmt.Errorf("tar on %s exited with status %d", host.Name, exitErr.ExitCode())
+	}
+	return false, waitErr
+}
+
+// parseRemoteListing reads one line of the remote tar's verbose listing,
+// as written with --numeric-owner --utc --full-time --quoting-style=c:
+//
+//	-rw-r--r--  0/0  1234 2026-10-16 06:54:54.123 "/etc/hosts"
+//	hrw-r--r--  0/0     0 2026-10-16 06:54:54.123 "/etc/b" link to "/etc/a"
+//	lrwxrwxrwx  0/0     0 2026-10-16 06:54:54.123 "/etc/c" -> "a"
+//	crw-rw-rw-  0/0   1,3 2026-10-16 06:54:54.123 "/dev/null"
+func parseRemoteListing(line string) (*tar.Header, error) {
+	quote := strings.IndexByte(line, '"')
+	fields := strings.Fields(line[:max(quote, 0)])
+	if quote < 0 || len(fields) != 5 || len(fields[0]) < 10 {
+		return nil, fmt.Errorf("unexpected line %q", line)
+	}
+
+	hdr := &tar.Header{Format: tar.FormatPAX}
+	switch fields[0][0] {
+	case '-':
+		hdr.Typeflag = tar.TypeReg
+	case 'd':
+		hdr.Typeflag = tar.TypeDir
+	case 'l':
+		hdr.Typeflag = tar.TypeSymlink
+	case 'h':
+		hdr.Typeflag = tar.TypeLink
+	case 'c':
+		hdr.Typeflag = tar.TypeChar
+	case 'b':
+		hdr.Typeflag = tar.TypeBlock
+	case 'p':
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		return nil, fmt.Errorf("unexpected entry type in %q", line)
+	}
+	hdr.Mode = parsePermissions(fields[0][1:10])
+
+	uid, gid, _ := strings.Cut(fields[1], "/")
+	var err error
+	if hdr.Uid, err = strconv.Atoi(uid); err != nil {
+		return nil, fmt.Errorf("unexpected owner in %q", line)
+	}
+	if hdr.Gid, err = strconv.Atoi(gid); err != nil {
+		return nil, fmt.Errorf("unexpected group in %q", line)
+	}
+
+	if major, minor, ok := strings.Cut(fields[2], ","); ok {
+		hdr.Devmajor, _ = strconv.ParseInt(major, 10, 64)
+		hdr.Devminor, _ = strconv.ParseInt(minor, 10, 64)
+	} else if hdr.Size, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return nil, fmt.Errorf("unexpected size in %q", line)
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		hdr.Size = 0
+	}
+
+	if hdr.ModTime, err = time.Parse("2006-01-02 15:04:05", fields[3]+" "+fields[4]); err != nil {
+		return nil, fmt.Errorf("unexpected time in %q", line)
+	}
+
+	rest := line[quote:]
+	quoted, err := strconv.QuotedPrefix(rest)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected name in %q", line)
+	}
+	hdr.Name, _ = strconv.Unquote(quoted)
+	if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+		// The words before the target are translated
+		rest = rest[len(quoted):]
+		quote = strings.IndexByte(rest, '"')
+		if quote < 0 {
+			return nil, fmt.Errorf("no link target in %q", line)
+		}
+		if quoted, err = strconv.QuotedPrefix(rest[quote:]); err != nil {
+			return nil, fmt.Errorf("unexpected link target in %q", line)
+		}
+		hdr.Linkname, _ = strconv.Unquote(quoted)
+	}
+	return hdr, nil
+}
+
+// parsePermissions turns the nine permission characters of a listing,
+// such as rwsr-xr-x, into mode bits.
+func parsePermissions(perm string) int64 {
+	var mode int64
+	for i, c := range perm {
+		bit := int64(0400) >> i
+		switch {
+		case c == 's' || c == 'S':
+			mode |= 04000 >> (i / 3) // setuid for the owner, setgid for the group
+		case c == 't' || c == 'T':
+			mode |= 01000
+		}
+		if c != '-' && c != 'S' && c != 'T' {
+			mode |= bit
+		}
+	}
+	return mode
+}
+
+// remoteEntryName turns the absolute name of a remote entry into its
+// archive name, relative to /.
+func remoteEntryName(name string) string {
+	return strings.Trim(name, "/")
+}
+
+// splitMarkerRules separates the @marker rules, which need to look inside
+// directories, from the rules that only need an entry's header.
+func splitMarkerRules(rules []excludeRule) ([]excludeRule, []string) {
+	var others []excludeRule
+	var markers []string
+	for _, rule := range rules {
+		if rule.marker != "" {
+			markers = append(markers, rule.marker)
+		} else {
+			others = append(others, rule)
+		}
+	}
+	return others, markers
+}
+
+// remoteArchiveCommand builds the shell command archiving paths on the
+// remote host or, with list, only listing what it would archive. Patterns
+// starting with / match the whole path, others any name.
+func remoteArchiveCommand(paths, markers []string, list bool) string {
+	args := []string{remoteTarCommand, "--create", "--absolute-names", "--one-file-system"}
+	if list {
+		// In the format parseRemoteListing reads
+		args = append([]string{"env", "LC_ALL=C"}, args...)
+		args = append(args, "--file=/dev/null", "--verbose", "--verbose",
+			"--numeric-owner", "--utc", "--full-time", "--quoting-style=c")
+	} else {
+		args = append(args, "--file=-", "--format=posix", "--sparse",
+			"--xattrs", shellQuote("--xattrs-include=*"), "--acls")
+	}
+	var anchored, names []string
+	for _, pattern := range excludePatterns {
+		if strings.HasPrefix(pattern, "/") {
+			anchored = append(anchored, shellQuote("--exclude="+pattern))
+		} else {
+			names = append(names, shellQuote("--exclude="+pattern))
+		}
+	}
+	if len(anchored) > 0 {
+		args = append(append(args, "--anchored"), anchored...)
+	}
+	if len(names) > 0 {
+		args = append(append(args, "--no-anchored"), names...)
+	}
+	for _, marker := range markers {
+		args = append(args, shellQuote("--exclude-tag-all="+marker))
+	}
+	args = append(args, "--")
+	for _, path := range paths {
+		args = append(args, shellQuote(path))
+	}
+	return strings.Join(args, " ")
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
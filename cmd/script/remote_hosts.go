@@ -0,0 +1,178 @@
+package main
+
+// Remote hosts (pull mode).
+//
+// With REMOTE_HOSTS=name:user@host[:port],... this machine is a central
+// backup box: instead of archiving its own filesystem, every snapshot run
+// connects to each host over SSH in turn, runs tar there and streams its
+// output through the usual compression and encryption, without a staging
+// copy on either side (see remote_archive.go). Each host gets its own
+// directory, DISK_IMAGE_DIR/<name> and <S3_BUCKET_PREFIX>/<name>, so its
+// index, repository and retention are its own; the manifest chain still
+// spans every host.
+//
+// Connections use a dedicated key (REMOTE_SSH_KEY) in batch mode, and only
+// reach hosts listed in REMOTE_KNOWN_HOSTS. REMOTE_<NAME>_PATHS lists the
+// absolute paths archived on a host, / by default; each stays on its
+// filesystem. REMOTE_TAR_COMMAND is run in front of the tar options, to
+// use sudo for instance. SOURCES, DATABASES, DOCKER_BACKUP_LABEL and
+// CAPTURE_BACKEND describe this machine and do not apply to remote hosts,
+// which are always archived in full.
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+const defaultSSHPort = "22"
+
+// remoteHost is one host pulled by each snapshot run.
+type remoteHost struct {
+	Name    string
+	User    string
+	Address string
+	Port    string
+	Paths   []string
+}
+
+// parseRemoteHosts parses REMOTE_HOSTS: "name:user@host[:port],...".
+func parseRemoteHosts(value string) ([]remoteHost, error) {
+	var hosts []remoteHost
+	seen := make(map[string]bool)
+	for _, entry := range splitPatterns(value) {
+		name, target, ok := strings.Cut(entry, ":")
+		if !ok || !sourceNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid remote host %q, expected name:user@host[:port] with a lower-case name", entry)
+		}
+		host := remoteHost{Name: name, Port: defaultSSHPort, Paths: []string{"/"}}
+		if user, address, ok := strings.Cut(target, "@"); ok {
+			host.User, target = user, address
+		}
+		// host, host:port, [v6] or [v6]:port
+		if address, port, err := net.SplitHostPort(target); err == nil {
+			host.Address, host.Port = address, port
+		} else {
+			host.Address = strings.Trim(target, "[]")
+		}
+		if host.Address == "" {
+			return nil, fmt.Errorf("remote host %s: no address in %q", name, entry)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("remote host %s is listed twice", name)
+		}
+		seen[name] = true
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// remotePathsKey returns the host name of REMOTE_<NAME>_PATHS keys.
+func remotePathsKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, "REMOTE_")
+	if !ok {
+		return "", false
+	}
+	name, ok := strings.CutSuffix(rest, "_PATHS")
+	return name, ok && name != ""
+}
+
+// applyRemotePaths attaches the REMOTE_<NAME>_PATHS settings, by upper-cased
+// name, and reports settings naming no host.
+func applyRemotePaths(hosts []remoteHost, paths map[string][]string) {
+	for i := range hosts {
+		key := strings.ToUpper(strings.ReplaceAll(hosts[i].Name, "-", "_"))
+		var valid []string
+		for _, path := range paths[key] {
+			if !filepath.IsAbs(path) {
+				logError("Ignoring REMOTE_%s_PATHS entry %q: not an absolute path", key, path)
+				continue
+			}
+			valid = append(valid, filepath.Clean(path))
+		}
+		if len(valid) > 0 {
+			hosts[i].Paths = valid
+		}
+		delete(paths, key)
+	}
+	for name := range paths {
+		logError("Ignoring REMOTE_%s_PATHS: no such remote host", name)
+	}
+}
+
+// sources describes the host's paths as sources, for info files and hooks.
+func (h *remoteHost) sources() []snapshotSource {
+	sources := make([]snapshotSource, len(h.Paths))
+	for i, path := range h.Paths {
+		sources[i] = snapshotSource{Name: h.Name, Path: path}
+	}
+	return sources
+}
+
+// target formats the host as user@address:port.
+func (h *remoteHost) target() string {
+	address := net.JoinHostPort(h.Address, h.Port)
+	if h.User != "" {
+		return h.User + "@" + address
+	}
+	return address
+}
+
+// describe formats the host for info files.
+func (h *remoteHost) describe() string {
+	return fmt.Sprintf("%s (%s over SSH)", h.Name, h.target())
+}
+
+// sshArgs returns the ssh arguments running command on the host.
+func (h *remoteHost) sshArgs(command string) []string {
+	args := []string{
+		"-i", remoteSSHKey,
+		"-o", "IdentitiesOnly=yes",
+		"-o", "BatchMode=yes",
+		"-o", "StrictHostKeyChecking=yes",
+		"-o", "UserKnownHostsFile=" + remoteKnownHosts,
+		"-o", "ConnectTimeout=30",
+		// A vanished host fails the snapshot instead of hanging it
+		"-o", "ServerAliveInterval=30",
+		"-o", "ServerAliveCountMax=4",
+		"-p", h.Port,
+	}
+	if h.User != "" {
+		args = append(args, "-l", h.User)
+	}
+	return append(args, "--", h.Address, command)
+}
+
+// snapshotAll takes this host's snapshot or, in pull mode, one snapshot of
+// each remote host, filed under its own directory.
+func snapshotAll(keyID string, masterKey []byte) {
+	unlock, err := lockSnapshotRun()
+	if errors.Is(err, errSnapshotRunning) {
+		logInfo("⏳ Skipping snapshot: %v", err)
+		return
+	}
+	if err != nil {
+		logError("Skipping snapshot: %v", err)
+		return
+	}
+	defer unlock()
+
+	if len(remoteHosts) == 0 {
+		takeSnapshot(keyID, masterKey)
+		return
+	}
+
+	logInfo("🛰️ Pull mode: snapshotting %d remote hosts, not this one", len(remoteHosts))
+	base := diskImageDir
+	defer func() {
+		diskImageDir, pulledHost = base, nil
+	}()
+	for i := range remoteHosts {
+		pulledHost = &remoteHosts[i]
+		diskImageDir = filepath.Join(base, pulledHost.Name)
+		logInfo("🛰️ Snapshotting remote host %s", pulledHost.describe())
+		takeSnapshot(keyID, masterKey)
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+// Repository mode: chunking, deduplicated storage and garbage collection
+// (see repository_format.go for the on-disk format).
+//
+// The archive stream is cut with a gear rolling hash: a boundary falls
+// where the top chunkAverageBits bits of the hash of the last 64 bytes are
+// zero, so inserting data only changes the chunks around it and the rest of
+// the archive deduplicates against earlier snapshots.
+//
+// Retention only removes tree files; the chunks no remaining tree refers to
+// are then garbage collected. Chunks written or reused by a snapshot within
+// chunkGracePeriod are always kept, so a snapshot running concurrently never
+// loses a chunk it has just found in the repository. The bucket copy of the
+// repository is collected the same way, against the local trees and the
+// trees in the bucket (see upload_cloud.go).
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	chunkMinSize     = 512 * 1024
+	chunkMaxSize     = 8 * 1024 * 1024
+	chunkAverageBits = 20 // 1 MiB average chunk
+	chunkGracePeriod = 24 * time.Hour
+)
+
+var errRepositoryNeedsMasterKey = errors.New("repository mode needs a master key (KEY_MODE=file or sealed)")
+
+func repositoryDir() string {
+	return filepath.Join(diskImageDir, repositoryDirName)
+}
+
+// loadRepositorySecret opens the repository secret through the keyring,
+// creating the repository on first use. It also returns the files created.
+func loadRepositorySecret(keyID string, masterKey []byte) ([]byte, []string, error) {
+	if masterKey == nil {
+		return nil, nil, errRepositoryNeedsMasterKey
+	}
+
+	keys, err := newKeyringKeys(masterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer keys.wipe()
+	secret, err := openRepositorySecret(keys)
+	if err == nil {
+		return secret, nil, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	path := filepath.Join(repositoryDir(), repositoryKeyFilename)
+	secret = make([]byte, repositorySecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, nil, err
+	}
+	if err := os.MkdirAll(filepath.Join(repositoryDir(), "chunks"), 0700); err != nil {
+		return nil, nil, err
+	}
+	if err := encryptDiskImage(bytes.NewReader(secret), path, keyID, masterKey, compressionNone); err != nil {
+		return nil, nil, err
+	}
+	logInfo("🧩 Created repository %s in %s", keyFingerprint(secret), repositoryDir())
+	return secret, []string{path}, nil
+}
+
+// openRepositorySecret decrypts repository/key.encrypted with whichever
+// keyring generation it is wrapped for.
+func openRepositorySecret(keys *keyringKeys) ([]byte, error) {
+	path := filepath.Join(repositoryDir(), repositoryKeyFilename)
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var secret bytes.Buffer
+	if err := keys.decrypt(&secret, file); err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	if secret.Len() != repositorySecretLength {
+		return nil, fmt.Errorf("invalid repository secret in %s", path)
+	}
+	return secret.Bytes(), nil
+}
+
+// keyringKeys finds the key that opens a repository file through the
+// keyring, by the key IDs of its slots: the active master key, the key of
+// an older generation still stored on this host, or for trees the
+// repository tree key.
+type keyringKeys struct {
+	keyring *Keyring
+	keys    map[string][]byte // By fingerprint
+	loaded  [][]byte          // Keys read from KEY_DIR, wiped by wipe
+	treeKey []byte
+}
+
+func newKeyringKeys(masterKey []byte) (*keyringKeys, error) {
+	keyring, err := loadKeyring(keyDir, keyFile)
+	if err == errNoKeyring {
+		keyring = &Keyring{}
+	} else if err != nil {
+		return nil, err
+	}
+	return &keyringKeys{
+		keyring: keyring,
+		keys:    map[string][]byte{keyFingerprint(masterKey): masterKey},
+	}, nil
+}
+
+// setRepository lets trees of the repository be opened by their
+// repository slot.
+func (k *keyringKeys) setRepository(secret []byte) {
+	wipe(k.treeKey)
+	k.treeKey = repositoryTreeKey(secret)
+}
+
+// dataKey unwraps the data key of a version 3 file.
+func (k *keyringKeys) dataKey(header *snapshotHeader) ([]byte, error) {
+	if k.treeKey != nil {
+		treeFingerprint := keyFingerprint(k.treeKey)
+		for _, slot := range header.KeySlots {
+			if slot.Type == keySlotRepository && slot.KeyFingerprint == treeFingerprint {
+				return openWrappedKey(slot, k.treeKey, header.aad)
+			}
+		}
+	}
+
+	var missing []string
+	for _, slot := range header.KeySlots {
+		if slot.Type != keySlotMaster {
+			continue
+		}
+		if key, ok := k.keys[slot.KeyFingerprint]; ok {
+			return unwrapDataKey(header, key)
+		}
+		generation := k.keyring.find(slot.KeyID)
+		if generation == nil {
+			generation = k.keyring.findByFingerprint(slot.KeyFingerprint)
+		}
+		if generation == nil || generation.KeyFile == "" {
+			missing = append(missing, slotKeyName(slot))
+			continue
+		}
+		key, err := loadGenerationKey(generation)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[generation.Fingerprint] = key
+		k.loaded = append(k.loaded, key)
+		return unwrapDataKey(header, key)
+	}
+	if len(missing) == 0 {
+		return nil, errors.New("no master key slot")
+	}
+	return nil, fmt.Errorf("needs key generation %s, which is not stored on this host", strings.Join(missing, " or "))
+}
+
+// decrypt decrypts a version 3 file from src into dst.
+func (k *keyringKeys) decrypt(dst io.Writer, src io.Reader) error {
+	br := bufio.NewReader(src)
+	header, err := readSnapshotHeader(br)
+	if err != nil {
+		return err
+	}
+	if header.Version < 3 {
+		return fmt.Errorf("stream format version %d has no key slots", header.Version)
+	}
+	dataKey, err := k.dataKey(header)
+	if err != nil {
+		return err
+	}
+	defer wipe(dataKey)
+
+	plain, err := newSegmentReader(br, dataKey, header.NoncePrefix, header.aad, header.ChunkSize, header.PlaintextSize)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, plain)
+	return err
+}
+
+// wipe forgets the keys read from KEY_DIR and the tree key; the master key
+// belongs to the caller.
+func (k *keyringKeys) wipe() {
+	for _, key := range k.loaded {
+		wipe(key)
+	}
+	wipe(k.treeKey)
+	k.loaded, k.treeKey = nil, nil
+}
+
+// addRepositorySlot gives a tree its repository slot.
+func addRepositorySlot(treePath string, masterKey, secret []byte) error {
+	src, err := os.Open(treePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	tmpPath := treePath + ".tmp"
+	dst, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	treeKey := repositoryTreeKey(secret)
+	defer wipe(treeKey)
+	out := bufio.NewWriter(dst)
+	err = addKeySlot(out, src, masterKey, keySlotRepository, keyFingerprint(secret), treeKey)
+	if err == nil {
+		err = out.Flush()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, treePath)
+}
+
+// chunker cuts a stream at content-defined boundaries.
+type chunker struct {
+	src  *bufio.Reader
+	gear [256]uint64
+	buf  []byte
+}
+
+// newChunker derives the gear table from the repository's ID key, so
+// boundaries differ between repositories.
+func newChunker(src io.Reader, idKey []byte) *chunker {
+	c := &chunker{
+		src: bufio.NewReaderSize(src, 1024*1024),
+		buf: make([]byte, 0, chunkMaxSize),
+	}
+	mac := hmac.New(sha256.New, idKey)
+	for i := range c.gear {
+		mac.Reset()
+		mac.Write([]byte{'g', 'e', 'a', 'r', byte(i)})
+		c.gear[i] = binary.BigEndian.Uint64(mac.Sum(nil))
+	}
+	return c
+}
+
+// next returns the next chunk, valid until the following call, or io.EOF
+// at the end of the stream.
+func (c *chunker) next() ([]byte, error) {
+	const mask = uint64(1)<<chunkAverageBits - 1
+
+	c.buf = c.buf[:0]
+	var hash uint64
+	for len(c.buf) < chunkMaxSize {
+		b, err := c.src.ReadByte()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		c.buf = append(c.buf, b)
+		hash = hash<<1 + c.gear[b]
+		if len(c.buf) >= chunkMinSize && (hash>>(64-chunkAverageBits))&mask == 0 {
+			break
+		}
+	}
+	if len(c.buf) == 0 {
+		return nil, io.EOF
+	}
+	return c.buf, nil
+}
+
+// createRepositorySnapshot archives the root filesystem into the
+// repository and encrypts the resulting tree to treePath. It returns the
+// repository files it created, to be uploaded before the tree.
+func createRepositorySnapshot(treePath, keyID string, key []byte, now time.Time, plan *incrementalPlan, listing *fileManifest) ([]string, error) {
+	secret, created, err := loadRepositorySecret(keyID, key)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(secret)
+	encryptionKey, idKey := repositoryKeys(secret)
+
+	logInfo("Archiving filesystem into the repository...")
+
+	pr, pw := io.Pipe()
+	archived := make(chan struct{})
+	go func() {
+		defer close(archived)
+		pw.CloseWithError(writeSnapshotArchive(pw, now, plan, listing))
+	}()
+	// Stops the archiver if chunking failed first, and waits for it; its
+	// own error reaches the chunker through the pipe
+	defer func() {
+		pr.CloseWithError(io.ErrClosedPipe)
+		<-archived
+	}()
+
+	tree := &repositoryTree{
+		Version:    repositoryTreeVersion,
+		Repository: keyFingerprint(secret),
+		Secret:     secret,
+	}
+	newFiles := created
+	var stored, storedBytes int64
+	chunks := newChunker(pr, idKey)
+	for {
+		data, err := chunks.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		id := chunkID(idKey, data)
+		path := chunkPath(repositoryDir(), id)
+		isNew, err := storeChunk(path, encryptionKey, id, data, now)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store chunk %s: %v", id, err)
+		}
+		if isNew {
+			newFiles = append(newFiles, path)
+			stored++
+			storedBytes += int64(len(data))
+		}
+		tree.Chunks = append(tree.Chunks, chunkRef{ID: id, Size: int64(len(data))})
+		tree.Size += int64(len(data))
+	}
+
+	logInfo("🧩 %d chunks (%.2f MB), %d new (%.2f MB)", len(tree.Chunks), float64(tree.Size)/1024/1024,
+		stored, float64(storedBytes)/1024/1024)
+
+	plaintext, err := encodeTree(tree)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext)
+	if err := encryptDiskImage(bytes.NewReader(plaintext), treePath, keyID, key, compressionNone); err != nil {
+		return nil, err
+	}
+	if err := addRepositorySlot(treePath, key, secret); err != nil {
+		os.Remove(treePath)
+		return nil, fmt.Errorf("failed to add repository slot: %v", err)
+	}
+	return newFiles, nil
+}
+
+// storeChunk writes a chunk unless the repository already has it, and
+// reports whether it was written. Reused chunks get a fresh mtime, which
+// protects them from a concurrent garbage collection.
+func storeChunk(path string, encryptionKey []byte, id string, data []byte, now time.Time) (bool, error) {
+	if _, err := os.Stat(path); err == nil {
+		return false, os.Chtimes(path, now, now)
+	}
+
+	sealed, err := sealChunk(encryptionKey, id, data)
+	if err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return false, err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, sealed, 0600); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	return true, os.Rename(tmp, path)
+}
+
+// isTreeFile reports whether a snapshot file is a repository tree.
+func isTreeFile(name string) bool {
+	return strings.HasSuffix(name, repositoryTreeSuffix+".encrypted")
+}
+
+// collectRepositoryGarbage removes the chunks no tree refers to anymore.
+// Trees are read through their repository slot, or else with the key
+// generation their master slot names. A tree that cannot be read stops the
+// collection: its chunks could otherwise be deleted.
+func collectRepositoryGarbage(masterKey []byte) {
+	if _, err := os.Stat(repositoryDir()); err != nil || masterKey == nil {
+		return
+	}
+
+	logInfo("🧩 Collecting unreferenced repository chunks...")
+
+	keys, err := newKeyringKeys(masterKey)
+	if err != nil {
+		logError("Repository garbage collection aborted: %v", err)
+		return
+	}
+	defer keys.wipe()
+	secret, err := openRepositorySecret(keys)
+	if err != nil {
+		logError("Repository garbage collection aborted: %v", err)
+		return
+	}
+	keys.setRepository(secret)
+	wipe(secret)
+
+	referenced := make(map[string]bool)
+	trees := 0
+	err = filepath.WalkDir(diskImageDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() && path == repositoryDir() {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !isTreeFile(d.Name()) {
+			return nil
+		}
+
+		tree, err := readTreeFile(path, keys)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		for _, ref := range tree.Chunks {
+			referenced[ref.ID] = true
+		}
+		wipe(tree.Secret)
+		trees++
+		return nil
+	})
+	if err != nil {
+		logError("Repository garbage collection aborted: %v", err)
+		return
+	}
+
+	cutoff := time.Now().Add(-chunkGracePeriod)
+	removed := 0
+	var freed int64
+	filepath.WalkDir(filepath.Join(repositoryDir(), "chunks"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || referenced[d.Name()] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			logError("Failed to remove chunk %s: %v", d.Name(), err)
+			return nil
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+
+	logInfo("🧩 %d trees refer to %d chunks, removed %d unreferenced chunks (%.2f MB freed)",
+		trees, len(referenced), removed, float64(freed)/1024/1024)
+
+	collectCloudRepositoryGarbage(referenced, keys)
+}
+
+// readTreeFile decrypts a tree file.
+func readTreeFile(path string, keys *keyringKeys) (*repositoryTree, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readTree(file, keys)
+}
+
+// readTree decrypts a tree read from src.
+func readTree(src io.Reader, keys *keyringKeys) (*repositoryTree, error) {
+	var plaintext bytes.Buffer
+	if err := keys.decrypt(&plaintext, src); err != nil {
+		return nil, err
+	}
+	defer wipe(plaintext.Bytes())
+	return parseTree(plaintext.Bytes())
+}
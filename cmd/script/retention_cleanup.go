@@ -2,6 +2,7 @@ package main
 
 import (
 	"bufio"
+	"crypto/ed25519"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -13,10 +14,12 @@ const (
 	defaultRetentionDays = 0
 )
 
-func checkRetentionPolicy() {
+// checkRetentionPolicy removes expired disk images and returns how many
+// were removed.
+func checkRetentionPolicy() int {
 	retentionDays := getRetentionDays()
 	if retentionDays <= 0 {
-		return
+		return 0
 	}
 
 	logInfo("🗑️ Checking retention policy: removing disk images older than %d days", retentionDays)
@@ -25,20 +28,21 @@ func checkRetentionPolicy() {
 	removed := 0
 	var totalSize int64
 
+	var expired, kept []string
 	err := filepath.Walk(diskImageDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
+		// Repository chunks are collected once no tree refers to them
+		if info.IsDir() && path == repositoryDir() {
+			return filepath.SkipDir
+		}
 
-		if !info.IsDir() && strings.HasSuffix(info.Name(), ".encrypted") {
+		if !info.IsDir() && strings.HasSuffix(info.Name(), ".encrypted") && !isFileManifest(info.Name()) {
 			if info.ModTime().Before(cutoffTime) {
-				totalSize += info.Size()
-				if err := os.Remove(path); err != nil {
-					logError("Failed to remove old disk image %s: %v", path, err)
-				} else {
-					removed++
-					logInfo("🗑️ Removed old disk image: %s", filepath.Base(path))
-				}
+				expired = append(expired, path)
+			} else {
+				kept = append(kept, path)
 			}
 		}
 
@@ -47,7 +51,59 @@ func checkRetentionPolicy() {
 
 	if err != nil {
 		logError("Failed to check retention policy: %v", err)
-		return
+		return 0
+	}
+
+	if len(expired) == 0 {
+		return 0
+	}
+
+	// Incremental snapshots are useless without the snapshots they build
+	// on, so nothing expires while that cannot be worked out
+	needed, err := chainAncestors(kept)
+	if err != nil {
+		logError("Keeping all %d expired disk images: cannot tell which snapshots newer incrementals build on: %v", len(expired), err)
+		return 0
+	}
+	held := 0
+	// Removed manifests leave gaps in the chain, recorded as tombstones
+	publicKey, _ := loadSigningPublicKey(keyDir)
+	var tombstones []uint64
+	for _, path := range expired {
+		if needed[path] {
+			held++
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			logError("Failed to remove old disk image %s: %v", path, err)
+			continue
+		}
+		removed++
+		totalSize += info.Size()
+		logInfo("🗑️ Removed old disk image: %s", filepath.Base(path))
+		sequence := manifestSequence(manifestPathFor(path), publicKey)
+		if err := os.Remove(manifestPathFor(path)); err != nil && !os.IsNotExist(err) {
+			logError("Failed to remove manifest of %s: %v", path, err)
+		} else if sequence > 0 {
+			tombstones = append(tombstones, sequence)
+		}
+		if err := os.Remove(fileManifestPathFor(path)); err != nil && !os.IsNotExist(err) {
+			logError("Failed to remove file manifest of %s: %v", path, err)
+		}
+	}
+
+	if len(tombstones) > 0 {
+		if err := recordTombstones(keyDir, tombstones); err != nil {
+			logError("Failed to record removed manifests, verify-chain will report them missing: %v", err)
+		}
+	}
+
+	if held > 0 {
+		logInfo("🗑️ Kept %d expired disk images that newer incremental snapshots build on", held)
 	}
 
 	if removed > 0 {
@@ -55,6 +111,24 @@ func checkRetentionPolicy() {
 
 		removeEmptyDirs(diskImageDir)
 	}
+	return removed
+}
+
+// manifestSequence returns the chain sequence number of a manifest, or 0 if
+// it is unchained or cannot be verified.
+func manifestSequence(manifestPath string, publicKey ed25519.PublicKey) uint64 {
+	if publicKey == nil {
+		return 0
+	}
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return 0
+	}
+	manifest, err := openManifest(data, publicKey)
+	if err != nil {
+		return 0
+	}
+	return manifest.Sequence
 }
 
 func getRetentionDays() int {
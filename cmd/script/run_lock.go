@@ -0,0 +1,41 @@
+package main
+
+// Snapshot run lock.
+//
+// Cron starts a run every minute, and a run can take longer than that. Two
+// runs at once would both extend the manifest chain from the same head and
+// commit the file index over each other, so a run holds an exclusive flock
+// on KEY_DIR/snapshot.lock from start to end; a run that finds it held is
+// skipped, and the next one catches up. Key rotation and activation
+// (cmd/generate) hold the same lock while they rewrap snapshot files.
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+const runLockFilename = "snapshot.lock"
+
+var errSnapshotRunning = errors.New("another snapshot run or a key rotation is in progress")
+
+// lockSnapshotRun takes the run lock, or returns errSnapshotRunning if
+// another run holds it. The lock is released by the returned function, or
+// when the process exits.
+func lockSnapshotRun() (func(), error) {
+	path := filepath.Join(keyDir, runLockFilename)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, errSnapshotRunning
+		}
+		return nil, fmt.Errorf("failed to lock %s: %v", path, err)
+	}
+	return func() { file.Close() }, nil
+}
@@ -43,12 +43,18 @@ func getDiskImageStatsContent() {
 	dayFolders := 0
 	hourFolders := 0
 	totalDiskImages := 0
+	repositoryChunks := 0
+	var repositoryBytes int64
 
 	err := filepath.Walk(diskImageDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
 
+		if info.IsDir() && path == repositoryDir() {
+			return filepath.SkipDir
+		}
+
 		if info.IsDir() && path != diskImageDir {
 			relPath, _ := filepath.Rel(diskImageDir, path)
 			pathParts := strings.Split(filepath.ToSlash(relPath), "/")
@@ -62,7 +68,7 @@ func getDiskImageStatsContent() {
 			case 4:
 				hourFolders++
 			}
-		} else if !info.IsDir() && strings.HasSuffix(info.Name(), ".encrypted") {
+		} else if !info.IsDir() && strings.HasSuffix(info.Name(), ".encrypted") && !isFileManifest(info.Name()) {
 			totalDiskImages++
 		}
 
@@ -74,8 +80,19 @@ func getDiskImageStatsContent() {
 		return
 	}
 
+	filepath.Walk(filepath.Join(repositoryDir(), "chunks"), func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			repositoryChunks++
+			repositoryBytes += info.Size()
+		}
+		return nil
+	})
+
 	logInfo("📅 Years with disk images: %d", yearFolders)
 	logInfo("📁 Days with disk images: %d", dayFolders)
 	logInfo("⏰ Hour folders: %d", hourFolders)
 	logInfo("💽 Total encrypted disk images: %d", totalDiskImages)
+	if repositoryChunks > 0 {
+		logInfo("🧩 Repository chunks: %d (%.2f MB)", repositoryChunks, float64(repositoryBytes)/1024/1024)
+	}
 }
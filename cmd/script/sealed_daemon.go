@@ -0,0 +1,414 @@
+package main
+
+// Sealed mode.
+//
+// With KEY_MODE=sealed no key material is kept on disk: keyring.json only
+// describes the generations. 'snapshot daemon' starts sealed and takes a
+// snapshot every SNAPSHOT_INTERVAL once operators have submitted enough
+// Shamir shares of the active generation through the local unseal socket
+// ('snapshot unseal'). The reconstructed key lives in locked memory and is
+// zeroed when the daemon is sealed again or stops.
+//
+// The socket speaks one line per request and one line per response:
+//
+//	unseal <share hex>  ->  ok sealed 1/3 ... | ok unsealed ... | error ...
+//	status              ->  ok sealed ... | ok unsealed ...
+//	seal                ->  ok sealed
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/vault/shamir"
+)
+
+const (
+	keyModeFile       = "file"
+	keyModeSealed     = "sealed"
+	keyModeRecipients = "recipients" // No master key: encrypt to RECIPIENTS only
+
+	unsealRequestTimeout = 30 * time.Second
+)
+
+// sealVault holds the unseal progress and, once unsealed, the master key.
+// mu guards the fields; inUse is held for reading while a snapshot uses the
+// key so that sealing waits for the snapshot instead of wiping the key
+// under it.
+type sealVault struct {
+	mu    sync.Mutex
+	inUse sync.RWMutex
+
+	generation *KeyGeneration
+	shares     []*lockedBuffer
+	key        *lockedBuffer
+	keyID      string
+	unsealedAt time.Time
+}
+
+func runCommand(command string) {
+	switch command {
+	case "daemon":
+		runDaemon()
+	case "unseal":
+		runUnsealClient()
+	case "verify-chain":
+		runVerifyChain()
+	case "status", "seal":
+		response, err := sendUnsealRequest(command)
+		printUnsealResponse(response, err)
+	default:
+		fmt.Println("Usage:")
+		fmt.Println("  snapshot          # Take one snapshot with the key stored on disk")
+		fmt.Println("  snapshot daemon   # Start sealed and take snapshots once unsealed")
+		fmt.Println("  snapshot unseal   # Submit one key share to the running daemon")
+		fmt.Println("  snapshot status   # Show whether the daemon is sealed")
+		fmt.Println("  snapshot seal     # Wipe the key from the daemon's memory")
+		fmt.Println("  snapshot verify-chain  # Check the manifest chain for deleted snapshots")
+		os.Exit(1)
+	}
+}
+
+func runDaemon() {
+	if keyMode != keyModeSealed {
+		logInfo("⚠️ KEY_MODE is %s; the daemon still ignores key files and waits for shares", keyMode)
+	}
+
+	if err := hardenProcess(); err != nil {
+		logError("Failed to disable core dumps: %v", err)
+	}
+
+	listener, err := listenUnsealSocket()
+	if err != nil {
+		logError("Failed to open unseal socket: %v", err)
+		os.Exit(1)
+	}
+
+	vault := &sealVault{}
+	go vault.serve(listener)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	logInfo("🔒 Snapshot daemon started sealed, submit key shares with 'snapshot unseal' (%s)", unsealSocket)
+
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			vault.runScheduledSnapshot()
+		case sig := <-signals:
+			logInfo("Received %s, sealing and shutting down", sig)
+			listener.Close()
+			vault.seal()
+			os.Remove(unsealSocket)
+			return
+		}
+	}
+}
+
+func listenUnsealSocket() (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(unsealSocket), 0700); err != nil {
+		return nil, err
+	}
+
+	// A socket left behind by a previous daemon would make Listen fail
+	if conn, err := net.Dial("unix", unsealSocket); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("another daemon is already listening on %s", unsealSocket)
+	}
+	os.Remove(unsealSocket)
+
+	listener, err := net.Listen("unix", unsealSocket)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(unsealSocket, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (v *sealVault) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go v.handleConnection(conn)
+	}
+}
+
+func (v *sealVault) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(unsealRequestTimeout))
+
+	scanner := bufio.NewScanner(conn)
+	if !scanner.Scan() {
+		return
+	}
+	// The share is decoded straight from the scanner's buffer into locked
+	// memory: converting it to a string would leave a copy on the heap
+	line := scanner.Bytes()
+	defer wipe(line)
+
+	command, argument, _ := bytes.Cut(bytes.TrimSpace(line), []byte(" "))
+
+	var message string
+	var err error
+	switch string(command) {
+	case "unseal":
+		message, err = v.submitShare(argument)
+	case "status":
+		message = v.status()
+	case "seal":
+		v.seal()
+		logInfo("🔒 Sealed on operator request")
+		message = "sealed"
+	default:
+		err = fmt.Errorf("unknown command %q", command)
+	}
+
+	if err != nil {
+		fmt.Fprintf(conn, "error %v\n", err)
+		return
+	}
+	fmt.Fprintf(conn, "ok %s\n", message)
+}
+
+// submitShare adds one share and reconstructs the key once the active
+// generation's threshold is reached. The result is only accepted when its
+// fingerprint matches the keyring, so a wrong share never unseals.
+func (v *sealVault) submitShare(shareHex []byte) (string, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.key != nil {
+		return fmt.Sprintf("unsealed with key generation %s", v.keyID), nil
+	}
+
+	if v.generation == nil {
+		keyring, err := loadKeyring(keyDir, keyFile)
+		if err != nil {
+			return "", err
+		}
+		if v.generation = keyring.active(); v.generation == nil {
+			return "", fmt.Errorf("keyring has no active key generation")
+		}
+	}
+
+	share, err := decodeShare(shareHex)
+	if err != nil {
+		return "", err
+	}
+	for _, existing := range v.shares {
+		if bytes.Equal(existing.Bytes(), share.Bytes()) {
+			share.Destroy()
+			return "", fmt.Errorf("share already submitted")
+		}
+	}
+	v.shares = append(v.shares, share)
+
+	// Keyrings migrated from a key without key_info.json do not know their
+	// threshold; keep trying from two shares on until the fingerprint matches.
+	required := v.generation.RequiredShares
+	if len(v.shares) < required || len(v.shares) < 2 {
+		logInfo("🔑 Unseal progress: %d/%d shares for key generation %s", len(v.shares), required, v.generation.ID)
+		return v.progress(), nil
+	}
+
+	key, err := v.combineShares()
+	if err != nil && required == 0 {
+		return v.progress(), nil
+	}
+	if err != nil {
+		v.resetShares()
+		return "", fmt.Errorf("%v; unseal progress reset", err)
+	}
+
+	v.key = key
+	v.keyID = v.generation.ID
+	v.unsealedAt = time.Now()
+	v.resetShares()
+
+	logInfo("🔓 Unsealed with key generation %s", v.keyID)
+	return fmt.Sprintf("unsealed with key generation %s", v.keyID), nil
+}
+
+// combineShares reconstructs the key into locked memory.
+func (v *sealVault) combineShares() (*lockedBuffer, error) {
+	parts := make([][]byte, len(v.shares))
+	for i, share := range v.shares {
+		parts[i] = share.Bytes()
+	}
+
+	combined, err := shamir.Combine(parts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to combine shares: %v", err)
+	}
+	defer wipe(combined)
+
+	if len(combined) != masterKeyLength || keyFingerprint(combined) != v.generation.Fingerprint {
+		return nil, fmt.Errorf("shares do not reconstruct key generation %s", v.generation.ID)
+	}
+
+	key, err := newLockedBuffer(len(combined))
+	if err != nil {
+		return nil, err
+	}
+	copy(key.Bytes(), combined)
+	return key, nil
+}
+
+func decodeShare(shareHex []byte) (*lockedBuffer, error) {
+	shareHex = bytes.TrimSpace(shareHex)
+	if len(shareHex) != hex.EncodedLen(masterKeyLength+1) {
+		return nil, fmt.Errorf("invalid share length: expected %d bytes, got %d", masterKeyLength+1, len(shareHex)/2)
+	}
+
+	share, err := newLockedBuffer(masterKeyLength + 1)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := hex.Decode(share.Bytes(), shareHex); err != nil {
+		share.Destroy()
+		return nil, fmt.Errorf("invalid hex in share: %v", err)
+	}
+	return share, nil
+}
+
+func (v *sealVault) resetShares() {
+	for _, share := range v.shares {
+		share.Destroy()
+	}
+	v.shares = nil
+	v.generation = nil
+}
+
+// progress must be called with mu held.
+func (v *sealVault) progress() string {
+	if v.generation == nil {
+		return "sealed, waiting for key shares"
+	}
+	required := fmt.Sprint(v.generation.RequiredShares)
+	if v.generation.RequiredShares == 0 {
+		required = "?"
+	}
+	return fmt.Sprintf("sealed %d/%s shares for key generation %s", len(v.shares), required, v.generation.ID)
+}
+
+func (v *sealVault) status() string {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.key != nil {
+		return fmt.Sprintf("unsealed with key generation %s since %s", v.keyID, v.unsealedAt.Format(time.RFC3339))
+	}
+	return v.progress()
+}
+
+// seal wipes the key and any partial shares, waiting for a running
+// snapshot to finish first.
+func (v *sealVault) seal() {
+	v.inUse.Lock()
+	defer v.inUse.Unlock()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.key.Destroy()
+	v.key = nil
+	v.keyID = ""
+	v.resetShares()
+}
+
+func (v *sealVault) runScheduledSnapshot() {
+	// A rotation activates a new generation; the old key must not be used
+	// for new snapshots, so seal until the new shares are submitted.
+	keyring, err := loadKeyring(keyDir, keyFile)
+	if err != nil {
+		logError("Failed to load keyring: %v", err)
+		return
+	}
+	v.mu.Lock()
+	keyID := v.keyID
+	v.mu.Unlock()
+	if active := keyring.active(); keyID != "" && (active == nil || active.ID != keyID) {
+		logInfo("🔒 Key generation %s is no longer active, sealing until the new generation is unsealed", keyID)
+		v.seal()
+	}
+
+	v.inUse.RLock()
+	defer v.inUse.RUnlock()
+
+	v.mu.Lock()
+	key, keyID, progress := v.key, v.keyID, v.progress()
+	v.mu.Unlock()
+
+	if key == nil {
+		logInfo("🔒 Skipping snapshot: %s", progress)
+		return
+	}
+
+	snapshotAll(keyID, key.Bytes())
+}
+
+func runUnsealClient() {
+	fmt.Print("Enter KEY SHARE: ")
+	share, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	share = strings.TrimSpace(share)
+	if share == "" {
+		fmt.Println("❌ No share entered")
+		os.Exit(1)
+	}
+
+	response, err := sendUnsealRequest("unseal " + share)
+	printUnsealResponse(response, err)
+}
+
+func sendUnsealRequest(request string) (string, error) {
+	conn, err := net.Dial("unix", unsealSocket)
+	if err != nil {
+		return "", fmt.Errorf("cannot reach snapshot daemon on %s: %v", unsealSocket, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(unsealRequestTimeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\n", request); err != nil {
+		return "", err
+	}
+
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("no response from snapshot daemon: %v", err)
+	}
+	response = strings.TrimSpace(response)
+
+	if message, ok := strings.CutPrefix(response, "error "); ok {
+		return "", fmt.Errorf("%s", message)
+	}
+	return strings.TrimPrefix(response, "ok "), nil
+}
+
+func printUnsealResponse(response string, err error) {
+	if err != nil {
+		fmt.Printf("%s❌ %v%s\n", ColorRed, err, ColorReset)
+		os.Exit(1)
+	}
+	if strings.HasPrefix(response, "unsealed") {
+		fmt.Printf("%s🔓 %s%s\n", ColorGreen, response, ColorReset)
+		return
+	}
+	fmt.Printf("🔒 %s\n", response)
+}
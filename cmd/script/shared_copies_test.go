@@ -0,0 +1,43 @@
+package main
+
+// The Docker build compiles each program from its own directory, so the
+// files they share are copied rather than imported. Every copy must stay
+// byte-identical to the one in cmd/script.
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var sharedCopies = map[string][]string{
+	"stream_cipher.go":     {"../generate", "../test", "../../test_encryption"},
+	"recipients.go":        {"../generate", "../test", "../../test_encryption"},
+	"keyring.go":           {"../generate", "../test"},
+	"compression.go":       {"../test", "../../test_encryption"},
+	"manifest.go":          {"../test"},
+	"repository_format.go": {"../test"},
+	"file_manifest.go":     {"../test"},
+	"docker_api.go":        {"../test"},
+}
+
+func TestSharedCopiesIdentical(t *testing.T) {
+	for name, dirs := range sharedCopies {
+		want, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, dir := range dirs {
+			path := filepath.Join(dir, name)
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Errorf("missing copy: %v", err)
+				continue
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s differs from cmd/script/%s", path, name)
+			}
+		}
+	}
+}
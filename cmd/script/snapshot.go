@@ -2,10 +2,9 @@ package main
 
 import (
 	"bufio"
-	"fmt"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -13,7 +12,14 @@ import (
 // Global configuration variables
 var (
 	diskImageDir string
-	keyFile      string
+	keyDir       string
+	keyFile      string // Pre-keyring master key, read when no keyring exists
+
+	// Sealed mode
+	keyMode          string
+	recipients       []recipient // X25519 public keys every snapshot is also encrypted to
+	unsealSocket     string
+	snapshotInterval time.Duration
 
 	// System paths
 	tempMountPoint    string
@@ -29,25 +35,109 @@ var (
 	genisoimagePath string
 	isolinuxLibPath string
 	syslinuxLibPath string
+	mksquashfsPath  string
+	pgDumpPath      string
+	mysqldumpPath   string
+	sqlite3Path     string
+	redisCliPath    string
+	btrfsPath       string
+	lvmPath         string
+	sshPath         string
+
+	// Image format
+	imageFormat    string
+	rawImageSizeMB int // 0 to size raw images from their content
+	isoKernel      string
+	isoInitrd      string
+	isoBootOptions string
+
+	// Compression
+	compressionCodec   string
+	compressionLevel   int // defaultCompressionLevel for the codec's default
+	compressionThreads int // 0 for every CPU
+
+	// Incremental snapshots
+	incrementalEnabled   bool
+	fullSnapshotInterval time.Duration
+
+	// Deduplicated repository
+	repositoryEnabled bool
+
+	// Sources
+	snapshotSources     []snapshotSource
+	databaseSources     []databaseSource
+	databaseDumpTimeout time.Duration
+	captureBackend      string
+
+	// Docker volumes
+	dockerSocket          string
+	dockerBackupLabel     string
+	dockerPauseContainers bool
+
+	// Remote hosts (pull mode)
+	remoteHosts      []remoteHost
+	remoteSSHKey     string
+	remoteKnownHosts string
+	remoteTarCommand string
+	pulledHost       *remoteHost // Host being snapshotted, nil for this one
+
+	// Hooks
+	preSnapshotHooks  []string
+	postSnapshotHooks []string
+	hookTimeout       time.Duration
+	hookFailurePolicy string
+	currentHooks      *snapshotHooks // Hooks of the snapshot being taken
 
 	// Exclusions
 	excludePatterns []string
+	excludeFile     string
+	excludeRules    []excludeRule
 )
 
 func main() {
 	loadConfig()
 
-	if _, err := os.Stat(keyFile); os.IsNotExist(err) {
-		logError("No encryption key found. Use 'make generate' to create a key and start")
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1])
 		return
 	}
 
-	masterKey, err := loadMasterKey()
+	if keyMode == keyModeSealed {
+		logError("Sealed mode: snapshots are taken by the running 'snapshot daemon'")
+		return
+	}
+
+	if keyMode == keyModeRecipients {
+		groups, err := loadShamirGroups()
+		if err != nil {
+			logError("Failed to load Shamir groups: %v", err)
+			return
+		}
+		if len(recipients)+len(groups) == 0 {
+			logError("KEY_MODE=recipients but no RECIPIENTS or Shamir groups are configured")
+			return
+		}
+		// This host never holds a key able to decrypt its own snapshots
+		snapshotAll("", nil)
+		return
+	}
+
+	keyID, masterKey, err := loadMasterKey()
+	if err == errNoKeyring {
+		logError("No encryption key found. Use 'make generate' to create a key and start")
+		return
+	}
 	if err != nil {
 		logError("Failed to load master key: %v", err)
 		return
 	}
+	defer wipe(masterKey)
 
+	snapshotAll(keyID, masterKey)
+}
+
+// takeSnapshot creates, encrypts, stores and uploads one disk image.
+func takeSnapshot(keyID string, masterKey []byte) {
 	// Use single timestamp for consistency
 	now := time.Now()
 	diskImagePath, diskImageName, err := createArchitecturedDiskImageWithTime(now)
@@ -58,31 +148,100 @@ func main() {
 
 	logInfo("Starting encrypted OS disk image %s", diskImageName)
 
-	isoPath := diskImagePath + ".iso.gz"
-	if err := createCompressedISOWithTime(isoPath, now); err != nil {
-		logError("Failed to create compressed ISO: %v", err)
-		return
+	fullImage := imageFormat != imageFormatTar
+	var plan *incrementalPlan
+	if fullImage && incrementalEnabled {
+		logError("INCREMENTAL=true ignored: %s images are always full", imageFormat)
+	} else if pulledHost != nil && incrementalEnabled {
+		logError("INCREMENTAL=true ignored: remote hosts are always pulled in full")
+	} else {
+		plan = planSnapshot(now)
 	}
 
+	useRepository := repositoryEnabled
+	if useRepository && fullImage {
+		logError("REPOSITORY=true ignored: %s images are not stored in the repository", imageFormat)
+		useRepository = false
+	}
+	if useRepository && masterKey == nil {
+		logError("REPOSITORY=true ignored: %v", errRepositoryNeedsMasterKey)
+		useRepository = false
+	}
+
+	var repositoryFiles []string
+	if useRepository {
+		diskImagePath += repositoryTreeSuffix
+		diskImageName += repositoryTreeSuffix
+	}
 	encryptedDiskPath := diskImagePath + ".encrypted"
-	if err := encryptDiskImage(isoPath, encryptedDiskPath, masterKey); err != nil {
-		logError("Failed to encrypt ISO: %v", err)
+	listing := &fileManifest{
+		Version:   fileManifestVersion,
+		Snapshot:  filepath.Base(encryptedDiskPath),
+		CreatedAt: now.UTC(),
+	}
+
+	hooks := newSnapshotHooks(diskImageName, encryptedDiskPath, now)
+	if err := hooks.runPre(); err != nil {
+		logError("Snapshot aborted: %v", err)
+		hooks.runPost("aborted")
+		return
+	}
+	currentHooks = hooks
+	defer func() { currentHooks = nil }()
+
+	switch {
+	case imageFormat == imageFormatRawExt4:
+		err = createRawExt4Image(encryptedDiskPath, keyID, masterKey, now, listing)
+	case imageFormat == imageFormatISO:
+		err = createBootableISO(encryptedDiskPath, keyID, masterKey, now, listing)
+	case imageFormat == imageFormatSquashfs:
+		err = createSquashfsImage(encryptedDiskPath, keyID, masterKey, now, listing)
+	case useRepository:
+		repositoryFiles, err = createRepositorySnapshot(encryptedDiskPath, keyID, masterKey, now, plan, listing)
+	default:
+		err = createEncryptedArchive(encryptedDiskPath, keyID, masterKey, now, plan, listing)
+	}
+	if err != nil {
+		logError("Failed to create encrypted archive: %v", err)
+		hooks.runPost("failed")
 		return
 	}
+	hooks.runPost("success")
 
-	if err := os.Remove(isoPath); err != nil {
-		logError("Failed to remove ISO: %v", err)
+	// The signed manifest records the sidecar's digest, so it goes first
+	if sidecarPath, err := writeFileManifestSidecar(encryptedDiskPath, keyID, masterKey, listing); err != nil {
+		logError("Failed to write file manifest sidecar: %v", err)
+	} else {
+		logInfo("📋 File manifest of %d entries written: %s", len(listing.Entries), sidecarPath)
+	}
+
+	if manifestPath, err := writeSnapshotManifest(encryptedDiskPath, keyID, now, plan.parent()); err != nil {
+		// Without a manifest nothing can build on this snapshot, so the
+		// next incremental is taken against the previous one instead
+		logError("Failed to write signed manifest: %v", err)
+	} else {
+		logInfo("🖋️ Signed manifest written: %s", manifestPath)
+		if err := plan.commit(encryptedDiskPath); err != nil {
+			logError("Failed to save file index: %v", err)
+		}
 	}
 
 	logSectionStart("💽 Disk Image Stats")
 	getDiskImageStatsContent()
 	logSectionEnd()
 
-	checkRetentionPolicy()
+	if checkRetentionPolicy() > 0 {
+		collectRepositoryGarbage(masterKey)
+	}
 
-	uploadToCloud(encryptedDiskPath, diskImageName)
+	// Chunks go first, so the bucket never holds a tree with missing chunks
+	if len(repositoryFiles) > 0 && !uploadRepositoryToCloud(repositoryFiles) {
+		logError("Not uploading %s: some of its chunks are not in the bucket", diskImageName)
+	} else {
+		uploadToCloud(encryptedDiskPath, diskImageName)
+	}
 
-	if err := updateSnapshotInfoFile(diskImageName, encryptedDiskPath); err != nil {
+	if err := updateSnapshotInfoFile(diskImageName, encryptedDiskPath, plan.parent()); err != nil {
 		logError("Failed to update snapshot info file: %v", err)
 	}
 
@@ -91,8 +250,11 @@ func main() {
 
 func loadConfig() {
 	diskImageDir = "/app/disk_images"
-	keyDir := "/app/keys"
+	keyDir = "/app/keys"
 	keyFilename := "master.key"
+	keyMode = keyModeFile
+	unsealSocket = "/run/snapshot/unseal.sock"
+	snapshotInterval = time.Minute
 
 	// Default system paths
 	tempMountPoint = "/tmp/disk_mount"
@@ -108,13 +270,47 @@ func loadConfig() {
 	genisoimagePath = "genisoimage"
 	isolinuxLibPath = "/usr/lib/ISOLINUX"
 	syslinuxLibPath = "/usr/lib/syslinux/modules/bios"
-
-	// Default exclusions
+	mksquashfsPath = "mksquashfs"
+	pgDumpPath = "pg_dump"
+	mysqldumpPath = "mysqldump"
+	sqlite3Path = "sqlite3"
+	redisCliPath = "redis-cli"
+	btrfsPath = "btrfs"
+	lvmPath = "lvm"
+	sshPath = "ssh"
+
+	// Default image format
+	imageFormat = imageFormatTar
+	isoBootOptions = "boot=live components"
+
+	// Default compression
+	compressionCodec = compressionGzip
+	compressionLevel = defaultCompressionLevel
+
+	// Default incremental snapshots
+	fullSnapshotInterval = 24 * time.Hour
+
+	// Default remote hosts
+	remoteTarCommand = "tar"
+
+	// Default hooks
+	hookTimeout = 5 * time.Minute
+	hookFailurePolicy = hookPolicyAbort
+
+	// Default source: the whole root filesystem
+	snapshotSources = defaultSources()
+	sourceRules := make(map[string]map[string][]string)
+	databaseDumpTimeout = 30 * time.Minute
+	captureBackend = captureLive
+	dockerSocket = "/var/run/docker.sock"
+	databaseSettings := make(map[string]map[string]string)
+	remotePaths := make(map[string][]string)
+
+	// Default exclusions (DISK_IMAGE_DIR is always excluded)
 	excludePatterns = []string{
-		"--exclude=/proc/*", "--exclude=/sys/*", "--exclude=/dev/*",
-		"--exclude=/tmp/*", "--exclude=/var/tmp/*", "--exclude=/run/*",
-		"--exclude=/mnt/*", "--exclude=/media/*", "--exclude=/lost+found",
-		"--exclude=/app/disk_images/*",
+		"/proc/*", "/sys/*", "/dev/*",
+		"/tmp/*", "/var/tmp/*", "/run/*",
+		"/mnt/*", "/media/*", "/lost+found",
 	}
 
 	envFile := "/app/.env"
@@ -154,6 +350,29 @@ func loadConfig() {
 			if value != "" {
 				keyFilename = value
 			}
+		case "KEY_MODE":
+			if value == keyModeFile || value == keyModeSealed || value == keyModeRecipients {
+				keyMode = value
+			} else if value != "" {
+				logError("Unknown KEY_MODE %q, using %s", value, keyMode)
+			}
+		case "RECIPIENTS":
+			parsed, err := parseRecipients(value)
+			if err != nil {
+				logError("Ignoring RECIPIENTS: %v", err)
+			} else {
+				recipients = parsed
+			}
+		case "UNSEAL_SOCKET":
+			if value != "" {
+				unsealSocket = value
+			}
+		case "SNAPSHOT_INTERVAL":
+			if interval, err := time.ParseDuration(value); err == nil && interval > 0 {
+				snapshotInterval = interval
+			} else if value != "" {
+				logError("Invalid SNAPSHOT_INTERVAL %q, using %s", value, snapshotInterval)
+			}
 		// System paths
 		case "TEMP_MOUNT_POINT":
 			if value != "" {
@@ -200,16 +419,209 @@ func loadConfig() {
 			if value != "" {
 				syslinuxLibPath = value
 			}
+		case "MKSQUASHFS_PATH":
+			if value != "" {
+				mksquashfsPath = value
+			}
+		case "PG_DUMP_PATH":
+			if value != "" {
+				pgDumpPath = value
+			}
+		case "MYSQLDUMP_PATH":
+			if value != "" {
+				mysqldumpPath = value
+			}
+		case "SQLITE3_PATH":
+			if value != "" {
+				sqlite3Path = value
+			}
+		case "REDIS_CLI_PATH":
+			if value != "" {
+				redisCliPath = value
+			}
+		case "BTRFS_PATH":
+			if value != "" {
+				btrfsPath = value
+			}
+		case "LVM_PATH":
+			if value != "" {
+				lvmPath = value
+			}
+		case "SSH_PATH":
+			if value != "" {
+				sshPath = value
+			}
+		// Image format
+		case "IMAGE_FORMAT":
+			if isImageFormat(value) {
+				imageFormat = value
+			} else if value != "" {
+				logError("Unknown IMAGE_FORMAT %q, using %s", value, imageFormat)
+			}
+		case "RAW_IMAGE_SIZE_MB":
+			if size, err := strconv.Atoi(value); err == nil && size >= 0 {
+				rawImageSizeMB = size
+			} else if value != "" {
+				logError("Invalid RAW_IMAGE_SIZE_MB %q, sizing raw images from their content", value)
+			}
+		case "ISO_KERNEL":
+			isoKernel = value
+		case "ISO_INITRD":
+			isoInitrd = value
+		case "ISO_BOOT_OPTIONS":
+			if value != "" {
+				isoBootOptions = value
+			}
+		// Compression
+		case "COMPRESSION":
+			if isCompressionCodec(value) {
+				compressionCodec = value
+			} else if value != "" {
+				logError("Unknown COMPRESSION %q, using %s", value, compressionCodec)
+			}
+		case "COMPRESSION_LEVEL":
+			if level, err := strconv.Atoi(value); err == nil && level >= 0 {
+				compressionLevel = level
+			} else if value != "" {
+				logError("Invalid COMPRESSION_LEVEL %q, using the codec default", value)
+			}
+		case "COMPRESSION_THREADS":
+			if threads, err := strconv.Atoi(value); err == nil && threads >= 0 {
+				compressionThreads = threads
+			} else if value != "" {
+				logError("Invalid COMPRESSION_THREADS %q, using every CPU", value)
+			}
+		// Incremental snapshots
+		case "INCREMENTAL":
+			incrementalEnabled = strings.ToLower(value) == "true"
+		case "FULL_SNAPSHOT_INTERVAL":
+			if interval, err := time.ParseDuration(value); err == nil && interval > 0 {
+				fullSnapshotInterval = interval
+			} else if value != "" {
+				logError("Invalid FULL_SNAPSHOT_INTERVAL %q, using %s", value, fullSnapshotInterval)
+			}
+		// Deduplicated repository
+		case "REPOSITORY":
+			repositoryEnabled = strings.ToLower(value) == "true"
+		// Sources
+		case "SOURCES":
+			if value == "" {
+				break
+			}
+			if parsed, err := parseSources(value); err != nil {
+				logError("Ignoring SOURCES, archiving /: %v", err)
+			} else {
+				snapshotSources = parsed
+			}
+		case "CAPTURE_BACKEND":
+			if isCaptureBackend(value) {
+				captureBackend = value
+			} else if value != "" {
+				logError("Unknown CAPTURE_BACKEND %q, using %s", value, captureBackend)
+			}
+		// Docker volumes
+		case "DOCKER_SOCKET":
+			if value != "" {
+				dockerSocket = value
+			}
+		case "DOCKER_BACKUP_LABEL":
+			dockerBackupLabel = value
+		case "DOCKER_PAUSE_CONTAINERS":
+			dockerPauseContainers = strings.ToLower(value) == "true"
+		case "DATABASES":
+			if parsed, err := parseDatabases(value); err != nil {
+				logError("Ignoring DATABASES: %v", err)
+			} else {
+				databaseSources = parsed
+			}
+		case "DATABASE_DUMP_TIMEOUT":
+			if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+				databaseDumpTimeout = timeout
+			} else if value != "" {
+				logError("Invalid DATABASE_DUMP_TIMEOUT %q, using %s", value, databaseDumpTimeout)
+			}
+		// Remote hosts
+		case "REMOTE_HOSTS":
+			if parsed, err := parseRemoteHosts(value); err != nil {
+				logError("Ignoring REMOTE_HOSTS: %v", err)
+			} else {
+				remoteHosts = parsed
+			}
+		case "REMOTE_SSH_KEY":
+			remoteSSHKey = value
+		case "REMOTE_KNOWN_HOSTS":
+			remoteKnownHosts = value
+		case "REMOTE_TAR_COMMAND":
+			if value != "" {
+				remoteTarCommand = value
+			}
+		// Hooks
+		case "PRE_SNAPSHOT_HOOKS":
+			preSnapshotHooks = splitPatterns(value)
+		case "POST_SNAPSHOT_HOOKS":
+			postSnapshotHooks = splitPatterns(value)
+		case "HOOK_TIMEOUT":
+			if timeout, err := time.ParseDuration(value); err == nil && timeout > 0 {
+				hookTimeout = timeout
+			} else if value != "" {
+				logError("Invalid HOOK_TIMEOUT %q, using %s", value, hookTimeout)
+			}
+		case "HOOK_FAILURE_POLICY":
+			switch strings.ToLower(value) {
+			case hookPolicyAbort, hookPolicyContinue:
+				hookFailurePolicy = strings.ToLower(value)
+			case "":
+			default:
+				logError("Unknown HOOK_FAILURE_POLICY %q, using %s", value, hookFailurePolicy)
+			}
 		// Exclusions (rebuild the array if any exclusion is set)
 		case "EXCLUDE_PROC", "EXCLUDE_SYS", "EXCLUDE_DEV", "EXCLUDE_TMP",
 			"EXCLUDE_VAR_TMP", "EXCLUDE_RUN", "EXCLUDE_MNT", "EXCLUDE_MEDIA", "EXCLUDE_LOST_FOUND":
 			if value != "" {
 				updateExclusionPattern(key, value)
 			}
+		case "EXCLUDE_FILE":
+			excludeFile = value
+		default:
+			if name, kind, ok := sourceRuleKey(key); ok {
+				if sourceRules[name] == nil {
+					sourceRules[name] = make(map[string][]string)
+				}
+				sourceRules[name][kind] = splitPatterns(value)
+			} else if name, setting, ok := databaseSettingKey(key); ok {
+				if databaseSettings[name] == nil {
+					databaseSettings[name] = make(map[string]string)
+				}
+				databaseSettings[name][setting] = value
+			} else if name, ok := remotePathsKey(key); ok {
+				remotePaths[name] = splitPatterns(value)
+			}
+		}
+	}
+	applySourceRules(snapshotSources, sourceRules)
+	databaseSources = applyDatabaseSettings(databaseSources, databaseSettings)
+	applyRemotePaths(remoteHosts, remotePaths)
+
+	if excludeFile != "" {
+		if rules, err := loadExcludeFile(excludeFile); err != nil {
+			logError("Ignoring EXCLUDE_FILE: %v", err)
+		} else {
+			excludeRules = rules
 		}
 	}
 
+	if err := validateCompression(compressionCodec, compressionLevel); err != nil {
+		logError("Invalid COMPRESSION_LEVEL: %v, using the codec default", err)
+		compressionLevel = defaultCompressionLevel
+	}
+
 	keyFile = filepath.Join(keyDir, keyFilename)
+	if remoteSSHKey == "" {
+		remoteSSHKey = filepath.Join(keyDir, "remote_ssh_key")
+	}
+	if remoteKnownHosts == "" {
+		remoteKnownHosts = filepath.Join(keyDir, "remote_known_hosts")
+	}
 }
 
 func updateExclusionPattern(key, value string) {
@@ -220,88 +632,6 @@ func updateExclusionPattern(key, value string) {
 	}
 
 	if idx, exists := exclusionMap[key]; exists && idx < len(excludePatterns) {
-		excludePatterns[idx] = "--exclude=" + value
-	}
-}
-
-func createCompressedISO(isoPath string) error {
-	return createCompressedISOWithTime(isoPath, time.Now())
-}
-
-func createCompressedISOWithTime(isoPath string, now time.Time) error {
-	logInfo("Creating compressed ISO from filesystem...")
-
-	if err := os.MkdirAll(tempISODir, 0755); err != nil {
-		return err
-	}
-	defer os.RemoveAll(tempISODir)
-
-	args := append([]string{"rsync", "-aHAXx"}, excludePatterns...)
-	args = append(args, "/", tempISODir+"/")
-	cmd := exec.Command(args[0], args[1:]...)
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to copy filesystem: %v", err)
-	}
-
-	infoDir := filepath.Join(tempISODir, snapshotInfoDir)
-	if err := os.MkdirAll(infoDir, 0755); err != nil {
-		return err
+		excludePatterns[idx] = value
 	}
-
-	infoFile := filepath.Join(infoDir, diskImageInfoFile)
-	if file, err := os.Create(infoFile); err == nil {
-		fmt.Fprintf(file, "Last Snapshot Information\n")
-		fmt.Fprintf(file, "========================\n")
-		fmt.Fprintf(file, "Disk image created: %s\n", now.Format(time.RFC3339))
-		fmt.Fprintf(file, "Source: Container OS filesystem\n")
-		fmt.Fprintf(file, "Type: Compressed ISO (gzip)\n")
-		fmt.Fprintf(file, "Encryption: AES-256-GCM with Shamir Secret Sharing\n")
-		fmt.Fprintf(file, "\nTo restore:\n")
-		fmt.Fprintf(file, "1. Decrypt with 3 key shares\n")
-		fmt.Fprintf(file, "2. Decompress with gunzip\n")
-		fmt.Fprintf(file, "3. Mount ISO or use in VM\n")
-		file.Close()
-	}
-
-	bootDir := filepath.Join(tempISODir, "isolinux")
-	if err := os.MkdirAll(bootDir, 0755); err != nil {
-		return err
-	}
-
-	cmd = exec.Command("cp", filepath.Join(isolinuxLibPath, "isolinux.bin"), bootDir)
-	cmd.Run()
-	cmd = exec.Command("cp", filepath.Join(syslinuxLibPath, "ldlinux.c32"), bootDir)
-	cmd.Run()
-
-	cfgContent := `DEFAULT linux
-LABEL linux
-  KERNEL /boot/vmlinuz
-  APPEND root=/dev/sr0 ro
-`
-	os.WriteFile(filepath.Join(bootDir, "isolinux.cfg"), []byte(cfgContent), 0644)
-
-	cmd = exec.Command(genisoimagePath, "-o", tempISOFile, "-R", "-J", "-joliet-long", tempISODir)
-	if err := cmd.Run(); err != nil {
-		cmd = exec.Command(genisoimagePath, "-o", tempISOFile, "-R", tempISODir)
-		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to create ISO: %v", err)
-		}
-	}
-
-	cmd = exec.Command("gzip", "-c", tempISOFile)
-	outFile, err := os.Create(isoPath)
-	if err != nil {
-		return err
-	}
-	defer outFile.Close()
-
-	cmd.Stdout = outFile
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to compress ISO: %v", err)
-	}
-
-	os.Remove(tempISOFile)
-	logInfo("Compressed ISO created successfully")
-	return nil
 }
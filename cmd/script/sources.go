@@ -0,0 +1,160 @@
+package main
+
+// Snapshot sources.
+//
+// By default the whole root filesystem is archived, with archive names
+// relative to "/". SOURCES=name:path,... archives named trees instead, each
+// under its name in the archive (/srv/data as data/..., /etc as etc/...).
+// A source stays on the filesystem of its path, like rsync -x.
+//
+// Every source can have its own rules, SOURCE_<NAME>_EXCLUDE and
+// SOURCE_<NAME>_INCLUDE (comma-separated patterns, NAME upper-cased with -
+// as _; the default source is named "root"). Patterns starting with / match
+// the path relative to the source, others the file name. An include
+// pattern wins over the source's own excludes and the EXCLUDE_* patterns,
+// but as with rsync an excluded directory is not descended into, so its
+// content cannot be included back.
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+const defaultSourceName = "root"
+
+var sourceNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// snapshotSource is one tree archived by each snapshot.
+type snapshotSource struct {
+	Name    string
+	Path    string
+	Prefix  string // Archive name prefix: "" for the default source, else Name + "/"
+	Include []string
+	Exclude []string
+}
+
+// defaultSources archives the whole root filesystem.
+func defaultSources() []snapshotSource {
+	return []snapshotSource{{Name: defaultSourceName, Path: "/"}}
+}
+
+// parseSources parses SOURCES: "name:path,name:path".
+func parseSources(value string) ([]snapshotSource, error) {
+	var sources []snapshotSource
+	seen := make(map[string]bool)
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(entry, ":")
+		if !ok || !sourceNamePattern.MatchString(name) {
+			return nil, fmt.Errorf("invalid source %q, expected name:path with a lower-case name", entry)
+		}
+		if !filepath.IsAbs(path) {
+			return nil, fmt.Errorf("source %s: %q is not an absolute path", name, path)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("source %s is listed twice", name)
+		}
+		seen[name] = true
+		sources = append(sources, snapshotSource{Name: name, Path: filepath.Clean(path), Prefix: name + "/"})
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no sources listed")
+	}
+	return sources, nil
+}
+
+// sourceRuleKey splits SOURCE_<NAME>_INCLUDE and SOURCE_<NAME>_EXCLUDE
+// keys into the source name and the rule kind.
+func sourceRuleKey(key string) (name, kind string, ok bool) {
+	rest, ok := strings.CutPrefix(key, "SOURCE_")
+	if !ok {
+		return "", "", false
+	}
+	for _, kind := range []string{"INCLUDE", "EXCLUDE"} {
+		if name, ok := strings.CutSuffix(rest, "_"+kind); ok && name != "" {
+			return name, kind, true
+		}
+	}
+	return "", "", false
+}
+
+// applySourceRules attaches the rules read from SOURCE_<NAME>_* keys, by
+// upper-cased name, and reports rules naming no source.
+func applySourceRules(sources []snapshotSource, rules map[string]map[string][]string) {
+	for i := range sources {
+		key := strings.ToUpper(strings.ReplaceAll(sources[i].Name, "-", "_"))
+		sources[i].Include = rules[key]["INCLUDE"]
+		sources[i].Exclude = rules[key]["EXCLUDE"]
+		delete(rules, key)
+	}
+	for name := range rules {
+		logError("Ignoring SOURCE_%s_* rules: no such source", name)
+	}
+}
+
+// splitPatterns splits a comma-separated list of patterns or commands.
+func splitPatterns(value string) []string {
+	var patterns []string
+	for _, pattern := range strings.Split(value, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// archiveName is the archive name of a path of the source, without the
+// trailing slash of directories; the source path itself is the prefix.
+func (s *snapshotSource) archiveName(path string) string {
+	rel, err := filepath.Rel(s.Path, path)
+	if err != nil {
+		return path
+	}
+	if rel == "." {
+		return strings.TrimSuffix(s.Prefix, "/")
+	}
+	return s.Prefix + filepath.ToSlash(rel)
+}
+
+// matchSourcePattern matches a source rule against path, relative to the
+// source for patterns starting with /, else against the file name.
+func (s *snapshotSource) matchSourcePattern(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		subject := filepath.Base(path)
+		if strings.HasPrefix(pattern, "/") {
+			rel, err := filepath.Rel(s.Path, path)
+			if err != nil {
+				continue
+			}
+			subject = "/" + filepath.ToSlash(rel)
+		}
+		if matched, _ := filepath.Match(pattern, subject); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// describeSources lists the sources for info files.
+func describeSources(sources []snapshotSource) []string {
+	var lines []string
+	for _, s := range sources {
+		line := fmt.Sprintf("%s (%s)", s.Name, s.Path)
+		if s.Prefix != "" {
+			line += " as " + s.Prefix
+		}
+		if len(s.Include) > 0 {
+			line += ", include " + strings.Join(s.Include, " ")
+		}
+		if len(s.Exclude) > 0 {
+			line += ", exclude " + strings.Join(s.Exclude, " ")
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
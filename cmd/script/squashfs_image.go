@@ -0,0 +1,72 @@
+package main
+
+// SquashFS images (IMAGE_FORMAT=squashfs).
+//
+// The root filesystem is staged and packed with mksquashfs, which
+// compresses each block on its own with the COMPRESSION codec, level and
+// threads. The image is encrypted without further compression, so a
+// decrypted snapshot is a .squashfs that can be loop-mounted read-only and
+// browsed straight away, reading only the blocks it needs. SquashFS images
+// are always full snapshots, and are also the root filesystem of bootable
+// ISOs.
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// createSquashfsImage packs the root filesystem into a squashfs image and
+// encrypts it to encryptedPath.
+func createSquashfsImage(encryptedPath, keyID string, key []byte, now time.Time, listing *fileManifest) error {
+	imagePath := filepath.Join(tempMountPoint, "disk_image.squashfs")
+	defer os.Remove(imagePath)
+	if err := makeSquashfsImage(imagePath, now, listing); err != nil {
+		return err
+	}
+	return encryptImageFile(imagePath, encryptedPath, keyID, key, false)
+}
+
+// makeSquashfsImage stages the root filesystem and packs it into a
+// squashfs image at path, keeping owners, modes, times and extended
+// attributes.
+func makeSquashfsImage(path string, now time.Time, listing *fileManifest) error {
+	staging, _, err := stageFilesystem(now, listing)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	args := append([]string{staging, path, "-noappend", "-no-progress", "-xattrs"}, squashfsCompressionArgs()...)
+	logInfo("Packing root filesystem into %s (%s compression, %d threads)...",
+		filepath.Base(path), compressionCodec, compressionThreadCount())
+	cmd := exec.Command(mksquashfsPath, args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", mksquashfsPath, err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// squashfsCompressionArgs maps COMPRESSION, COMPRESSION_LEVEL and
+// COMPRESSION_THREADS to mksquashfs options. mksquashfs has no level for
+// xz, so the level is only passed for gzip and zstd.
+func squashfsCompressionArgs() []string {
+	args := []string{"-processors", strconv.Itoa(compressionThreadCount())}
+	if compressionCodec == compressionNone {
+		return append(args, "-noI", "-noD", "-noF", "-noX")
+	}
+
+	args = append(args, "-comp", compressionCodec)
+	if compressionLevel != defaultCompressionLevel && compressionCodec != compressionXz {
+		args = append(args, "-Xcompression-level", strconv.Itoa(compressionLevel))
+	}
+	return args
+}
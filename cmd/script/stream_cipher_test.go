@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, dataKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func testPlaintext(t *testing.T, n int) []byte {
+	t.Helper()
+	plaintext := make([]byte, n)
+	if _, err := rand.Read(plaintext); err != nil {
+		t.Fatal(err)
+	}
+	return plaintext
+}
+
+// sealTestStream encrypts plaintext with key and returns the file and the
+// offset of its first segment.
+func sealTestStream(t *testing.T, plaintext, key []byte) ([]byte, int) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := encryptStream(&buf, bytes.NewReader(plaintext), "g1", key, nil, compressionZstd, -1); err != nil {
+		t.Fatal(err)
+	}
+
+	segments := (len(plaintext) + streamSegmentSize - 1) / streamSegmentSize
+	if segments == 0 {
+		segments = 1
+	}
+	return buf.Bytes(), buf.Len() - len(plaintext) - segments*streamTagSize
+}
+
+func decryptTestStream(data, key []byte) ([]byte, error) {
+	var out bytes.Buffer
+	_, err := decryptStreamTo(&out, bytes.NewReader(data), key)
+	return out.Bytes(), err
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, n := range []int{0, 1, streamSegmentSize - 1, streamSegmentSize, streamSegmentSize + 1, 3*streamSegmentSize + 7} {
+		plaintext := testPlaintext(t, n)
+		data, start := sealTestStream(t, plaintext, key)
+
+		header, err := describeSnapshotFile(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if header.Version != streamVersion || header.Compression != compressionZstd || header.ChunkSize != streamSegmentSize {
+			t.Fatalf("%d bytes: unexpected header %+v", n, header)
+		}
+
+		_, size, header, err := digestSnapshot(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		segments := size - int64(len(header.aad))
+		if segments != int64(len(data)-start) || segmentsPlaintextSize(segments, header.ChunkSize) != int64(n) {
+			t.Fatalf("%d bytes: manifest covers %d bytes of segments", n, segments)
+		}
+
+		got, err := decryptTestStream(data, key)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Fatalf("%d bytes: decrypted plaintext differs", n)
+		}
+	}
+}
+
+func TestStreamWrongKey(t *testing.T) {
+	data, _ := sealTestStream(t, testPlaintext(t, 100), testKey(t))
+	if _, err := decryptTestStream(data, testKey(t)); err == nil {
+		t.Fatal("decrypted with the wrong key")
+	}
+}
+
+func TestStreamTruncated(t *testing.T) {
+	key := testKey(t)
+	data, start := sealTestStream(t, testPlaintext(t, 2*streamSegmentSize+100), key)
+	sealed := streamSegmentSize + streamTagSize
+
+	cuts := map[string]int{
+		"no segments":          start,
+		"after first segment":  start + sealed,
+		"after second segment": start + 2*sealed,
+		"inside a segment":     start + sealed + 10,
+		"inside a tag":         start + streamTagSize/2,
+		"last byte":            len(data) - 1,
+	}
+	for name, cut := range cuts {
+		if _, err := decryptTestStream(data[:cut], key); err == nil {
+			t.Errorf("%s: truncated stream decrypted", name)
+		}
+	}
+}
+
+func TestStreamTampered(t *testing.T) {
+	key := testKey(t)
+	data, start := sealTestStream(t, testPlaintext(t, 2*streamSegmentSize+100), key)
+	sealed := streamSegmentSize + streamTagSize
+
+	flip := func(offset int) []byte {
+		tampered := append([]byte(nil), data...)
+		tampered[offset] ^= 0x01
+		return tampered
+	}
+	swapped := append([]byte(nil), data...)
+	copy(swapped[start:], data[start+sealed:start+2*sealed])
+	copy(swapped[start+sealed:], data[start:start+sealed])
+
+	cases := map[string][]byte{
+		"header":         flip(len(streamMagic) + 8),
+		"first segment":  flip(start),
+		"last tag":       flip(len(data) - 1),
+		"swapped":        swapped,
+		"extra segment":  append(append([]byte(nil), data[:start+2*sealed]...), data[start+sealed:]...),
+		"final repeated": append(append([]byte(nil), data...), data[start+2*sealed:]...),
+	}
+	for name, tampered := range cases {
+		if _, err := decryptTestStream(tampered, key); err == nil {
+			t.Errorf("%s: tampered stream decrypted", name)
+		}
+	}
+}
+
+func TestStreamPlaintextSizeMismatch(t *testing.T) {
+	key := testKey(t)
+	var buf bytes.Buffer
+	err := sealStream(&buf, bytes.NewReader(testPlaintext(t, 100)), "g1", key, nil, "", time.Now(), 99)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptTestStream(buf.Bytes(), key); err == nil {
+		t.Fatal("decrypted a stream whose size does not match its header")
+	}
+}
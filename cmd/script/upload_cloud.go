@@ -5,13 +5,16 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // CloudConfig holds S3 Object Storage configuration
@@ -49,6 +52,158 @@ func uploadToCloud(localPath, diskImageName string) {
 	logInfo("✅ Successfully uploaded to S3: s3://%s/%s", config.BucketName, buildS3Key(config.BucketPrefix, localPath, diskImageName))
 }
 
+// uploadRepositoryToCloud uploads new repository files (chunks and the
+// repository key) under <prefix>/repository, mirroring DISK_IMAGE_DIR, and
+// reports whether they all made it.
+func uploadRepositoryToCloud(paths []string) bool {
+	config := getCloudConfig()
+	if !config.Enabled {
+		return true
+	}
+
+	client, err := newS3Client(config)
+	if err != nil {
+		logError("Failed to upload repository chunks to S3: %v", err)
+		return false
+	}
+
+	logInfo("☁️ Uploading %d new repository files to S3...", len(paths))
+	ok := true
+	for _, path := range paths {
+		rel, err := filepath.Rel(diskImageDir, path)
+		if err != nil {
+			logError("Failed to upload %s to S3: %v", path, err)
+			ok = false
+			continue
+		}
+		key := filepath.Join(config.BucketPrefix, rel)
+
+		file, err := os.Open(path)
+		if err != nil {
+			logError("Failed to upload %s to S3: %v", path, err)
+			ok = false
+			continue
+		}
+		_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+			Bucket: aws.String(config.BucketName),
+			Key:    aws.String(key),
+			Body:   file,
+		})
+		file.Close()
+		if err != nil {
+			logError("Failed to upload %s to S3: %v", path, err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// collectCloudRepositoryGarbage removes the chunks under <prefix>/repository
+// that neither a local tree (referenced) nor a tree in the bucket refers to.
+// As locally, chunks uploaded within chunkGracePeriod are kept, and so are
+// chunks the local repository still holds: a snapshot reusing them does not
+// upload them again. A tree that cannot be read stops the collection.
+func collectCloudRepositoryGarbage(referenced map[string]bool, keys *keyringKeys) {
+	config := getCloudConfig()
+	if !config.Enabled {
+		return
+	}
+
+	client, err := newS3Client(config)
+	if err != nil {
+		logError("S3 repository garbage collection aborted: %v", err)
+		return
+	}
+
+	logInfo("🧩 Collecting unreferenced repository chunks in S3...")
+
+	chunksPrefix := path.Join(config.BucketPrefix, repositoryDirName, "chunks") + "/"
+	input := &s3.ListObjectsV2Input{Bucket: aws.String(config.BucketName)}
+	if config.BucketPrefix != "" {
+		input.Prefix = aws.String(config.BucketPrefix + "/")
+	}
+	var treeKeys []string
+	var chunks []types.Object
+	paginator := s3.NewListObjectsV2Paginator(client, input)
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(context.TODO())
+		if err != nil {
+			logError("S3 repository garbage collection aborted: %v", err)
+			return
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			switch {
+			case strings.HasPrefix(key, chunksPrefix):
+				chunks = append(chunks, object)
+			case isTreeFile(path.Base(key)):
+				treeKeys = append(treeKeys, key)
+			}
+		}
+	}
+
+	cloudReferenced := make(map[string]bool, len(referenced))
+	for id := range referenced {
+		cloudReferenced[id] = true
+	}
+	for _, key := range treeKeys {
+		output, err := client.GetObject(context.TODO(), &s3.GetObjectInput{
+			Bucket: aws.String(config.BucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			logError("S3 repository garbage collection aborted: %s: %v", key, err)
+			return
+		}
+		tree, err := readTree(output.Body, keys)
+		output.Body.Close()
+		if err != nil {
+			logError("S3 repository garbage collection aborted: %s: %v", key, err)
+			return
+		}
+		for _, ref := range tree.Chunks {
+			cloudReferenced[ref.ID] = true
+		}
+		wipe(tree.Secret)
+	}
+
+	cutoff := time.Now().Add(-chunkGracePeriod)
+	var garbage []types.ObjectIdentifier
+	var freed int64
+	for _, object := range chunks {
+		id := path.Base(aws.ToString(object.Key))
+		if cloudReferenced[id] || aws.ToTime(object.LastModified).After(cutoff) {
+			continue
+		}
+		if _, err := os.Stat(chunkPath(repositoryDir(), id)); err == nil {
+			continue
+		}
+		garbage = append(garbage, types.ObjectIdentifier{Key: object.Key})
+		freed += aws.ToInt64(object.Size)
+	}
+
+	removed := 0
+	for len(garbage) > 0 {
+		batch := garbage[:min(len(garbage), 1000)] // DeleteObjects limit
+		garbage = garbage[len(batch):]
+		output, err := client.DeleteObjects(context.TODO(), &s3.DeleteObjectsInput{
+			Bucket: aws.String(config.BucketName),
+			Delete: &types.Delete{Objects: batch, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			logError("Failed to remove S3 chunks: %v", err)
+			continue
+		}
+		removed += len(batch) - len(output.Errors)
+		for _, failure := range output.Errors {
+			logError("Failed to remove S3 chunk %s: %s", aws.ToString(failure.Key), aws.ToString(failure.Message))
+		}
+	}
+
+	logInfo("🧩 %d trees in S3, removed %d unreferenced chunks from s3://%s/%s (about %.2f MB freed)",
+		len(treeKeys), removed, config.BucketName, chunksPrefix, float64(freed)/1024/1024)
+}
+
 func getCloudConfig() CloudConfig {
 	config := CloudConfig{
 		Enabled:      defaultS3Enabled,
@@ -103,18 +258,15 @@ func getCloudConfig() CloudConfig {
 		}
 	}
 
+	// Pulled hosts get their own prefix, as in DISK_IMAGE_DIR
+	if pulledHost != nil {
+		config.BucketPrefix = filepath.Join(config.BucketPrefix, pulledHost.Name)
+	}
+
 	return config
 }
 
 func uploadToS3(cfg CloudConfig, localPath, diskImageName string) error {
-	// Validate configuration
-	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
-		return fmt.Errorf("S3 credentials are not configured")
-	}
-	if cfg.BucketName == "" {
-		return fmt.Errorf("S3 bucket name is not configured")
-	}
-
 	// Open the file to upload
 	file, err := os.Open(localPath)
 	if err != nil {
@@ -128,6 +280,83 @@ func uploadToS3(cfg CloudConfig, localPath, diskImageName string) error {
 		return fmt.Errorf("failed to get file info: %v", err)
 	}
 
+	client, err := newS3Client(cfg)
+	if err != nil {
+		return err
+	}
+
+	// Build S3 key (path in bucket) maintaining the year/day/month/hour structure
+	s3Key := buildS3Key(cfg.BucketPrefix, localPath, diskImageName+".encrypted")
+
+	// Upload file to S3
+	logInfo("Uploading %s (%d bytes) to s3://%s/%s", diskImageName, fileInfo.Size(), cfg.BucketName, s3Key)
+
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(cfg.BucketName),
+		Key:    aws.String(s3Key),
+		Body:   file,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload to S3: %v", err)
+	}
+
+	// The signed manifest goes next to the snapshot so the bucket copy can
+	// be verified too
+	manifestPath := manifestPathFor(localPath)
+	manifest, err := os.Open(manifestPath)
+	if os.IsNotExist(err) {
+		logError("No signed manifest for %s, uploading the snapshot alone", diskImageName)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %v", err)
+	}
+	defer manifest.Close()
+
+	manifestKey := buildS3Key(cfg.BucketPrefix, localPath, diskImageName+manifestSuffix)
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(cfg.BucketName),
+		Key:    aws.String(manifestKey),
+		Body:   manifest,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload manifest to S3: %v", err)
+	}
+	logInfo("Uploaded signed manifest to s3://%s/%s", cfg.BucketName, manifestKey)
+
+	sidecar, err := os.Open(fileManifestPathFor(localPath))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open file manifest: %v", err)
+	}
+	defer sidecar.Close()
+
+	sidecarKey := buildS3Key(cfg.BucketPrefix, localPath, diskImageName+fileManifestSuffix)
+	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
+		Bucket: aws.String(cfg.BucketName),
+		Key:    aws.String(sidecarKey),
+		Body:   sidecar,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload file manifest to S3: %v", err)
+	}
+	logInfo("Uploaded file manifest to s3://%s/%s", cfg.BucketName, sidecarKey)
+
+	return nil
+}
+
+// newS3Client creates a client for the configured OVH S3 endpoint.
+func newS3Client(cfg CloudConfig) (*s3.Client, error) {
+	// Validate configuration
+	if cfg.AccessKeyID == "" || cfg.SecretAccessKey == "" {
+		return nil, fmt.Errorf("S3 credentials are not configured")
+	}
+	if cfg.BucketName == "" {
+		return nil, fmt.Errorf("S3 bucket name is not configured")
+	}
+
 	// Create AWS config with custom endpoint resolver for OVH
 	customResolver := aws.EndpointResolverWithOptionsFunc(func(service, region string, options ...interface{}) (aws.Endpoint, error) {
 		return aws.Endpoint{
@@ -147,28 +376,10 @@ func uploadToS3(cfg CloudConfig, localPath, diskImageName string) error {
 		)),
 	)
 	if err != nil {
-		return fmt.Errorf("failed to load AWS config: %v", err)
-	}
-
-	// Create S3 client
-	client := s3.NewFromConfig(awsConfig)
-
-	// Build S3 key (path in bucket) maintaining the year/day/month/hour structure
-	s3Key := buildS3Key(cfg.BucketPrefix, localPath, diskImageName+".encrypted")
-
-	// Upload file to S3
-	logInfo("Uploading %s (%d bytes) to s3://%s/%s", diskImageName, fileInfo.Size(), cfg.BucketName, s3Key)
-
-	_, err = client.PutObject(context.TODO(), &s3.PutObjectInput{
-		Bucket: aws.String(cfg.BucketName),
-		Key:    aws.String(s3Key),
-		Body:   file,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to upload to S3: %v", err)
+		return nil, fmt.Errorf("failed to load AWS config: %v", err)
 	}
 
-	return nil
+	return s3.NewFromConfig(awsConfig), nil
 }
 
 func buildS3Key(prefix, localPath, filename string) string {
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+)
+
+// listXattrs returns the extended attributes of path, including the
+// system.posix_acl_* attributes that hold its ACLs.
+func listXattrs(path string) (map[string]string, error) {
+	size, err := syscall.Listxattr(path, nil)
+	if err != nil || size == 0 {
+		if errors.Is(err, syscall.ENOTSUP) {
+			err = nil
+		}
+		return nil, err
+	}
+
+	names := make([]byte, size)
+	if size, err = syscall.Listxattr(path, names); err != nil {
+		return nil, err
+	}
+
+	xattrs := make(map[string]string)
+	for _, name := range bytes.Split(names[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		valueSize, err := syscall.Getxattr(path, string(name), nil)
+		if err != nil {
+			return nil, err
+		}
+		value := make([]byte, valueSize)
+		if valueSize, err = syscall.Getxattr(path, string(name), value); err != nil {
+			return nil, err
+		}
+		xattrs[string(name)] = string(value[:valueSize])
+	}
+	return xattrs, nil
+}
+
+// setXattr sets one extended attribute, POSIX ACLs included.
+func setXattr(path, name, value string) error {
+	return syscall.Setxattr(path, name, []byte(value), 0)
+}
+
+// dataRegions lists the parts of a file that hold data, using SEEK_DATA and
+// SEEK_HOLE. The file offset is left at the start.
+func dataRegions(file *os.File, size int64) ([]sparseRegion, error) {
+	defer file.Seek(0, io.SeekStart)
+
+	var regions []sparseRegion
+	var offset int64
+	for offset < size {
+		start, err := file.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			break // Only a hole is left
+		}
+		if err != nil {
+			return nil, err
+		}
+		end, err := file.Seek(start, seekHole)
+		if err != nil {
+			return nil, err
+		}
+		if end > size {
+			end = size
+		}
+		regions = append(regions, sparseRegion{offset: start, length: end - start})
+		offset = end
+	}
+
+	// A trailing hole still needs a final (empty) region so readers know
+	// the real end of the file
+	if len(regions) == 0 || regions[len(regions)-1].offset+regions[len(regions)-1].length < size {
+		regions = append(regions, sparseRegion{offset: size, length: 0})
+	}
+	return regions, nil
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// Extended attributes, ACLs and SEEK_DATA/SEEK_HOLE are only read on Linux;
+// elsewhere files are archived without attributes and sparse files in full.
+var errXattrUnsupported = errors.New("extended attributes are only supported on Linux")
+
+// listXattrs archives no extended attributes outside Linux.
+func listXattrs(path string) (map[string]string, error) {
+	return nil, nil
+}
+
+// setXattr sets one extended attribute, POSIX ACLs included.
+func setXattr(path, name, value string) error {
+	return errXattrUnsupported
+}
+
+// dataRegions cannot find holes outside Linux; the caller copies the whole
+// file instead.
+func dataRegions(file *os.File, size int64) ([]sparseRegion, error) {
+	return nil, errors.New("sparse file regions are only supported on Linux")
+}
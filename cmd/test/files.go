@@ -0,0 +1,357 @@
+package main
+
+// File manifest commands.
+//
+// 'decrypt files' searches the file manifest of a snapshot, 'decrypt
+// files-diff' compares those of two snapshots and 'decrypt files-verify'
+// checks a directory, a restored tree or the live filesystem, against one.
+// They only read the small <name>.files.encrypted sidecar, checked against
+// the signed manifest, so the snapshot itself does not need to be at hand.
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func runFiles() {
+	fmt.Println("📋 File manifest search")
+
+	listing, key, ok := openFileManifestInteractive("Enter snapshot file path: ", nil)
+	if !ok {
+		return
+	}
+	wipe(key)
+
+	fmt.Print("Pattern (glob on the path or name, empty for all): ")
+	var pattern string
+	fmt.Scanln(&pattern)
+	pattern = strings.Trim(strings.TrimSpace(pattern), "/")
+
+	matched := 0
+	var size int64
+	for _, entry := range listing.Entries {
+		if !matchEntry(entry.Path, pattern) {
+			continue
+		}
+		matched++
+		size += entry.Size
+		fmt.Println(formatEntry(entry))
+	}
+	fmt.Printf("%s✅ %d of %d entries match (%.2f MB)%s\n", ColorGreen, matched, len(listing.Entries), float64(size)/1024/1024, ColorReset)
+}
+
+func runFilesDiff() {
+	fmt.Println("📋 File manifest comparison")
+
+	older, key, ok := openFileManifestInteractive("Enter older snapshot file path: ", nil)
+	if !ok {
+		return
+	}
+	defer wipe(key)
+	newer, newerKey, ok := openFileManifestInteractive("Enter newer snapshot file path: ", key)
+	if !ok {
+		return
+	}
+	wipe(newerKey)
+
+	before := make(map[string]fileManifestEntry, len(older.Entries))
+	for _, entry := range older.Entries {
+		before[entry.Path] = entry
+	}
+	added, changed := 0, 0
+	for _, entry := range newer.Entries {
+		previous, ok := before[entry.Path]
+		delete(before, entry.Path)
+		if !ok {
+			added++
+			fmt.Printf("%s+ %s%s\n", ColorGreen, formatEntry(entry), ColorReset)
+			continue
+		}
+		if reasons := entryDifferences(previous, entry); len(reasons) > 0 {
+			changed++
+			fmt.Printf("%s~ %s (%s)%s\n", ColorYellow, entry.Path, strings.Join(reasons, ", "), ColorReset)
+		}
+	}
+	removed := make([]string, 0, len(before))
+	for name := range before {
+		removed = append(removed, name)
+	}
+	sort.Strings(removed)
+	for _, name := range removed {
+		fmt.Printf("%s- %s%s\n", ColorRed, formatEntry(before[name]), ColorReset)
+	}
+
+	fmt.Printf("📊 %d added, %d removed, %d changed\n", added, len(removed), changed)
+	fmt.Println("   Incremental snapshots only list the entries they archived; entries they")
+	fmt.Println("   did not archive show up as removed.")
+}
+
+func runFilesVerify() {
+	fmt.Println("📋 File manifest verification")
+
+	listing, key, ok := openFileManifestInteractive("Enter snapshot file path: ", nil)
+	if !ok {
+		return
+	}
+	wipe(key)
+
+	fmt.Print("Directory to verify (the restore target, or / for this host): ")
+	var root string
+	fmt.Scanln(&root)
+	root = strings.TrimSpace(root)
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		fmt.Printf("%s❌ %s is not a directory%s\n", ColorRed, root, ColorReset)
+		return
+	}
+
+	entries := make(map[string]fileManifestEntry, len(listing.Entries))
+	for _, entry := range listing.Entries {
+		entries[entry.Path] = entry
+	}
+	verified, missing, differing := 0, 0, 0
+	for _, want := range listing.Entries {
+		// A hard link is expected to hold the content of the entry it shares
+		if target, ok := entries[want.Link]; ok && want.Type == "hardlink" {
+			want.Type, want.Size, want.SHA256, want.Link = target.Type, target.Size, target.SHA256, ""
+		}
+		got, err := diskEntry(filepath.Join(root, filepath.FromSlash(want.Path)), want.Type == "file")
+		if os.IsNotExist(err) {
+			missing++
+			fmt.Printf("%s- %s: missing%s\n", ColorRed, want.Path, ColorReset)
+			continue
+		}
+		if err != nil {
+			differing++
+			fmt.Printf("%s❌ %s: %v%s\n", ColorRed, want.Path, err, ColorReset)
+			continue
+		}
+		if reasons := entryDifferences(want, got); len(reasons) > 0 {
+			differing++
+			fmt.Printf("%s~ %s (%s)%s\n", ColorYellow, want.Path, strings.Join(reasons, ", "), ColorReset)
+			continue
+		}
+		verified++
+	}
+
+	if missing == 0 && differing == 0 {
+		fmt.Printf("%s✅ All %d entries match the file manifest%s\n", ColorGreen, verified, ColorReset)
+		return
+	}
+	fmt.Printf("%s❌ %d entries match, %d differ, %d are missing%s\n", ColorRed, verified, differing, missing, ColorReset)
+}
+
+// openFileManifestInteractive asks for a snapshot, or its sidecar, checks
+// the sidecar against the signed manifest and decrypts it. key is tried
+// first, so that comparing two snapshots of one key asks for it once; the
+// key that opened the sidecar is returned.
+func openFileManifestInteractive(prompt string, key []byte) (*fileManifest, []byte, bool) {
+	fmt.Print(prompt)
+	var filePath string
+	fmt.Scanln(&filePath)
+	filePath = strings.TrimSpace(filePath)
+	if isFileManifest(filePath) {
+		filePath = strings.TrimSuffix(filePath, fileManifestSuffix) + ".encrypted"
+	}
+
+	sidecar := fileManifestPathFor(filePath)
+	if _, err := os.Stat(sidecar); err != nil {
+		fmt.Printf("%s❌ No file manifest found at %s (snapshots taken before file manifests have none)%s\n", ColorRed, sidecar, ColorReset)
+		return nil, nil, false
+	}
+	if !checkFileManifest(filePath) {
+		return nil, nil, false
+	}
+
+	header, err := readHeaderFromFile(sidecar)
+	if err != nil {
+		fmt.Printf("%s❌ Invalid file manifest header: %v%s\n", ColorRed, err, ColorReset)
+		return nil, nil, false
+	}
+	if key == nil || !keyOpens(header, key) {
+		if key, err = readKey(header, keyOptionsFor(header)); err != nil {
+			return nil, nil, false
+		}
+	}
+
+	listing, err := decryptFileManifest(sidecar, header, key)
+	if err != nil {
+		fmt.Printf("%s❌ Cannot read the file manifest: %v%s\n", ColorRed, err, ColorReset)
+		return nil, nil, false
+	}
+	fmt.Printf("📋 %s: %d entries, taken %s\n", listing.Snapshot, len(listing.Entries), listing.CreatedAt.Format("2006-01-02 15:04:05 MST"))
+	return listing, key, true
+}
+
+// checkFileManifest verifies the sidecar of a snapshot against its signed
+// manifest, with the same leniency as checkSnapshotManifest.
+func checkFileManifest(snapshotPath string) bool {
+	publicKey, err := loadSigningPublicKey(keyDir)
+	if err == nil {
+		data, rerr := os.ReadFile(manifestPathFor(snapshotPath))
+		if rerr == nil {
+			manifest, verr := openManifest(data, publicKey)
+			if verr == nil && manifest.File != filepath.Base(snapshotPath) {
+				verr = fmt.Errorf("manifest describes %s, not %s", manifest.File, filepath.Base(snapshotPath))
+			}
+			if verr == nil {
+				verr = verifyFileManifest(snapshotPath, manifest)
+			}
+			if verr == nil {
+				fmt.Printf("%s🖋️ File manifest verified: signed by %s on %s%s\n", ColorGreen, keyFingerprint(publicKey), manifest.Hostname, ColorReset)
+				return true
+			}
+			fmt.Printf("%s❌ File manifest verification failed: %v%s\n", ColorRed, verr, ColorReset)
+			return false
+		}
+		fmt.Printf("%s⚠️  No signed manifest found at %s%s\n", ColorYellow, manifestPathFor(snapshotPath), ColorReset)
+	} else {
+		fmt.Printf("%s⚠️  Cannot load signing public key: %v%s\n", ColorYellow, err, ColorReset)
+	}
+
+	fmt.Print("Continue without provenance check? (y/N): ")
+	var answer string
+	fmt.Scanln(&answer)
+	return strings.EqualFold(strings.TrimSpace(answer), "y")
+}
+
+// decryptFileManifest decrypts, decompresses and decodes a sidecar.
+func decryptFileManifest(path string, header *snapshotHeader, key []byte) (*fileManifest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := decryptStreamTo(pw, file, key)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	plain, err := newDecompressor(pr, snapshotCompression(header))
+	if err != nil {
+		return nil, err
+	}
+	defer plain.Close()
+	return readFileManifest(plain)
+}
+
+// matchEntry matches pattern against the whole path or, for patterns
+// without a slash, any of its names. A pattern without glob characters
+// matches as a substring.
+func matchEntry(name, pattern string) bool {
+	if pattern == "" {
+		return true
+	}
+	if !strings.ContainsAny(pattern, "*?[") {
+		return strings.Contains(name, pattern)
+	}
+	if ok, _ := path.Match(pattern, name); ok {
+		return true
+	}
+	if strings.Contains(pattern, "/") {
+		return false
+	}
+	for _, part := range strings.Split(name, "/") {
+		if ok, _ := path.Match(pattern, part); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func formatEntry(entry fileManifestEntry) string {
+	owner := fmt.Sprintf("%d:%d", entry.UID, entry.GID)
+	if entry.User != "" && entry.Group != "" {
+		owner = entry.User + ":" + entry.Group
+	}
+	line := fmt.Sprintf("%-8s %s %-15s %12d %s %s", entry.Type, entry.Mode, owner, entry.Size, entry.MTime.Local().Format("2006-01-02 15:04"), entry.Path)
+	switch {
+	case entry.Type == "symlink":
+		line += " -> " + entry.Link
+	case entry.Type == "hardlink":
+		line += " => " + entry.Link
+	case entry.SHA256 != "":
+		line += "  sha256:" + entry.SHA256[:min(16, len(entry.SHA256))]
+	}
+	return line
+}
+
+// entryDifferences lists what differs between two descriptions of a path.
+func entryDifferences(want, got fileManifestEntry) []string {
+	if want.Type != got.Type {
+		return []string{fmt.Sprintf("%s, was %s", got.Type, want.Type)}
+	}
+	var reasons []string
+	if want.SHA256 != got.SHA256 {
+		reasons = append(reasons, "content")
+	}
+	if want.Size != got.Size {
+		reasons = append(reasons, fmt.Sprintf("size %d, was %d", got.Size, want.Size))
+	}
+	if want.Link != got.Link {
+		reasons = append(reasons, fmt.Sprintf("target %s, was %s", got.Link, want.Link))
+	}
+	if want.Mode != got.Mode {
+		reasons = append(reasons, fmt.Sprintf("mode %s, was %s", got.Mode, want.Mode))
+	}
+	if want.UID != got.UID || want.GID != got.GID {
+		reasons = append(reasons, fmt.Sprintf("owner %d:%d, was %d:%d", got.UID, got.GID, want.UID, want.GID))
+	}
+	// Directories change mtime whenever their content does
+	if !want.MTime.Equal(got.MTime) && want.Type != "dir" {
+		reasons = append(reasons, "mtime")
+	}
+	return reasons
+}
+
+// diskEntry describes a path on disk as the snapshot would have listed it,
+// hashing regular files when hash is set.
+func diskEntry(name string, hash bool) (fileManifestEntry, error) {
+	info, err := os.Lstat(name)
+	if err != nil {
+		return fileManifestEntry{}, err
+	}
+	link := ""
+	if info.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(name); err != nil {
+			return fileManifestEntry{}, err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return fileManifestEntry{}, err
+	}
+
+	sum := ""
+	if hash && hdr.Typeflag == tar.TypeReg {
+		if sum, err = hashFile(name); err != nil {
+			return fileManifestEntry{}, err
+		}
+	}
+	return newFileManifestEntry(hdr, sum), nil
+}
+
+func hashFile(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
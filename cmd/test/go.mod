@@ -4,4 +4,6 @@ go 1.24
 
 require (
 	github.com/hashicorp/vault v1.15.2
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
 )
\ No newline at end of file
@@ -0,0 +1,248 @@
+package main
+
+// Signed snapshot manifests.
+//
+// Every snapshot gets a <name>.manifest.json next to it, uploaded to the
+// bucket alongside the .encrypted file. The manifest records the file name,
+// the SHA-256 and size of the ciphertext, the key it was encrypted with, the
+// creation time and the host, and is signed with the host's Ed25519 signing
+// key (KEY_DIR/signing.key, public half in KEY_DIR/signing.pub). A file
+// planted in the bucket by someone holding only S3 credentials has no valid
+// manifest.
+//
+// Manifests are chained: each records its sequence number and the SHA-256
+// of the previous manifest file, so deleting or reordering snapshots breaks
+// the chain (see 'snapshot verify-chain'). An incremental snapshot also
+// names the snapshot it builds on, which restores follow back to the full
+// snapshot, and the digest of the snapshot's file manifest sidecar.
+//
+// The digest covers the stream header and the encrypted segments but not the
+// key slots section, which master key rotation rewrites; a rotated snapshot
+// therefore keeps matching its original manifest.
+//
+// This file is shared by cmd/script and cmd/test; keep the copies identical.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	manifestVersion       = 1
+	manifestSuffix        = ".manifest.json"
+	manifestSignaturePref = "mobula snapshot manifest\x00"
+	signingKeyFilename    = "signing.key"
+	signingPubFilename    = "signing.pub"
+)
+
+// snapshotManifest describes one snapshot as produced by the snapshot host.
+type snapshotManifest struct {
+	Version     int       `json:"version"`
+	File        string    `json:"file"`
+	Size        int64     `json:"size"`   // Bytes covered by SHA256
+	SHA256      string    `json:"sha256"` // Header and segments, key slots excluded
+	KeyID       string    `json:"key_id,omitempty"`
+	Recipients  []string  `json:"recipients,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Hostname    string    `json:"hostname"`
+	Sequence    uint64    `json:"sequence,omitempty"`     // Position in the host's chain, from 1
+	Previous    string    `json:"previous,omitempty"`     // SHA-256 of the previous manifest file
+	Parent      string    `json:"parent,omitempty"`       // Snapshot an incremental builds on, relative to DISK_IMAGE_DIR
+	FilesSHA256 string    `json:"files_sha256,omitempty"` // The .files.encrypted sidecar, hashed like the snapshot
+
+	// Authenticated plaintext in the segments, which the header of a
+	// streamed snapshot cannot record up front
+	PlaintextSize int64 `json:"plaintext_size,omitempty"`
+}
+
+// signedManifest is the on-disk manifest: the exact manifest bytes and an
+// Ed25519 signature over them.
+type signedManifest struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Signer    string          `json:"signer"` // Fingerprint of the signing public key
+	Signature []byte          `json:"signature"`
+}
+
+// manifestPathFor returns the manifest path of an .encrypted file.
+func manifestPathFor(snapshotPath string) string {
+	return strings.TrimSuffix(snapshotPath, ".encrypted") + manifestSuffix
+}
+
+// digestSnapshot hashes a snapshot the way manifests record it and returns
+// the digest, the number of bytes hashed and the header (nil for files
+// without key slots, which are hashed whole).
+func digestSnapshot(src io.Reader) (string, int64, *snapshotHeader, error) {
+	br := bufio.NewReader(src)
+	digest := sha256.New()
+
+	var header *snapshotHeader
+	var size int64
+	lead, _ := br.Peek(len(streamMagic) + 1)
+	if isStreamFormat(lead) && len(lead) > len(streamMagic) && int(lead[len(streamMagic)]) >= 3 {
+		var err error
+		if header, err = readSnapshotHeader(br); err != nil {
+			return "", 0, nil, err
+		}
+		digest.Write(header.aad)
+		size = int64(len(header.aad))
+	}
+
+	n, err := io.Copy(digest, br)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	return hex.EncodeToString(digest.Sum(nil)), size + n, header, nil
+}
+
+// segmentsPlaintextSize returns the plaintext carried by n bytes of sealed
+// segments: every segment but the last holds chunkSize bytes, and each has
+// an authentication tag.
+func segmentsPlaintextSize(n int64, chunkSize int) int64 {
+	sealed := int64(chunkSize + streamTagSize)
+	return n - (n+sealed-1)/sealed*streamTagSize
+}
+
+// manifestHash is the hash the next manifest in the chain links to.
+func manifestHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// loadSigningKey reads the host signing key, creating it on first use.
+func loadSigningKey(keyDir string) (ed25519.PrivateKey, bool, error) {
+	path := filepath.Join(keyDir, signingKeyFilename)
+
+	seedHex, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(seedHex)))
+		if err != nil || len(seed) != ed25519.SeedSize {
+			return nil, false, fmt.Errorf("invalid signing key in %s", path)
+		}
+		return ed25519.NewKeyFromSeed(seed), false, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, false, err
+	}
+	if err := os.MkdirAll(keyDir, 0700); err != nil {
+		return nil, false, err
+	}
+	if err := os.WriteFile(path, []byte(hex.EncodeToString(privateKey.Seed())), 0600); err != nil {
+		return nil, false, err
+	}
+	pubPath := filepath.Join(keyDir, signingPubFilename)
+	if err := os.WriteFile(pubPath, []byte(hex.EncodeToString(publicKey)), 0644); err != nil {
+		return nil, false, err
+	}
+	return privateKey, true, nil
+}
+
+// loadSigningPublicKey reads the public key manifests are verified with.
+func loadSigningPublicKey(keyDir string) (ed25519.PublicKey, error) {
+	data, err := os.ReadFile(filepath.Join(keyDir, signingPubFilename))
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signing public key in %s", keyDir)
+	}
+	return publicKey, nil
+}
+
+// signManifest encodes and signs a manifest.
+func signManifest(manifest *snapshotManifest, signingKey ed25519.PrivateKey) ([]byte, error) {
+	raw, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	signed := signedManifest{
+		Manifest:  raw,
+		Signer:    keyFingerprint(publicKey),
+		Signature: ed25519.Sign(signingKey, append([]byte(manifestSignaturePref), raw...)),
+	}
+	return json.MarshalIndent(signed, "", "  ")
+}
+
+// openManifest checks a manifest's signature and returns its content.
+func openManifest(data []byte, publicKey ed25519.PublicKey) (*snapshotManifest, error) {
+	signed := signedManifest{}
+	if err := json.Unmarshal(data, &signed); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+
+	if signed.Signer != keyFingerprint(publicKey) {
+		return nil, fmt.Errorf("manifest signed by unknown key %s (trusted key is %s)", signed.Signer, keyFingerprint(publicKey))
+	}
+	// The signature covers the compact encoding json.Marshal produced; the
+	// indented envelope reformats the embedded manifest
+	raw := bytes.Buffer{}
+	if err := json.Compact(&raw, signed.Manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	if !ed25519.Verify(publicKey, append([]byte(manifestSignaturePref), raw.Bytes()...), signed.Signature) {
+		return nil, errors.New("manifest signature is invalid")
+	}
+
+	manifest := &snapshotManifest{}
+	if err := json.Unmarshal(signed.Manifest, manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// verifySnapshotManifest checks that snapshotPath is the file its signed
+// manifest describes.
+func verifySnapshotManifest(snapshotPath string, publicKey ed25519.PublicKey) (*snapshotManifest, error) {
+	data, err := os.ReadFile(manifestPathFor(snapshotPath))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := openManifest(data, publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.File != filepath.Base(snapshotPath) {
+		return nil, fmt.Errorf("manifest describes %s, not %s", manifest.File, filepath.Base(snapshotPath))
+	}
+
+	file, err := os.Open(snapshotPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	digest, size, header, err := digestSnapshot(file)
+	if err != nil {
+		return nil, err
+	}
+	if size != manifest.Size || digest != manifest.SHA256 {
+		return nil, fmt.Errorf("snapshot content does not match its manifest (sha256 %s, expected %s)", digest, manifest.SHA256)
+	}
+	if header != nil && manifest.PlaintextSize != 0 &&
+		manifest.PlaintextSize != segmentsPlaintextSize(size-int64(len(header.aad)), header.ChunkSize) {
+		return nil, fmt.Errorf("snapshot plaintext size does not match its manifest (%d bytes)", manifest.PlaintextSize)
+	}
+
+	return manifest, nil
+}
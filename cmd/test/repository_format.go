@@ -0,0 +1,237 @@
+package main
+
+// Deduplicated repository format.
+//
+// In repository mode (REPOSITORY=true) the tar archive of a snapshot is not
+// stored as one encrypted file. It is cut into content-defined chunks, and
+// each chunk is encrypted on its own and stored once, under its keyed hash,
+// in DISK_IMAGE_DIR/repository/chunks. The snapshot file itself only holds
+// the tree: the ordered list of chunks that make up the archive.
+//
+// The repository secret is 64 random bytes: an AES-256 key for chunks and
+// an HMAC-SHA256 key for chunk IDs, which also seeds the chunker so chunk
+// boundaries reveal nothing about the content. It is kept in
+// repository/key.encrypted, sealed like a snapshot, and copied into every
+// tree, so a snapshot's own key shares are enough to restore it.
+//
+// Chunk file layout:
+//
+//	"MBCHNK" || version (1 byte) || flags (1 byte) || nonce (12 bytes) || AES-GCM(payload)
+//
+// Flag bit 0 marks a deflate-compressed payload. The chunk ID and the flags
+// are the additional data, so chunks cannot be swapped or relabelled, and
+// the ID is checked again against the decrypted content.
+//
+// A tree is a <name>.tree.encrypted file in the usual snapshot layout,
+// whose plaintext is "MBTREE\n" followed by the tree JSON. Besides the
+// usual key slots it has a "repository" slot, sealed with a key derived
+// from the repository secret, so garbage collection can read the trees of
+// every key generation; it opens nothing the secret does not already open.
+//
+// This file is shared by cmd/script and cmd/test; keep the copies identical.
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+const (
+	repositoryDirName      = "repository"
+	repositoryKeyFilename  = "key.encrypted"
+	repositorySecretLength = 64 // Chunk encryption key || chunk ID key
+	repositoryTreeVersion  = 1
+	repositoryTreeMagic    = "MBTREE\n"
+	repositoryTreeSuffix   = ".tree"
+	keySlotRepository      = "repository" // Tree data key wrapped by the repository tree key
+
+	chunkMagic        = "MBCHNK"
+	chunkVersion      = 1
+	chunkFlagDeflate  = 1
+	chunkHeaderLength = len(chunkMagic) + 2 + 12
+)
+
+// repositoryTree lists the chunks of one snapshot's archive, in order.
+type repositoryTree struct {
+	Version    int        `json:"version"`
+	Repository string     `json:"repository"` // Fingerprint of the repository secret
+	Secret     []byte     `json:"secret"`
+	Size       int64      `json:"size"` // Archive size
+	Chunks     []chunkRef `json:"chunks"`
+}
+
+// chunkRef is one chunk of an archive.
+type chunkRef struct {
+	ID   string `json:"id"`
+	Size int64  `json:"size"` // Plaintext size
+}
+
+func repositoryKeys(secret []byte) (encryptionKey, idKey []byte) {
+	return secret[:32], secret[32:]
+}
+
+// repositoryTreeKey derives the key of the trees' repository slot.
+func repositoryTreeKey(secret []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("mobula repository tree key"))
+	return mac.Sum(nil)
+}
+
+// chunkID is the keyed hash a chunk is stored under.
+func chunkID(idKey, data []byte) string {
+	mac := hmac.New(sha256.New, idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkPath spreads chunks over 256 directories.
+func chunkPath(repoDir, id string) string {
+	return filepath.Join(repoDir, "chunks", id[:2], id)
+}
+
+// sealChunk encrypts a chunk, deflating it first when that makes it
+// smaller.
+func sealChunk(encryptionKey []byte, id string, data []byte) ([]byte, error) {
+	flags := byte(0)
+	payload := data
+
+	var compressed bytes.Buffer
+	fw, err := flate.NewWriter(&compressed, flate.BestSpeed)
+	if err != nil {
+		return nil, err
+	}
+	fw.Write(data)
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	if compressed.Len() < len(data) {
+		flags |= chunkFlagDeflate
+		payload = compressed.Bytes()
+	}
+
+	aead, err := newStreamAEAD(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, chunkHeaderLength, chunkHeaderLength+len(payload)+aead.Overhead())
+	copy(sealed, chunkMagic)
+	sealed[len(chunkMagic)] = chunkVersion
+	sealed[len(chunkMagic)+1] = flags
+	nonce := sealed[len(chunkMagic)+2 : chunkHeaderLength]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(sealed, nonce, payload, chunkAAD(id, flags)), nil
+}
+
+// openChunk decrypts a chunk and checks that it is the chunk named id.
+func openChunk(encryptionKey, idKey []byte, id string, sealed []byte) ([]byte, error) {
+	if len(sealed) < chunkHeaderLength || string(sealed[:len(chunkMagic)]) != chunkMagic {
+		return nil, errors.New("not a repository chunk")
+	}
+	if version := sealed[len(chunkMagic)]; version != chunkVersion {
+		return nil, fmt.Errorf("unsupported chunk version %d", version)
+	}
+	flags := sealed[len(chunkMagic)+1]
+	nonce := sealed[len(chunkMagic)+2 : chunkHeaderLength]
+
+	aead, err := newStreamAEAD(encryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	data, err := aead.Open(nil, nonce, sealed[chunkHeaderLength:], chunkAAD(id, flags))
+	if err != nil {
+		return nil, errors.New("chunk authentication failed")
+	}
+	if flags&chunkFlagDeflate != 0 {
+		fr := flate.NewReader(bytes.NewReader(data))
+		data, err = io.ReadAll(fr)
+		fr.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if chunkID(idKey, data) != id {
+		return nil, errors.New("chunk content does not match its ID")
+	}
+	return data, nil
+}
+
+func chunkAAD(id string, flags byte) []byte {
+	return append([]byte(chunkMagic+id), chunkVersion, flags)
+}
+
+// encodeTree returns the plaintext of a tree file.
+func encodeTree(tree *repositoryTree) ([]byte, error) {
+	data, err := json.Marshal(tree)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(repositoryTreeMagic), data...), nil
+}
+
+// isRepositoryTree reports whether decrypted snapshot content is a tree.
+func isRepositoryTree(head []byte) bool {
+	return bytes.HasPrefix(head, []byte(repositoryTreeMagic))
+}
+
+// parseTree decodes the plaintext of a tree file.
+func parseTree(data []byte) (*repositoryTree, error) {
+	if !isRepositoryTree(data) {
+		return nil, errors.New("not a repository tree")
+	}
+	tree := &repositoryTree{}
+	if err := json.Unmarshal(data[len(repositoryTreeMagic):], tree); err != nil {
+		return nil, fmt.Errorf("failed to parse repository tree: %v", err)
+	}
+	if tree.Version != repositoryTreeVersion {
+		return nil, fmt.Errorf("unsupported repository tree version %d", tree.Version)
+	}
+	if len(tree.Secret) != repositorySecretLength {
+		return nil, errors.New("repository tree has no valid secret")
+	}
+	return tree, nil
+}
+
+// treeReader reads back the archive a tree describes, one chunk at a time.
+type treeReader struct {
+	repoDir string
+	tree    *repositoryTree
+	next    int
+	chunk   []byte
+}
+
+func newTreeReader(repoDir string, tree *repositoryTree) io.Reader {
+	return &treeReader{repoDir: repoDir, tree: tree}
+}
+
+func (r *treeReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		if r.next == len(r.tree.Chunks) {
+			return 0, io.EOF
+		}
+		ref := r.tree.Chunks[r.next]
+		sealed, err := os.ReadFile(chunkPath(r.repoDir, ref.ID))
+		if err != nil {
+			return 0, fmt.Errorf("missing chunk %d of %d: %v", r.next+1, len(r.tree.Chunks), err)
+		}
+		encryptionKey, idKey := repositoryKeys(r.tree.Secret)
+		if r.chunk, err = openChunk(encryptionKey, idKey, ref.ID, sealed); err != nil {
+			return 0, fmt.Errorf("chunk %s: %v", ref.ID, err)
+		}
+		r.next++
+	}
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
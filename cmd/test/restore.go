@@ -0,0 +1,443 @@
+package main
+
+// Point-in-time restore.
+//
+// 'decrypt restore' rebuilds the tree captured by a snapshot into a target
+// directory. An incremental snapshot's signed manifest names the snapshot
+// it builds on; the chain is followed back to the full snapshot, and every
+// snapshot is then extracted in order, each incremental applying the
+// deletions listed in its snapshot info directory.
+
+import (
+	"archive/tar"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	deletedFilesName = "deleted_files.txt" // Written by incremental snapshots
+	maxRestoreChain  = 100000              // Guards against manifests linking in a loop
+)
+
+// restoreStats counts what extracting one snapshot did.
+type restoreStats struct {
+	entries  int
+	deleted  int
+	warnings int
+}
+
+func runRestore() {
+	fmt.Println("♻️ Point-in-time restore")
+
+	fmt.Print("Enter snapshot file path: ")
+	var filePath string
+	fmt.Scanln(&filePath)
+	filePath = strings.TrimSpace(filePath)
+
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		fmt.Printf("%s❌ File %s not found.%s\n", ColorRed, filePath, ColorReset)
+		return
+	}
+
+	if !checkSnapshotManifest(filePath) {
+		return
+	}
+
+	chain, err := snapshotChain(filePath)
+	if err != nil {
+		fmt.Printf("%s❌ Cannot rebuild the snapshot chain: %v%s\n", ColorRed, err, ColorReset)
+		return
+	}
+	if len(chain) > 1 {
+		fmt.Printf("🔗 Incremental snapshot: restoring %d snapshots, starting with full snapshot %s\n", len(chain), chain[0])
+	}
+
+	fmt.Print("Restore into directory: ")
+	var target string
+	fmt.Scanln(&target)
+	target = strings.TrimSpace(target)
+	if target == "" {
+		fmt.Printf("%s❌ No target directory given%s\n", ColorRed, ColorReset)
+		return
+	}
+	if err := os.MkdirAll(target, 0755); err != nil {
+		fmt.Printf("%s❌ Cannot create %s: %v%s\n", ColorRed, target, err, ColorReset)
+		return
+	}
+	if target, err = filepath.Abs(target); err == nil {
+		target, err = filepath.EvalSymlinks(target)
+	}
+	if err != nil {
+		fmt.Printf("%s❌ Invalid target directory: %v%s\n", ColorRed, err, ColorReset)
+		return
+	}
+
+	if !restoreChain(chain, target, "") {
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("%s🎉 Snapshot restored to %s%s\n", ColorGreen, target, ColorReset)
+}
+
+// restoreChain extracts the snapshots of a chain in order into target,
+// asking for a key whenever the previous one does not open the next
+// snapshot. It reports failures and returns whether every one succeeded.
+func restoreChain(chain []string, target, prefix string) bool {
+	var key []byte
+	defer func() { wipe(key) }()
+
+	for i, path := range chain {
+		header, err := readHeaderFromFile(path)
+		if err != nil {
+			fmt.Printf("%s❌ Invalid snapshot header in %s: %v%s\n", ColorRed, path, err, ColorReset)
+			return false
+		}
+
+		// Snapshots of a chain usually share a key; only ask again when it
+		// does not open this one
+		if key == nil || !keyOpens(header, key) {
+			fmt.Printf("\n🔑 Key for %s\n", path)
+			wipe(key)
+			if key, err = readKey(header, keyOptionsFor(header)); err != nil {
+				return false
+			}
+		}
+
+		fmt.Printf("📦 [%d/%d] Restoring %s\n", i+1, len(chain), path)
+		stats, err := restoreSnapshot(path, header, key, target, prefix)
+		if err != nil {
+			fmt.Printf("%s❌ Restore failed: %v%s\n", ColorRed, err, ColorReset)
+			return false
+		}
+		fmt.Printf("%s✅ %d entries extracted, %d paths deleted%s\n", ColorGreen, stats.entries, stats.deleted, ColorReset)
+		if stats.warnings > 0 {
+			fmt.Printf("%s⚠️  %d owners, attributes or times could not be restored (run as root to keep them)%s\n", ColorYellow, stats.warnings, ColorReset)
+		}
+	}
+	return true
+}
+
+// snapshotChain returns the snapshots to extract, oldest first, to restore
+// filePath: the full snapshot and every incremental up to filePath. Parents
+// are looked up in the DISK_IMAGE_DIR layout the manifest refers to, then
+// next to filePath for snapshots copied elsewhere.
+func snapshotChain(filePath string) ([]string, error) {
+	chain := []string{filePath}
+
+	publicKey, err := loadSigningPublicKey(keyDir)
+	if err != nil {
+		return chain, nil // Already confirmed without a provenance check
+	}
+	manifest, err := verifySnapshotManifest(filePath, publicKey)
+	if err != nil {
+		return chain, nil
+	}
+
+	root := snapshotRoot(filePath)
+	for manifest.Parent != "" {
+		if len(chain) > maxRestoreChain {
+			return nil, errors.New("snapshot chain does not end")
+		}
+
+		parent := filepath.Join(root, filepath.FromSlash(manifest.Parent))
+		if _, err := os.Stat(parent); err != nil {
+			parent = filepath.Join(filepath.Dir(filePath), filepath.Base(manifest.Parent))
+		}
+		if _, err := os.Stat(parent); err != nil {
+			return nil, fmt.Errorf("%s builds on %s, which is missing", chain[0], manifest.Parent)
+		}
+
+		if manifest, err = verifySnapshotManifest(parent, publicKey); err != nil {
+			return nil, fmt.Errorf("manifest of %s: %v", parent, err)
+		}
+		chain = append([]string{parent}, chain...)
+	}
+	return chain, nil
+}
+
+// snapshotRoot returns DISK_IMAGE_DIR for a snapshot stored as
+// DISK_IMAGE_DIR/YYYY/DD/MM/HH/<name>.
+func snapshotRoot(snapshotPath string) string {
+	root := snapshotPath
+	for i := 0; i < 5; i++ {
+		root = filepath.Dir(root)
+	}
+	return root
+}
+
+// restoreSnapshot decrypts, decompresses and extracts one snapshot, only
+// the entries below prefix when it is set. For a repository tree, the
+// archive is read back from the repository's chunks.
+func restoreSnapshot(path string, header *snapshotHeader, key []byte, target, prefix string) (*restoreStats, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := decryptStreamTo(pw, file, key)
+		pw.CloseWithError(err)
+	}()
+	defer pr.Close()
+
+	plain, err := newDecompressor(pr, snapshotCompression(header))
+	if err != nil {
+		return nil, err
+	}
+	defer plain.Close()
+
+	br := bufio.NewReaderSize(plain, 64*1024)
+	head, _ := br.Peek(isoMagicOffset + 5)
+	switch contentExtension(head) {
+	case ".img":
+		return nil, errors.New("this is a raw ext4 image: decrypt it with 'make decrypt' and dd or mount the .img")
+	case ".iso":
+		return nil, errors.New("this is an ISO image: decrypt it with 'make decrypt' and boot or mount the .iso")
+	case ".squashfs":
+		return nil, errors.New("this is a squashfs image: decrypt it with 'make decrypt' and mount the .squashfs")
+	}
+	if !isRepositoryTree(head) {
+		return extractArchive(tar.NewReader(br), target, prefix)
+	}
+
+	data, err := io.ReadAll(br)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(data)
+	tree, err := parseTree(data)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(tree.Secret)
+
+	repoDir := filepath.Join(snapshotRoot(path), repositoryDirName)
+	if _, err := os.Stat(repoDir); err != nil {
+		repoDir = filepath.Join(filepath.Dir(path), repositoryDirName)
+	}
+	fmt.Printf("🧩 Repository snapshot: %d chunks (%.2f MB) from %s\n", len(tree.Chunks), float64(tree.Size)/1024/1024, repoDir)
+	return extractArchive(tar.NewReader(bufio.NewReaderSize(newTreeReader(repoDir, tree), 64*1024)), target, prefix)
+}
+
+// extractArchive writes every entry under target, then applies the
+// deletion list. The first entry is in the snapshot info directory, which
+// holds the deletion list of incremental snapshots: the file manifest, or
+// the directory itself in older snapshots. With a prefix, such as
+// "volumes/data/", only the entries below it are extracted, relative to it.
+func extractArchive(tr *tar.Reader, target, prefix string) (*restoreStats, error) {
+	stats := &restoreStats{}
+	infoDir := ""
+	var deleted []string
+	type dirTimes struct {
+		path  string
+		mtime time.Time
+	}
+	var dirs []dirTimes
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if infoDir == "" {
+			infoDir, _, _ = strings.Cut(hdr.Name, "/")
+			infoDir += "/"
+		}
+
+		var src io.Reader = tr
+		if hdr.Name == infoDir+deletedFilesName {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return nil, err
+			}
+			deleted = parseDeletedPaths(data)
+			src = strings.NewReader(string(data))
+		}
+		if prefix != "" {
+			name, ok := strings.CutPrefix(hdr.Name, prefix)
+			if !ok {
+				continue
+			}
+			hdr.Name = name
+			if hdr.Typeflag == tar.TypeLink {
+				hdr.Linkname = strings.TrimPrefix(hdr.Linkname, prefix)
+			}
+		}
+
+		path, err := restorePath(target, hdr.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := extractEntry(hdr, src, path, target, stats); err != nil {
+			return nil, fmt.Errorf("failed to restore %s: %v", hdr.Name, err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			dirs = append(dirs, dirTimes{path: path, mtime: hdr.ModTime})
+		}
+		stats.entries++
+	}
+
+	for _, name := range deleted {
+		if prefix != "" {
+			var ok bool
+			if name, ok = strings.CutPrefix(name, prefix); !ok {
+				continue
+			}
+		}
+		path, err := restorePath(target, name)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return nil, err
+		}
+		stats.deleted++
+	}
+
+	// Extracting into a directory updates its mtime, so set them last
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime); err != nil {
+			stats.warnings++
+		}
+	}
+	return stats, nil
+}
+
+// restorePath maps an archive name to a path under target, refusing names
+// that would end up outside it, including through a symlinked parent.
+func restorePath(target, name string) (string, error) {
+	clean := filepath.Clean("/" + filepath.FromSlash(name))
+	if clean == "/" {
+		return target, nil
+	}
+	path := filepath.Join(target, clean)
+
+	// Missing directories are created by extractEntry below the deepest
+	// existing one, so that one decides where the entry lands
+	dir := filepath.Dir(path)
+	resolved, err := filepath.EvalSymlinks(dir)
+	for os.IsNotExist(err) && dir != target {
+		dir = filepath.Dir(dir)
+		resolved, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return "", err
+	}
+	if resolved != target && !strings.HasPrefix(resolved, target+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s resolves outside of %s", name, target)
+	}
+	return path, nil
+}
+
+// parseDeletedPaths reads a deletion list: one path per line, Go quoted
+// when the name contains a newline or starts with a quote.
+func parseDeletedPaths(data []byte) []string {
+	var paths []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, `"`) {
+			if unquoted, err := strconv.Unquote(line); err == nil {
+				line = unquoted
+			}
+		}
+		paths = append(paths, line)
+	}
+	return paths
+}
+
+// extractEntry creates one archive entry at path, replacing whatever an
+// earlier snapshot of the chain left there.
+func extractEntry(hdr *tar.Header, src io.Reader, path, target string, stats *restoreStats) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	existing, err := os.Lstat(path)
+	if err == nil && !(existing.IsDir() && hdr.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	mode := hdr.FileInfo().Mode()
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(path, 0700); err != nil {
+			return err
+		}
+	case tar.TypeReg:
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, src); err != nil {
+			file.Close()
+			return err
+		}
+		if err := file.Close(); err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+		restoreOwner(hdr, path, stats)
+		return nil
+	case tar.TypeLink:
+		linkTarget, err := restorePath(target, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+		return os.Link(linkTarget, path)
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		if err := makeDevice(path, hdr); err != nil {
+			return err
+		}
+	default:
+		fmt.Printf("%s⚠️  Skipping %s: unsupported entry type %q%s\n", ColorYellow, hdr.Name, hdr.Typeflag, ColorReset)
+		return nil
+	}
+
+	// Owner first: chown clears the setuid and setgid bits
+	restoreOwner(hdr, path, stats)
+	if err := os.Chmod(path, mode.Perm()|mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return err
+	}
+	for record, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(record, "SCHILY.xattr."); ok {
+			if err := setXattr(path, name, value); err != nil {
+				stats.warnings++
+			}
+		}
+	}
+	if hdr.Typeflag != tar.TypeDir {
+		if err := os.Chtimes(path, hdr.ModTime, hdr.ModTime); err != nil {
+			stats.warnings++
+		}
+	}
+	return nil
+}
+
+// restoreOwner sets the archived owner; failing to do so (when not
+// running as root) is only counted.
+func restoreOwner(hdr *tar.Header, path string, stats *restoreStats) {
+	if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+		stats.warnings++
+	}
+}
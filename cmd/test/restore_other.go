@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import (
+	"archive/tar"
+	"errors"
+)
+
+// Device nodes and extended attributes are only restored on Linux.
+
+// makeDevice creates the device node or FIFO described by hdr.
+func makeDevice(path string, hdr *tar.Header) error {
+	return errors.New("device nodes are only restored on Linux")
+}
+
+// setXattr restores one extended attribute, POSIX ACLs included.
+func setXattr(path, name, value string) error {
+	return errors.New("extended attributes are only restored on Linux")
+}
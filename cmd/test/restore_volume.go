@@ -0,0 +1,92 @@
+package main
+
+// Docker volume restore.
+//
+// 'decrypt restore-volume' recreates a Docker volume archived under
+// volumes/<name>/ by a snapshot taken with DOCKER_BACKUP_LABEL: it creates
+// the volume through the Docker socket (DOCKER_SOCKET, /var/run/docker.sock
+// by default), unless it exists already, and restores the snapshot chain
+// into its mountpoint, which must be reachable from here.
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const defaultDockerSocket = "/var/run/docker.sock"
+
+func runRestoreVolume() {
+	fmt.Println("🐳 Docker volume restore")
+
+	fmt.Print("Enter snapshot file path: ")
+	var filePath string
+	fmt.Scanln(&filePath)
+	filePath = strings.TrimSpace(filePath)
+
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		fmt.Printf("%s❌ File %s not found.%s\n", ColorRed, filePath, ColorReset)
+		return
+	}
+
+	if !checkSnapshotManifest(filePath) {
+		return
+	}
+
+	chain, err := snapshotChain(filePath)
+	if err != nil {
+		fmt.Printf("%s❌ Cannot rebuild the snapshot chain: %v%s\n", ColorRed, err, ColorReset)
+		return
+	}
+
+	fmt.Print("Volume to restore: ")
+	var name string
+	fmt.Scanln(&name)
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, "/") {
+		fmt.Printf("%s❌ Invalid volume name%s\n", ColorRed, ColorReset)
+		return
+	}
+	fmt.Printf("Restore as volume [%s]: ", name)
+	var restoreAs string
+	fmt.Scanln(&restoreAs)
+	if restoreAs = strings.TrimSpace(restoreAs); restoreAs == "" {
+		restoreAs = name
+	}
+
+	socket := os.Getenv("DOCKER_SOCKET")
+	if socket == "" {
+		socket = defaultDockerSocket
+	}
+	client := newDockerClient(socket)
+	volume, err := client.inspectVolume(restoreAs)
+	if err == nil {
+		fmt.Printf("%s⚠️  Volume %s already exists; restore into it, replacing its files? [y/N]: %s", ColorYellow, restoreAs, ColorReset)
+		var answer string
+		fmt.Scanln(&answer)
+		if strings.ToLower(strings.TrimSpace(answer)) != "y" {
+			fmt.Println("Operation cancelled.")
+			return
+		}
+	} else {
+		labels := map[string]string{"mobula.restored-from": filepath.Base(filePath)}
+		if volume, err = client.createVolume(restoreAs, labels); err != nil {
+			fmt.Printf("%s❌ Cannot create volume %s: %v%s\n", ColorRed, restoreAs, err, ColorReset)
+			return
+		}
+		fmt.Printf("📁 Created volume %s\n", restoreAs)
+	}
+
+	target, err := filepath.EvalSymlinks(volume.Mountpoint)
+	if err != nil {
+		fmt.Printf("%s❌ Cannot reach the volume's mountpoint (mount /var/lib/docker/volumes here): %v%s\n", ColorRed, err, ColorReset)
+		return
+	}
+	if !restoreChain(chain, target, "volumes/"+name+"/") {
+		return
+	}
+
+	fmt.Println()
+	fmt.Printf("%s🎉 Volume %s restored from %s%s\n", ColorGreen, restoreAs, filepath.Base(filePath), ColorReset)
+}
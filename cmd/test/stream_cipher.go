@@ -0,0 +1,760 @@
+package main
+
+// Streaming AES-256-GCM used for .encrypted snapshots.
+//
+// The plaintext is cut into fixed-size segments that are sealed
+// independently, so encryption and decryption run in constant memory no
+// matter how large the disk image is. Each segment nonce is built from a
+// random per-file prefix, a big-endian segment counter and a final flag:
+//
+//	nonce = prefix (7 bytes) || counter (4 bytes) || final (1 byte)
+//
+// The final flag is only set on the last segment, so a truncated file fails
+// authentication instead of decrypting to a shorter image, and segments
+// cannot be reordered because the counter is part of the nonce.
+//
+// File layout (version 3):
+//
+//	"MBSNAP" || version (1 byte) || header length (uint32 BE) || header JSON
+//	         || key slots length (uint32 BE) || key slots JSON || segments
+//
+// Segments are sealed with a random per-file data key. The key slots hold
+// that data key wrapped by the master key and/or for X25519 recipients and
+// Shamir groups (see recipients.go), so rotating a key only means rewriting
+// the key slots; the segments never change. The magic, version and header
+// JSON are passed as additional data to every segment and to every key
+// wrap, so neither can be altered or moved to another file without failing
+// authentication. The key slots are deliberately left out of the segment
+// additional data so they can be rewrapped in place.
+//
+// Version 2 files had no key slots and sealed segments with the master key
+// directly. Version 1 files carried only the nonce prefix after the version
+// byte, and legacy files are a single nonce || ciphertext seal with no
+// header at all.
+//
+// This file is shared by cmd/script, cmd/test, cmd/generate and
+// test_encryption; keep the copies identical.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+)
+
+const (
+	streamMagic         = "MBSNAP"         // Marks the streaming format
+	streamVersion       = 3                // Current on-disk format version
+	streamSegmentSize   = 64 * 1024        // Plaintext bytes per segment
+	streamMaxSegment    = 16 * 1024 * 1024 // Largest segment size accepted when reading
+	streamMaxHeader     = 1024 * 1024      // Largest header accepted when reading
+	streamNoncePrefixSz = 7                // Random nonce prefix stored per file
+	streamTagSize       = 16               // AES-GCM authentication tag
+	streamCipherSuite   = "AES-256-GCM-STREAM"
+)
+
+const (
+	dataKeyLength = 32       // Per-snapshot AES-256 data key
+	keySlotMaster = "master" // Data key wrapped by a master key
+)
+
+var (
+	errStreamTruncated  = errors.New("encrypted stream is truncated")
+	errAlreadyRewrapped = errors.New("snapshot already uses the new key")
+	errNoMasterSlot     = errors.New("snapshot is only encrypted to recipients")
+)
+
+// snapshotHeader describes how an .encrypted file was produced.
+type snapshotHeader struct {
+	Version        int       `json:"-"`
+	CipherSuite    string    `json:"cipher_suite"`
+	ChunkSize      int       `json:"chunk_size"`
+	NoncePrefix    []byte    `json:"nonce_prefix"`
+	KeyFingerprint string    `json:"key_fingerprint,omitempty"` // Version 2 only
+	CreatedAt      time.Time `json:"created_at"`
+	PlaintextSize  int64     `json:"plaintext_size"`        // -1 when not known up front, see the manifest
+	Compression    string    `json:"compression,omitempty"` // Codec of the plaintext, gzip when absent
+
+	KeySlots []keySlot `json:"-"` // Stored in their own section from version 3
+
+	aad []byte // Raw header bytes authenticated with every segment
+}
+
+// keySlot is one wrapped copy of a snapshot's data key.
+type keySlot struct {
+	Type           string `json:"type"`
+	KeyID          string `json:"key_id,omitempty"` // Keyring generation of the wrapping key
+	KeyFingerprint string `json:"key_fingerprint"`
+	EphemeralKey   []byte `json:"ephemeral_key,omitempty"`   // Recipient slots only
+	RequiredShares int    `json:"required_shares,omitempty"` // Shamir group slots only
+	TotalShares    int    `json:"total_shares,omitempty"`    // Shamir group slots only
+	WrappedKey     []byte `json:"wrapped_key"`               // nonce || AES-GCM(data key)
+}
+
+// keyFingerprint identifies a key without revealing it, so a file can say
+// which master key it needs.
+func keyFingerprint(key []byte) string {
+	sum := sha256.Sum256(append([]byte("mobula snapshot key fingerprint\x00"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// wipe overwrites key material that is no longer needed.
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wrapDataKey seals the data key under the master key, bound to the header.
+func wrapDataKey(dataKey []byte, keyID string, masterKey, aad []byte) (keySlot, error) {
+	aead, err := newStreamAEAD(masterKey)
+	if err != nil {
+		return keySlot{}, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return keySlot{}, err
+	}
+
+	return keySlot{
+		Type:           keySlotMaster,
+		KeyID:          keyID,
+		KeyFingerprint: keyFingerprint(masterKey),
+		WrappedKey:     aead.Seal(nonce, nonce, dataKey, aad),
+	}, nil
+}
+
+// unwrapDataKey recovers the data key from the slot that key opens: key is
+// either a master key or the private key of an X25519 recipient.
+func unwrapDataKey(header *snapshotHeader, key []byte) ([]byte, error) {
+	fingerprint := keyFingerprint(key)
+
+	recipientFingerprint := ""
+	if publicKey, err := x25519PublicKey(key); err == nil {
+		recipientFingerprint = keyFingerprint(publicKey)
+	}
+
+	var available []string
+	for _, slot := range header.KeySlots {
+		switch {
+		case slot.Type == keySlotMaster && slot.KeyFingerprint == fingerprint:
+			return openWrappedKey(slot, key, header.aad)
+		case isRecipientSlot(slot) && slot.KeyFingerprint == recipientFingerprint:
+			return unwrapDataKeyX25519(slot, key, header.aad)
+		default:
+			available = append(available, slotKeyName(slot))
+		}
+	}
+
+	return nil, fmt.Errorf("wrong key: file needs key %s, got key %s", strings.Join(available, " or "), fingerprint)
+}
+
+// slotKeyName names the key a slot needs, preferring its keyring ID.
+func slotKeyName(slot keySlot) string {
+	if slot.KeyID != "" {
+		return fmt.Sprintf("%s (%s)", slot.KeyID, slot.KeyFingerprint)
+	}
+	return slot.KeyFingerprint
+}
+
+// segmentWriter seals everything written to it into authenticated segments.
+// Close must be called to emit the final segment.
+type segmentWriter struct {
+	aead        cipher.AEAD
+	dst         io.Writer
+	prefix      []byte
+	aad         []byte
+	segmentSize int
+	counter     uint32
+	buf         []byte
+	out         []byte
+	closed      bool
+}
+
+func newSegmentWriter(dst io.Writer, key, prefix, aad []byte, segmentSize int) (*segmentWriter, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segmentWriter{
+		aead:        aead,
+		dst:         dst,
+		prefix:      prefix,
+		aad:         aad,
+		segmentSize: segmentSize,
+		buf:         make([]byte, 0, segmentSize),
+		out:         make([]byte, 0, segmentSize+streamTagSize),
+	}, nil
+}
+
+func (w *segmentWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("write to closed segment writer")
+	}
+
+	written := 0
+	for len(p) > 0 {
+		// A full buffer is only flushed once more data arrives, so the last
+		// segment is always the one sealed by Close.
+		if len(w.buf) == w.segmentSize {
+			if err := w.flush(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := copy(w.buf[len(w.buf):w.segmentSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the final segment. It does not close the underlying writer.
+func (w *segmentWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+func (w *segmentWriter) flush(final bool) error {
+	if w.counter == math.MaxUint32 {
+		return errors.New("encrypted stream exceeds maximum number of segments")
+	}
+
+	nonce := segmentNonce(w.prefix, w.counter, final)
+	w.out = w.aead.Seal(w.out[:0], nonce, w.buf, w.aad)
+	if _, err := w.dst.Write(w.out); err != nil {
+		return err
+	}
+
+	w.counter++
+	w.buf = w.buf[:0]
+	return nil
+}
+
+// segmentReader opens the segments produced by segmentWriter.
+type segmentReader struct {
+	aead     cipher.AEAD
+	src      *bufio.Reader
+	prefix   []byte
+	aad      []byte
+	counter  uint32
+	in       []byte
+	plain    []byte
+	pending  []byte
+	done     bool
+	total    int64
+	expected int64
+}
+
+func newSegmentReader(src io.Reader, key, prefix, aad []byte, segmentSize int, expected int64) (*segmentReader, error) {
+	aead, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &segmentReader{
+		aead:     aead,
+		src:      bufio.NewReaderSize(src, segmentSize+streamTagSize+1),
+		prefix:   prefix,
+		aad:      aad,
+		in:       make([]byte, segmentSize+streamTagSize),
+		plain:    make([]byte, 0, segmentSize),
+		expected: expected,
+	}, nil
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for len(r.pending) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
+
+func (r *segmentReader) next() error {
+	n, err := io.ReadFull(r.src, r.in)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		// A short segment can only be the final one
+	case err != nil:
+		return err
+	}
+
+	final := n < len(r.in)
+	if !final {
+		if _, peekErr := r.src.Peek(1); peekErr == io.EOF {
+			final = true
+		}
+	}
+
+	if n < streamTagSize {
+		return errStreamTruncated
+	}
+
+	nonce := segmentNonce(r.prefix, r.counter, final)
+	plain, err := r.aead.Open(r.plain[:0], nonce, r.in[:n], r.aad)
+	if err != nil {
+		if final {
+			// Either tampered with or cut right after a full segment
+			return fmt.Errorf("segment %d failed authentication (wrong key, tampered or truncated file)", r.counter)
+		}
+		return fmt.Errorf("segment %d failed authentication (wrong key or tampered file)", r.counter)
+	}
+
+	r.counter++
+	r.total += int64(len(plain))
+	r.pending = plain
+	r.done = final
+
+	if final && r.expected >= 0 && r.total != r.expected {
+		return fmt.Errorf("decrypted size %d does not match header size %d", r.total, r.expected)
+	}
+	return nil
+}
+
+func newStreamAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, streamNoncePrefixSz+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixSz:], counter)
+	if final {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// marshalHeader encodes the magic, version and JSON header. The returned
+// bytes are written as-is and double as the segments' additional data.
+func marshalHeader(header *snapshotHeader) ([]byte, error) {
+	body, err := json.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := append([]byte(streamMagic), streamVersion)
+	raw = binary.BigEndian.AppendUint32(raw, uint32(len(body)))
+	return append(raw, body...), nil
+}
+
+// marshalKeySlots encodes the length-prefixed key slots section.
+func marshalKeySlots(slots []keySlot) ([]byte, error) {
+	body, err := json.Marshal(slots)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	return append(raw, body...), nil
+}
+
+// encryptStream writes a versioned header followed by the sealed segments of
+// everything read from src. A fresh data key encrypts the segments and is
+// stored wrapped by masterKey, tagged with its keyring generation keyID, and
+// for each recipient. masterKey may be nil when there are recipients.
+// plaintextSize is recorded in the header and checked on decryption; pass -1
+// when it is not known in advance (snapshot manifests record it instead).
+// compression names the codec the
+// plaintext was compressed with, or "" when it is unknown.
+func encryptStream(dst io.Writer, src io.Reader, keyID string, masterKey []byte, recipients []recipient, compression string, plaintextSize int64) error {
+	return sealStream(dst, src, keyID, masterKey, recipients, compression, time.Now().UTC(), plaintextSize)
+}
+
+func sealStream(dst io.Writer, src io.Reader, keyID string, masterKey []byte, recipients []recipient, compression string, createdAt time.Time, plaintextSize int64) error {
+	if masterKey == nil && len(recipients) == 0 {
+		return errors.New("no master key or recipient to encrypt to")
+	}
+
+	prefix := make([]byte, streamNoncePrefixSz)
+	if _, err := rand.Read(prefix); err != nil {
+		return err
+	}
+
+	dataKey := make([]byte, dataKeyLength)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	defer wipe(dataKey)
+
+	header := &snapshotHeader{
+		CipherSuite:   streamCipherSuite,
+		ChunkSize:     streamSegmentSize,
+		NoncePrefix:   prefix,
+		CreatedAt:     createdAt,
+		PlaintextSize: plaintextSize,
+		Compression:   compression,
+	}
+
+	raw, err := marshalHeader(header)
+	if err != nil {
+		return fmt.Errorf("failed to encode header: %v", err)
+	}
+
+	var keySlots []keySlot
+	if masterKey != nil {
+		slot, err := wrapDataKey(dataKey, keyID, masterKey, raw)
+		if err != nil {
+			return fmt.Errorf("failed to wrap data key: %v", err)
+		}
+		keySlots = append(keySlots, slot)
+	}
+	for _, r := range recipients {
+		slot, err := wrapDataKeyX25519(dataKey, r, raw)
+		if err != nil {
+			return fmt.Errorf("failed to wrap data key for recipient %s: %v", r.Name, err)
+		}
+		keySlots = append(keySlots, slot)
+	}
+
+	slots, err := marshalKeySlots(keySlots)
+	if err != nil {
+		return fmt.Errorf("failed to encode key slots: %v", err)
+	}
+
+	if _, err := dst.Write(append(raw, slots...)); err != nil {
+		return err
+	}
+
+	sw, err := newSegmentWriter(dst, dataKey, prefix, raw, streamSegmentSize)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sw, src); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// isStreamFormat reports whether data starts with the streaming format magic.
+// Files without it are legacy single-shot nonce || ciphertext files.
+func isStreamFormat(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(streamMagic))
+}
+
+// readSnapshotHeader consumes and validates the header at the start of src.
+func readSnapshotHeader(src io.Reader) (*snapshotHeader, error) {
+	lead := make([]byte, len(streamMagic)+1)
+	if _, err := io.ReadFull(src, lead); err != nil {
+		return nil, fmt.Errorf("failed to read stream header: %v", err)
+	}
+	if !isStreamFormat(lead) {
+		return nil, errors.New("not a streaming snapshot file")
+	}
+
+	version := int(lead[len(streamMagic)])
+	switch version {
+	case 1:
+		prefix := make([]byte, streamNoncePrefixSz)
+		if _, err := io.ReadFull(src, prefix); err != nil {
+			return nil, fmt.Errorf("failed to read stream header: %v", err)
+		}
+		return &snapshotHeader{
+			Version:       1,
+			CipherSuite:   streamCipherSuite,
+			ChunkSize:     streamSegmentSize,
+			NoncePrefix:   prefix,
+			PlaintextSize: -1,
+		}, nil
+	case 2, streamVersion:
+	default:
+		return nil, fmt.Errorf("unsupported stream format version %d", version)
+	}
+
+	sizeBuf := make([]byte, 4)
+	if _, err := io.ReadFull(src, sizeBuf); err != nil {
+		return nil, fmt.Errorf("failed to read stream header: %v", err)
+	}
+	size := binary.BigEndian.Uint32(sizeBuf)
+	if size > streamMaxHeader {
+		return nil, fmt.Errorf("stream header too large (%d bytes)", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(src, body); err != nil {
+		return nil, fmt.Errorf("failed to read stream header: %v", err)
+	}
+
+	header := &snapshotHeader{}
+	if err := json.Unmarshal(body, header); err != nil {
+		return nil, fmt.Errorf("failed to parse stream header: %v", err)
+	}
+	header.Version = version
+	header.aad = append(append(lead, sizeBuf...), body...)
+
+	if version >= 3 {
+		if _, err := io.ReadFull(src, sizeBuf); err != nil {
+			return nil, fmt.Errorf("failed to read key slots: %v", err)
+		}
+		size := binary.BigEndian.Uint32(sizeBuf)
+		if size > streamMaxHeader {
+			return nil, fmt.Errorf("key slots too large (%d bytes)", size)
+		}
+
+		slots := make([]byte, size)
+		if _, err := io.ReadFull(src, slots); err != nil {
+			return nil, fmt.Errorf("failed to read key slots: %v", err)
+		}
+		if err := json.Unmarshal(slots, &header.KeySlots); err != nil {
+			return nil, fmt.Errorf("failed to parse key slots: %v", err)
+		}
+		if len(header.KeySlots) == 0 {
+			return nil, errors.New("snapshot has no key slots")
+		}
+	}
+
+	if header.CipherSuite != streamCipherSuite {
+		return nil, fmt.Errorf("unsupported cipher suite %q", header.CipherSuite)
+	}
+	if header.ChunkSize <= 0 || header.ChunkSize > streamMaxSegment {
+		return nil, fmt.Errorf("invalid chunk size %d", header.ChunkSize)
+	}
+	if len(header.NoncePrefix) != streamNoncePrefixSz {
+		return nil, fmt.Errorf("invalid nonce prefix length %d", len(header.NoncePrefix))
+	}
+
+	return header, nil
+}
+
+// openStream returns a reader yielding the authenticated plaintext that
+// follows an already parsed header. masterKey unwraps the data key, or seals
+// the segments directly for files older than version 3.
+func openStream(src io.Reader, header *snapshotHeader, masterKey []byte) (io.Reader, error) {
+	if header.Version < 3 {
+		if header.KeyFingerprint != "" && header.KeyFingerprint != keyFingerprint(masterKey) {
+			return nil, fmt.Errorf("wrong key: file needs key %s, got key %s", header.KeyFingerprint, keyFingerprint(masterKey))
+		}
+		return newSegmentReader(src, masterKey, header.NoncePrefix, header.aad, header.ChunkSize, header.PlaintextSize)
+	}
+
+	dataKey, err := unwrapDataKey(header, masterKey)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe(dataKey)
+
+	return newSegmentReader(src, dataKey, header.NoncePrefix, header.aad, header.ChunkSize, header.PlaintextSize)
+}
+
+// decryptLegacy opens a pre-streaming file: a single AES-GCM seal over the
+// whole plaintext, stored as nonce || ciphertext.
+func decryptLegacy(data, key []byte) ([]byte, error) {
+	gcm, err := newStreamAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+
+	nonce := data[:gcm.NonceSize()]
+	return gcm.Open(nil, nonce, data[gcm.NonceSize():], nil)
+}
+
+// decryptStreamTo decrypts an .encrypted file of any format from src into
+// dst. Streaming files are processed in constant memory; legacy files still
+// have to be loaded whole.
+func decryptStreamTo(dst io.Writer, src io.Reader, key []byte) (int64, error) {
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(len(streamMagic))
+
+	if !isStreamFormat(magic) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return 0, err
+		}
+		plaintext, err := decryptLegacy(data, key)
+		if err != nil {
+			return 0, err
+		}
+		n, err := dst.Write(plaintext)
+		return int64(n), err
+	}
+
+	header, err := readSnapshotHeader(br)
+	if err != nil {
+		return 0, err
+	}
+
+	plain, err := openStream(br, header, key)
+	if err != nil {
+		return 0, err
+	}
+	return io.Copy(dst, plain)
+}
+
+// describeSnapshotFile returns the header of a streaming snapshot, or nil for
+// a legacy headerless file.
+func describeSnapshotFile(src io.Reader) (*snapshotHeader, error) {
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(len(streamMagic))
+	if !isStreamFormat(magic) {
+		return nil, nil
+	}
+	return readSnapshotHeader(br)
+}
+
+// rewrapStream copies an .encrypted file from src to dst so that it opens
+// with newKey instead of oldKey. Version 3 files only get their key slots
+// rewritten and their segments copied verbatim; older formats are decrypted
+// and re-encrypted. It reports whether the file had to be re-encrypted, and
+// returns errAlreadyRewrapped without writing anything when src already
+// opens with newKey only, or errNoMasterSlot when no master key opens it.
+// Recipient slots are kept as they are.
+func rewrapStream(dst io.Writer, src io.Reader, oldKey []byte, newKeyID string, newKey []byte) (bool, error) {
+	br := bufio.NewReader(src)
+	magic, _ := br.Peek(len(streamMagic))
+
+	if !isStreamFormat(magic) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return false, err
+		}
+		plaintext, err := decryptLegacy(data, oldKey)
+		if err != nil {
+			return false, err
+		}
+		return true, encryptStream(dst, bytes.NewReader(plaintext), newKeyID, newKey, nil, "", int64(len(plaintext)))
+	}
+
+	header, err := readSnapshotHeader(br)
+	if err != nil {
+		return false, err
+	}
+
+	if header.Version < 3 {
+		plain, err := openStream(br, header, oldKey)
+		if err != nil {
+			return false, err
+		}
+		createdAt := header.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = time.Now().UTC()
+		}
+		return true, sealStream(dst, plain, newKeyID, newKey, nil, header.Compression, createdAt, header.PlaintextSize)
+	}
+
+	return false, rewrapKeySlots(dst, br, header, oldKey, newKeyID, newKey)
+}
+
+func rewrapKeySlots(dst io.Writer, segments io.Reader, header *snapshotHeader, oldKey []byte, newKeyID string, newKey []byte) error {
+	oldFingerprint := keyFingerprint(oldKey)
+	newFingerprint := keyFingerprint(newKey)
+
+	hasOld, hasNew, hasMaster := false, false, false
+	var kept []keySlot
+	for _, slot := range header.KeySlots {
+		hasMaster = hasMaster || slot.Type == keySlotMaster
+		switch {
+		case slot.Type == keySlotMaster && slot.KeyFingerprint == oldFingerprint:
+			hasOld = true
+		case slot.Type == keySlotMaster && slot.KeyFingerprint == newFingerprint:
+			hasNew = true
+		default:
+			kept = append(kept, slot)
+		}
+	}
+	if !hasMaster {
+		return errNoMasterSlot
+	}
+	if hasNew && !hasOld {
+		return errAlreadyRewrapped
+	}
+
+	dataKey, err := unwrapDataKey(header, oldKey)
+	if err != nil {
+		return err
+	}
+	defer wipe(dataKey)
+
+	slot, err := wrapDataKey(dataKey, newKeyID, newKey, header.aad)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	slots, err := marshalKeySlots(append(kept, slot))
+	if err != nil {
+		return fmt.Errorf("failed to encode key slots: %v", err)
+	}
+
+	if _, err := dst.Write(append(append([]byte{}, header.aad...), slots...)); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, segments)
+	return err
+}
+
+// addKeySlot copies a version 3 .encrypted file from src to dst with one
+// more slot of type slotType, wrapping the data key with newKey; the other
+// slots and the segments are copied as they are. key is any master key
+// that already opens the file. It returns errAlreadyRewrapped without
+// writing anything when src already has such a slot for newKey.
+func addKeySlot(dst io.Writer, src io.Reader, key []byte, slotType, newKeyID string, newKey []byte) error {
+	br := bufio.NewReader(src)
+	header, err := readSnapshotHeader(br)
+	if err != nil {
+		return err
+	}
+	if header.Version < 3 {
+		return fmt.Errorf("stream format version %d has no key slots", header.Version)
+	}
+
+	newFingerprint := keyFingerprint(newKey)
+	for _, slot := range header.KeySlots {
+		if slot.Type == slotType && slot.KeyFingerprint == newFingerprint {
+			return errAlreadyRewrapped
+		}
+	}
+
+	dataKey, err := unwrapDataKey(header, key)
+	if err != nil {
+		return err
+	}
+	defer wipe(dataKey)
+
+	slot, err := wrapDataKey(dataKey, newKeyID, newKey, header.aad)
+	if err != nil {
+		return fmt.Errorf("failed to wrap data key: %v", err)
+	}
+	slot.Type = slotType
+	slots, err := marshalKeySlots(append(header.KeySlots, slot))
+	if err != nil {
+		return fmt.Errorf("failed to encode key slots: %v", err)
+	}
+
+	if _, err := dst.Write(append(append([]byte{}, header.aad...), slots...)); err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, br)
+	return err
+}
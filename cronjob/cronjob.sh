@@ -5,6 +5,16 @@
 echo "Starting snapshot container..."
 echo "$(date): Container started" >>/var/log/cron.log
 
+# Sealed mode: the key only exists in the daemon's memory, so snapshots are
+# scheduled by the daemon itself instead of cron
+if grep -q '^KEY_MODE=sealed' /app/.env 2>/dev/null; then
+	echo "Sealed mode - starting snapshot daemon (unseal it with 'make unseal')"
+	echo "$(date): Snapshot daemon starting sealed" >>/var/log/cron.log
+	/app/snapshot daemon >>/var/log/cron.log 2>&1 &
+	tail -f /var/log/cron.log
+	exit 0
+fi
+
 # Start cron service
 service cron start
 
@@ -0,0 +1,173 @@
+package main
+
+// Snapshot compression codecs.
+//
+// The codec a snapshot was compressed with is recorded in its stream header
+// ("compression"); snapshots without it are gzip. Every codec is handled
+// in-process: zstd with github.com/klauspost/compress and xz with
+// github.com/ulikunitz/xz, so no compression tool has to be installed
+// where snapshots are created or restored.
+//
+// This file is shared by cmd/script, cmd/test and test_encryption; keep the
+// copies identical.
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+	compressionXz   = "xz"
+
+	squashfsMagic   = "hsqs" // At the start of a squashfs superblock
+	tarMagicOffset  = 257    // "ustar" in a tar header
+	ext4MagicOffset = 1080   // 0xEF53 in the ext2/3/4 superblock
+	isoMagicOffset  = 32769  // "CD001" in the first ISO 9660 volume descriptor
+)
+
+// isCompressionCodec reports whether codec is a supported codec name.
+func isCompressionCodec(codec string) bool {
+	switch codec {
+	case compressionNone, compressionGzip, compressionZstd, compressionXz:
+		return true
+	}
+	return false
+}
+
+// snapshotCompression returns the codec of a snapshot's plaintext.
+func snapshotCompression(header *snapshotHeader) string {
+	if header == nil || header.Compression == "" {
+		return compressionGzip
+	}
+	return header.Compression
+}
+
+// compressionExtension is the file name extension of a codec's output.
+func compressionExtension(codec string) string {
+	switch codec {
+	case compressionGzip:
+		return ".gz"
+	case compressionZstd:
+		return ".zst"
+	case compressionXz:
+		return ".xz"
+	}
+	return ""
+}
+
+// newDecompressor returns a reader of the decompressed content of src.
+func newDecompressor(src io.Reader, codec string) (io.ReadCloser, error) {
+	switch codec {
+	case compressionNone:
+		return io.NopCloser(src), nil
+	case compressionGzip:
+		return gzip.NewReader(src)
+	case compressionZstd:
+		zr, err := zstd.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case compressionXz:
+		xr, err := xz.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	}
+	return nil, fmt.Errorf("unknown compression %q", codec)
+}
+
+// contentExtension names decompressed snapshot content from its first
+// bytes: a tar archive, a raw ext4 image (IMAGE_FORMAT=raw-ext4), a
+// squashfs image, or an ISO image (IMAGE_FORMAT=iso, and snapshots taken
+// before the archiver).
+func contentExtension(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte(squashfsMagic)):
+		return ".squashfs"
+	case len(head) >= tarMagicOffset+5 && string(head[tarMagicOffset:tarMagicOffset+5]) == "ustar":
+		return ".tar"
+	case len(head) >= ext4MagicOffset+2 && string(head[ext4MagicOffset:ext4MagicOffset+2]) == "\x53\xef":
+		return ".img"
+	case len(head) >= isoMagicOffset+5 && string(head[isoMagicOffset:isoMagicOffset+5]) == "CD001":
+		return ".iso"
+	}
+	return ".raw"
+}
+
+// decompressToFile decompresses src into outputBase plus the extension of
+// its content, and returns the path written and its size. Raw disk images
+// are written sparse.
+func decompressToFile(src io.Reader, codec, outputBase string) (string, int64, error) {
+	plain, err := newDecompressor(src, codec)
+	if err != nil {
+		return "", 0, err
+	}
+	defer plain.Close()
+
+	br := bufio.NewReaderSize(plain, 64*1024)
+	head, _ := br.Peek(isoMagicOffset + 5)
+	outputPath := outputBase + contentExtension(head)
+
+	output, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	var written int64
+	if contentExtension(head) == ".img" {
+		written, err = copySparse(output, br)
+	} else {
+		written, err = io.Copy(output, br)
+	}
+	if err == nil {
+		err = plain.Close()
+	}
+	if err != nil {
+		output.Close()
+		os.Remove(outputPath)
+		return "", 0, err
+	}
+	return outputPath, written, output.Close()
+}
+
+// copySparse copies src to the start of dst, seeking over blocks of zeros
+// so that they become holes.
+func copySparse(dst *os.File, src io.Reader) (int64, error) {
+	buf := make([]byte, 64*1024)
+	zeros := make([]byte, len(buf))
+	var written int64
+	for {
+		n, err := io.ReadFull(src, buf)
+		if n > 0 {
+			var werr error
+			if bytes.Equal(buf[:n], zeros[:n]) {
+				_, werr = dst.Seek(int64(n), io.SeekCurrent)
+			} else {
+				_, werr = dst.Write(buf[:n])
+			}
+			if werr != nil {
+				return written, werr
+			}
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	// A trailing hole only exists once the file is extended over it
+	return written, dst.Truncate(written)
+}
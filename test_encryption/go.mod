@@ -1,5 +1,9 @@
 module test_encryption
 
-go 1.21
+go 1.24
 
-require github.com/hashicorp/vault v1.15.2
+require (
+	github.com/hashicorp/vault v1.15.2
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.15
+)
@@ -1,10 +1,8 @@
 package main
 
 import (
+	"archive/tar"
 	"bufio"
-	"compress/gzip"
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
@@ -41,10 +39,10 @@ func main() {
 	for {
 		fmt.Println()
 		fmt.Printf("%sChoose an option:%s\n", ColorYellow, ColorReset)
-		fmt.Println("1. 🔑 Manual decryption with your 3 key shares")
+		fmt.Println("1. 🔑 Manual decryption with your key shares")
 		fmt.Println("2. 🤖 Concurrent brute force test (verify encryption strength)")
 		fmt.Println("3. 📂 Refresh file list")
-		fmt.Println("4. 💿 Test ISO contents (mount and browse)")
+		fmt.Println("4. 📦 Test archive contents (list and show snapshot info)")
 		fmt.Println("5. ❌ Exit")
 		fmt.Print("\nEnter choice (1-5): ")
 
@@ -58,7 +56,7 @@ func main() {
 		case "3":
 			showEncryptedFiles()
 		case "4":
-			testISOContents()
+			testArchiveContents()
 		case "5":
 			fmt.Printf("%s👋 Goodbye!%s\n", ColorGreen, ColorReset)
 			return
@@ -121,10 +119,11 @@ func manualDecryption() {
 		return
 	}
 
-	// Get 3 key shares
-	fmt.Printf("\n%sEnter your 3 key shares:%s\n", ColorYellow, ColorReset)
-	shares := make([]string, 3)
-	for i := 0; i < 3; i++ {
+	count := sharesToEnter(filename)
+
+	fmt.Printf("\n%sEnter your %d key shares:%s\n", ColorYellow, count, ColorReset)
+	shares := make([]string, count)
+	for i := 0; i < count; i++ {
 		fmt.Printf("Key share #%d: ", i+1)
 		shares[i] = strings.TrimSpace(getUserInput())
 		if shares[i] == "" {
@@ -137,12 +136,50 @@ func manualDecryption() {
 	fmt.Printf("\n%s🔐 Attempting decryption...%s\n", ColorBlue, ColorReset)
 
 	if decryptAndDecompressFile(filename, shares) {
-		fmt.Printf("%s✅ SUCCESS! File decrypted and decompressed to ISO%s\n", ColorGreen, ColorReset)
+		fmt.Printf("%s✅ SUCCESS! File decrypted and decompressed to a tar archive%s\n", ColorGreen, ColorReset)
 	} else {
 		fmt.Printf("%s❌ FAILED! Could not decrypt file%s\n", ColorRed, ColorReset)
 	}
 }
 
+// sharesToEnter asks how many shares will be entered when the snapshot is
+// also encrypted to Shamir groups with their own quorum; otherwise it is the
+// usual 3 shares of the master key.
+func sharesToEnter(filename string) int {
+	count := 3
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return count
+	}
+	defer file.Close()
+
+	header, err := describeSnapshotFile(file)
+	if err != nil || header == nil {
+		return count
+	}
+
+	var groups []keySlot
+	for _, slot := range header.KeySlots {
+		if slot.Type == keySlotShamirGroup {
+			groups = append(groups, slot)
+		}
+	}
+	if len(groups) == 0 {
+		return count
+	}
+
+	fmt.Printf("\n%s👥 This file can also be opened by these Shamir groups:%s\n", ColorPurple, ColorReset)
+	for _, group := range groups {
+		fmt.Printf("   • %s: %d of %d shares\n", group.KeyID, group.RequiredShares, group.TotalShares)
+	}
+	fmt.Print("How many shares will you enter? (default 3): ")
+	if n, err := strconv.Atoi(strings.TrimSpace(getUserInput())); err == nil && n >= 2 {
+		count = n
+	}
+	return count
+}
+
 func bruteForceTest() {
 	fmt.Printf("\n%s🤖 Concurrent Brute Force Test%s\n", ColorPurple, ColorReset)
 	fmt.Println("=" + strings.Repeat("=", 30))
@@ -296,33 +333,14 @@ func decryptFile(filename string, shares []string) bool {
 		return false // Invalid shares
 	}
 
-	// Try to decrypt file
-	ciphertext, err := os.ReadFile(filename)
-	if err != nil {
-		return false
-	}
-
-	// Create cipher
-	block, err := aes.NewCipher(masterKey)
+	// Try to decrypt file (a wrong key fails on the first segment)
+	file, err := os.Open(filename)
 	if err != nil {
 		return false
 	}
+	defer file.Close()
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return false
-	}
-
-	// Check file size
-	if len(ciphertext) < gcm.NonceSize() {
-		return false
-	}
-
-	// Extract nonce and try to decrypt
-	nonce := ciphertext[:gcm.NonceSize()]
-	encrypted := ciphertext[gcm.NonceSize():]
-
-	_, err = gcm.Open(nil, nonce, encrypted, nil)
+	_, err = decryptStreamTo(io.Discard, file, masterKey)
 	return err == nil // Success if no error
 }
 
@@ -343,101 +361,91 @@ func decryptAndDecompressFile(filename string, shares []string) bool {
 		return false // Invalid shares
 	}
 
-	// Try to decrypt file
-	ciphertext, err := os.ReadFile(filename)
+	// Try to decrypt file, streaming it to the compressed output
+	file, err := os.Open(filename)
 	if err != nil {
 		return false
 	}
+	defer file.Close()
 
-	// Create cipher
-	block, err := aes.NewCipher(masterKey)
+	header, err := describeSnapshotFile(file)
 	if err != nil {
 		return false
 	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
 		return false
 	}
+	codec := snapshotCompression(header)
 
-	// Check file size
-	if len(ciphertext) < gcm.NonceSize() {
+	base := strings.TrimSuffix(filename, ".encrypted") + "_decrypted"
+	compressedFile := base + compressionExtension(codec)
+	if codec == compressionNone {
+		compressedFile = base + ".uncompressed"
+	}
+	output, err := os.OpenFile(compressedFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fmt.Printf("%s❌ Failed to save decrypted file: %v%s\n", ColorRed, err, ColorReset)
 		return false
 	}
 
-	// Extract nonce and try to decrypt
-	nonce := ciphertext[:gcm.NonceSize()]
-	encrypted := ciphertext[gcm.NonceSize():]
-
-	decryptedData, err := gcm.Open(nil, nonce, encrypted, nil)
-	if err != nil {
+	if _, err := decryptStreamTo(output, file, masterKey); err != nil {
+		output.Close()
+		os.Remove(compressedFile)
 		return false // Decryption failed
 	}
 
-	// Save decrypted compressed file
-	gzFile := strings.TrimSuffix(filename, ".encrypted") + "_decrypted.iso.gz"
-	if err := os.WriteFile(gzFile, decryptedData, 0600); err != nil {
+	if err := output.Close(); err != nil {
 		fmt.Printf("%s❌ Failed to save decrypted file: %v%s\n", ColorRed, err, ColorReset)
 		return false
 	}
-	fmt.Printf("%s📁 Saved decrypted file: %s%s\n", ColorGreen, gzFile, ColorReset)
+	fmt.Printf("%s📁 Saved decrypted file: %s%s\n", ColorGreen, compressedFile, ColorReset)
 
-	// Decompress to ISO
-	isoFile := strings.TrimSuffix(gzFile, ".gz")
-	fmt.Printf("🗜️ Decompressing to ISO...\n")
-	if err := decompressGzip(gzFile, isoFile); err != nil {
+	// Decompress according to the codec recorded in the header
+	fmt.Printf("🗜️ Decompressing %s...\n", codec)
+	restoredFile, err := decompressFile(compressedFile, base, codec)
+	if err != nil {
 		fmt.Printf("%s❌ Decompression failed: %v%s\n", ColorRed, err, ColorReset)
 		return false
 	}
 
 	// Show file info
-	if stat, err := os.Stat(isoFile); err == nil {
-		fmt.Printf("%s💽 Final ISO: %s (%.2f MB)%s\n", ColorGreen, isoFile, float64(stat.Size())/1024/1024, ColorReset)
-		fmt.Printf("%s🎉 Ready to boot in VM!%s\n", ColorGreen, ColorReset)
+	if stat, err := os.Stat(restoredFile); err == nil {
+		fmt.Printf("%s📦 Final archive: %s (%.2f MB)%s\n", ColorGreen, restoredFile, float64(stat.Size())/1024/1024, ColorReset)
+		if strings.HasSuffix(restoredFile, ".tar") {
+			fmt.Printf("%s🎉 Ready to restore with: tar -xpf %s --xattrs --acls --numeric-owner -C <target>%s\n", ColorGreen, restoredFile, ColorReset)
+		}
 	}
 
 	return true
 }
 
-func decompressGzip(gzipFile, outputFile string) error {
-	file, err := os.Open(gzipFile)
+func decompressFile(compressedFile, outputBase, codec string) (string, error) {
+	file, err := os.Open(compressedFile)
 	if err != nil {
-		return err
+		return "", err
 	}
 	defer file.Close()
 
-	reader, err := gzip.NewReader(file)
-	if err != nil {
-		return err
-	}
-	defer reader.Close()
-
-	output, err := os.Create(outputFile)
-	if err != nil {
-		return err
-	}
-	defer output.Close()
-
-	_, err = io.Copy(output, reader)
-	return err
+	outputPath, _, err := decompressToFile(file, codec, outputBase)
+	return outputPath, err
 }
 
-func testISOContents() {
-	fmt.Printf("\n%s💿 ISO Contents Test%s\n", ColorPurple, ColorReset)
-	fmt.Println("=" + strings.Repeat("=", 20))
+func testArchiveContents() {
+	fmt.Printf("\n%s📦 Archive Contents Test%s\n", ColorPurple, ColorReset)
+	fmt.Println("=" + strings.Repeat("=", 24))
 
-	// Look for ISO files
-	fmt.Println("Looking for .iso files...")
+	// Look for decrypted archives
+	fmt.Println("Looking for .tar files...")
 	err := filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
-		if !d.IsDir() && strings.HasSuffix(strings.ToLower(d.Name()), ".iso") {
+		if !d.IsDir() && strings.HasSuffix(strings.ToLower(d.Name()), ".tar") {
 			info, err := d.Info()
 			if err != nil {
 				return nil
 			}
-			fmt.Printf("%s📀 Found ISO: %s (%.2f MB)%s\n", 
+			fmt.Printf("%s📦 Found archive: %s (%.2f MB)%s\n",
 				ColorGreen, d.Name(), float64(info.Size())/1024/1024, ColorReset)
 		}
 		return nil
@@ -448,7 +456,7 @@ func testISOContents() {
 		return
 	}
 
-	fmt.Print("\nEnter ISO filename to examine: ")
+	fmt.Print("\nEnter archive filename to examine: ")
 	filename := strings.TrimSpace(getUserInput())
 
 	if filename == "" {
@@ -456,18 +464,44 @@ func testISOContents() {
 		return
 	}
 
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		fmt.Printf("%s❌ File '%s' not found%s\n", ColorRed, filename, ColorReset)
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("%s❌ Cannot open '%s': %v%s\n", ColorRed, filename, err, ColorReset)
 		return
 	}
+	defer file.Close()
 
-	fmt.Printf("%s🔍 Instructions to examine ISO:%s\n", ColorBlue, ColorReset)
-	fmt.Printf("1. Copy ISO to your Mac: %s\n", filename)
-	fmt.Printf("2. Double-click it in Finder to mount\n")
-	fmt.Printf("3. Browse /Volumes/mounted_volume to see your backup files\n")
-	fmt.Printf("4. Check for /etc, /var, /usr directories to verify it's your system\n")
+	entries, dirs := 0, 0
+	var totalSize int64
+	var info []byte
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("%s❌ Archive is damaged after %d entries: %v%s\n", ColorRed, entries, err, ColorReset)
+			return
+		}
+		entries++
+		if header.Typeflag == tar.TypeDir {
+			dirs++
+		}
+		totalSize += header.Size
+		if strings.HasPrefix(header.Name, "snapshot_info/") && header.Typeflag == tar.TypeReg {
+			info, _ = io.ReadAll(reader)
+		}
+	}
+
+	fmt.Printf("%s✅ %d entries (%d directories, %.2f MB of file data)%s\n",
+		ColorGreen, entries, dirs, float64(totalSize)/1024/1024, ColorReset)
+	if info != nil {
+		fmt.Println()
+		fmt.Print(string(info))
+	}
 	fmt.Println()
-	fmt.Printf("%s💡 Tip: Look for /app/keys/ to verify it's your container backup%s\n", ColorYellow, ColorReset)
+	fmt.Printf("%s💡 Tip: run 'tar -tvf %s' and look for app/keys/ to verify it's your container backup%s\n", ColorYellow, filename, ColorReset)
 }
 
 func getUserInput() string {